@@ -0,0 +1,693 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// bibEntry is an entry of a .bib file. @string, @preamble and @comment
+// blocks are entries too, with no key.
+type bibEntry struct {
+	Type   string // Lower case
+	Key    string
+	Fields []bibField
+	Line   int
+	Start  int // Offset of the @
+	End    int // Offset just past the closing delimiter
+}
+
+// bibField is a field of an entry. Value is the text as written, with its
+// braces or quotes and any # concatenation.
+type bibField struct {
+	Name      string // Lower case
+	Value     string
+	NameStart int // Offset of the name in the file
+	Start     int // Offset of Value in the file
+	End       int
+}
+
+// bibFile is a parsed .bib file
+type bibFile struct {
+	Path    string
+	Content string
+	Entries []*bibEntry
+}
+
+// isReference reports whether e is a reference rather than an @string,
+// @preamble or @comment block
+func (e *bibEntry) isReference() bool {
+	return e.Type != "string" && e.Type != "preamble" && e.Type != "comment"
+}
+
+// name identifies e in messages
+func (e *bibEntry) name() string {
+	if e.Key != "" {
+		return e.Key
+	}
+	return "@" + e.Type
+}
+
+// field returns the value of a field without its outer braces or quotes, or
+// "" if e doesn't have it
+func (e *bibEntry) field(name string) string {
+	for _, f := range e.Fields {
+		if f.Name == name {
+			return unquoteBib(f.Value)
+		}
+	}
+	return ""
+}
+
+// macros returns the @string definitions of f by lower-cased name
+func (f *bibFile) macros() map[string]string {
+	macros := make(map[string]string)
+	for _, e := range f.Entries {
+		if e.Type == "string" {
+			for _, field := range e.Fields {
+				macros[field.Name] = unquoteBib(field.Value)
+			}
+		}
+	}
+	return macros
+}
+
+// bibValue returns a field of e like field, with a value that is an
+// @string name replaced by its definition
+func bibValue(e *bibEntry, name string, macros map[string]string) string {
+	for _, f := range e.Fields {
+		if f.Name == name {
+			if definition, ok := macros[strings.ToLower(f.Value)]; ok {
+				return definition
+			}
+			return unquoteBib(f.Value)
+		}
+	}
+	return ""
+}
+
+// unquoteBib removes the braces or quotes around a single-part value
+func unquoteBib(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return value
+	}
+	if value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	if value[0] == '{' {
+		if inner, end := readGroup(value, 0); end == len(value) {
+			return inner
+		}
+	}
+	return value
+}
+
+// readBib reads and parses a .bib file
+func readBib(path string) (*bibFile, []texDiagnostic, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	f, diags := parseBib(path, string(data))
+	return f, diags, nil
+}
+
+// bibParser reads the entries of a .bib file the way BibTeX does: text
+// outside entries is a comment and braces nest everywhere, backslashes
+// included. Syntax errors are collected so that the rest of the file is
+// still read.
+type bibParser struct {
+	path    string
+	content string
+	lines   []int // Offsets at which lines start
+	diags   []texDiagnostic
+}
+
+// parseBib parses the content of a .bib file. Entries that are broken, such
+// as by unbalanced braces, are reported and end at the next line starting
+// with @.
+func parseBib(path string, content string) (*bibFile, []texDiagnostic) {
+	p := &bibParser{path: path, content: content, lines: []int{0}}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			p.lines = append(p.lines, i+1)
+		}
+	}
+
+	f := &bibFile{Path: path, Content: content}
+	pos := 0
+	var last *bibEntry
+	for {
+		at := strings.IndexByte(content[pos:], '@')
+		if at < 0 {
+			p.checkTrailing(last, len(content))
+			break
+		}
+		start := pos + at
+		p.checkTrailing(last, start)
+		entry := p.entry(start)
+		if entry == nil {
+			// An @ in a comment between entries
+			pos = start + 1
+			continue
+		}
+		f.Entries = append(f.Entries, entry)
+		last = entry
+		pos = entry.End
+	}
+	return f, p.diags
+}
+
+// line returns the line number of an offset
+func (p *bibParser) line(offset int) int {
+	return sort.SearchInts(p.lines, offset+1)
+}
+
+func (p *bibParser) errorf(offset int, format string, args ...interface{}) {
+	p.diags = append(p.diags, texDiagnostic{File: p.path, Line: p.line(offset), Level: "error", Message: fmt.Sprintf(format, args...)})
+}
+
+// isBibIdent reports whether b can be part of a key, field name, number or
+// @string name
+func isBibIdent(b byte) bool {
+	return b > ' ' && !strings.ContainsRune("\"#%'(),={}@", rune(b))
+}
+
+func (p *bibParser) skipSpace(i int) int {
+	for i < len(p.content) && strings.IndexByte(" \t\r\n", p.content[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+// nextEntry returns the offset of the next line starting with @ after i,
+// where parsing resumes after an error
+func (p *bibParser) nextEntry(i int) int {
+	for {
+		nl := strings.IndexByte(p.content[i:], '\n')
+		if nl < 0 {
+			return len(p.content)
+		}
+		i += nl + 1
+		if j := p.skipSpace(i); j < len(p.content) && p.content[j] == '@' {
+			return j
+		}
+	}
+}
+
+// entry parses the entry whose @ is at start, or returns nil if there is no
+// entry there
+func (p *bibParser) entry(start int) *bibEntry {
+	c := p.content
+	i := start + 1
+	for i < len(c) && isBibIdent(c[i]) {
+		i++
+	}
+	typ := strings.ToLower(c[start+1 : i])
+	i = p.skipSpace(i)
+	if typ == "" || i >= len(c) || (c[i] != '{' && c[i] != '(') {
+		return nil
+	}
+	closing := byte('}')
+	if c[i] == '(' {
+		closing = ')'
+	}
+	e := &bibEntry{Type: typ, Line: p.line(start), Start: start}
+
+	// Comments and preambles are kept as they are
+	if typ == "comment" || typ == "preamble" {
+		end := p.group(i, closing)
+		if end < 0 {
+			p.errorf(start, "@%s is not closed; its braces are unbalanced", typ)
+			e.End = p.nextEntry(start)
+			return e
+		}
+		e.End = end
+		return e
+	}
+
+	i++
+	if typ != "string" {
+		i = p.skipSpace(i)
+		j := i
+		for j < len(c) && c[j] != ',' && c[j] != closing && isBibIdent(c[j]) {
+			j++
+		}
+		e.Key = c[i:j]
+		if e.Key == "" {
+			p.errorf(start, "@%s entry has no key", typ)
+		}
+		i = j
+	}
+
+	for {
+		i = p.skipSpace(i)
+		if i >= len(c) {
+			p.errorf(start, "%s is not closed; its braces are unbalanced", e.name())
+			e.End = len(c)
+			return e
+		}
+		if c[i] == closing {
+			e.End = i + 1
+			return e
+		}
+		if c[i] == ',' {
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(c) && isBibIdent(c[j]) {
+			j++
+		}
+		if j == i {
+			p.errorf(i, "unexpected %q in %s", c[i], e.name())
+			e.End = p.nextEntry(i)
+			return e
+		}
+		name := strings.ToLower(c[i:j])
+		j = p.skipSpace(j)
+		if j >= len(c) || c[j] != '=' {
+			p.errorf(i, "field %s of %s has no value", name, e.name())
+			e.End = p.nextEntry(i)
+			return e
+		}
+		valueStart := p.skipSpace(j + 1)
+		valueEnd, ok := p.value(valueStart)
+		if !ok {
+			p.errorf(valueStart, "unbalanced braces in the %s of %s", name, e.name())
+			e.End = p.nextEntry(valueStart)
+			return e
+		}
+		e.Fields = append(e.Fields, bibField{Name: name, Value: c[valueStart:valueEnd], NameStart: i, Start: valueStart, End: valueEnd})
+
+		i = p.skipSpace(valueEnd)
+		if i < len(c) && c[i] == '@' {
+			// The value closed the entry's brace and ran into the next one
+			p.errorf(valueStart, "unbalanced braces in the %s of %s", name, e.name())
+			e.End = i
+			return e
+		}
+		if i < len(c) && c[i] != ',' && c[i] != closing {
+			p.errorf(i, "missing comma after the %s of %s", name, e.name())
+		}
+	}
+}
+
+// value returns the end of the field value starting at i: braced or quoted
+// strings, numbers and @string names joined with #
+func (p *bibParser) value(i int) (int, bool) {
+	c := p.content
+	for {
+		switch {
+		case i >= len(c):
+			return i, false
+		case c[i] == '{':
+			if i = p.group(i, '}'); i < 0 {
+				return i, false
+			}
+		case c[i] == '"':
+			if i = p.group(i, '"'); i < 0 {
+				return i, false
+			}
+		case isBibIdent(c[i]):
+			for i < len(c) && isBibIdent(c[i]) {
+				i++
+			}
+		default:
+			return i, false
+		}
+		end := i
+		if i = p.skipSpace(i); i >= len(c) || c[i] != '#' {
+			return end, true
+		}
+		i = p.skipSpace(i + 1)
+	}
+}
+
+// group returns the offset just past the group opened at i and ended by
+// closing, or -1 if it isn't closed before the end of the file or a line
+// starting with @ and an entry type, which means its braces are unbalanced
+func (p *bibParser) group(i int, closing byte) int {
+	c := p.content
+	depth := 0
+	for j := i + 1; j < len(c); j++ {
+		switch {
+		case c[j] == closing && depth == 0:
+			return j + 1
+		case c[j] == '{':
+			depth++
+		case c[j] == '}':
+			depth--
+			if depth < 0 {
+				return -1
+			}
+		case c[j] == '\n':
+			if k := p.skipSpace(j + 1); k < len(c) && c[k] == '@' && bibEntryStartRe.MatchString(c[k:]) {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// bibEntryStartRe matches the start of an entry
+var bibEntryStartRe = regexp.MustCompile(`^@[a-zA-Z]+\s*[{(]`)
+
+// checkTrailing reports text between the end of entry and the offset next
+// that looks like more fields, which happens when a closing brace too many
+// ends the entry early
+func (p *bibParser) checkTrailing(entry *bibEntry, next int) {
+	if entry == nil || entry.End >= next {
+		return
+	}
+	text := strings.TrimSpace(p.content[entry.End:next])
+	if strings.HasPrefix(text, ",") || strings.HasPrefix(text, "}") || bibFieldLineRe.MatchString(text) {
+		p.errorf(entry.End, "text after the end of %s looks like more fields; its braces are unbalanced", entry.name())
+	}
+}
+
+// bibFieldLineRe matches a line that starts a field
+var bibFieldLineRe = regexp.MustCompile(`(?m)^\s*[a-zA-Z]+\s*=\s*[{"0-9]`)
+
+// bibRequired are the fields the standard BibTeX styles need for each entry
+// type. Alternatives are separated by |.
+var bibRequired = map[string][]string{
+	"article":       {"author", "title", "journal", "year"},
+	"book":          {"author|editor", "title", "publisher", "year"},
+	"booklet":       {"title"},
+	"inbook":        {"author|editor", "title", "chapter|pages", "publisher", "year"},
+	"incollection":  {"author", "title", "booktitle", "publisher", "year"},
+	"inproceedings": {"author", "title", "booktitle", "year"},
+	"conference":    {"author", "title", "booktitle", "year"},
+	"manual":        {"title"},
+	"mastersthesis": {"author", "title", "school", "year"},
+	"phdthesis":     {"author", "title", "school", "year"},
+	"proceedings":   {"title", "year"},
+	"techreport":    {"author", "title", "institution", "year"},
+	"unpublished":   {"author", "title", "note"},
+}
+
+// bibFieldAliases are the biblatex names that stand in for a BibTeX field
+var bibFieldAliases = map[string][]string{
+	"year":    {"date"},
+	"journal": {"journaltitle"},
+	"school":  {"institution"},
+}
+
+var (
+	// doiRe matches a bare DOI
+	doiRe = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+	// doiPrefixRe matches what people put in front of a DOI
+	doiPrefixRe = regexp.MustCompile(`(?i)^(?:https?://(?:dx\.)?doi\.org/|doi:\s*)`)
+)
+
+// lintBib checks the entries of f for problems bibtex or biber trip over or
+// that produce a wrong bibliography. Non-ASCII characters are only a problem
+// for bibtex; biber reads UTF-8.
+func lintBib(f *bibFile, biber bool) []texDiagnostic {
+	diags := []texDiagnostic{}
+	add := func(e *bibEntry, level string, format string, args ...interface{}) {
+		diags = append(diags, texDiagnostic{File: f.Path, Line: e.Line, Level: level, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// BibTeX compares keys without case
+	first := make(map[string]*bibEntry)
+	for _, e := range f.Entries {
+		if !e.isReference() || e.Key == "" {
+			continue
+		}
+		if other, ok := first[strings.ToLower(e.Key)]; ok {
+			add(e, "error", "duplicate key %s (first defined on line %d)", e.Key, other.Line)
+			continue
+		}
+		first[strings.ToLower(e.Key)] = e
+
+		// Fields come from the cross-referenced entry
+		if e.field("crossref") == "" && e.field("xdata") == "" {
+			for _, required := range bibRequired[e.Type] {
+				if !hasBibField(e, strings.Split(required, "|")) {
+					add(e, "warning", "%s %s has no %s", e.Type, e.Key, strings.ReplaceAll(required, "|", " or "))
+				}
+			}
+		}
+
+		if doi := strings.TrimSpace(e.field("doi")); doi != "" {
+			if bare := doiPrefixRe.ReplaceAllString(doi, ""); bare != doi && doiRe.MatchString(bare) {
+				add(e, "warning", "the doi of %s should be the bare DOI %s; styles add the resolver themselves", e.Key, bare)
+			} else if !doiRe.MatchString(doi) {
+				add(e, "warning", "malformed doi %q in %s", doi, e.Key)
+			}
+		}
+
+		if !biber {
+			if chars := nonASCII(e.Key); chars != "" {
+				add(e, "warning", "key %s has non-ASCII characters (%s); bibtex can't sort or match it reliably", e.Key, chars)
+			}
+			for _, field := range e.Fields {
+				if chars := nonASCII(field.Value); chars != "" {
+					add(e, "warning", "non-ASCII characters in the %s of %s (%s); bibtex garbles them when sorting, abbreviating names or changing case, use LaTeX accents such as {\\\"o}", field.Name, e.Key, chars)
+				}
+			}
+		}
+	}
+	return diags
+}
+
+// hasBibField reports whether e has one of the fields in names, or a
+// biblatex alias of one
+func hasBibField(e *bibEntry, names []string) bool {
+	for _, name := range names {
+		for _, alias := range append([]string{name}, bibFieldAliases[name]...) {
+			if strings.TrimSpace(e.field(alias)) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nonASCII lists the distinct non-ASCII characters of s, with the LaTeX
+// replacement where one is known
+func nonASCII(s string) string {
+	seen := make(map[rune]bool)
+	chars := []string{}
+	for _, r := range s {
+		if r < 0x80 || seen[r] {
+			continue
+		}
+		seen[r] = true
+		if repl, ok := unicodeReplacements[r]; ok && repl != "" {
+			chars = append(chars, fmt.Sprintf("%c U+%04X, write %s", r, r, repl))
+		} else {
+			chars = append(chars, fmt.Sprintf("%c U+%04X", r, r))
+		}
+	}
+	return strings.Join(chars, "; ")
+}
+
+var (
+	// auxCitationRe matches the citations bibtex (\citation{a,b}) and
+	// biblatex (\abx@aux@cite{0}{a}, or \abx@aux@cite{a} before 3.12) write
+	// to the .aux file
+	auxCitationRe = regexp.MustCompile(`\\(?:citation|abx@aux@cite(?:\{\d+\})?)\{([^}]*)\}`)
+	// auxInputRe matches the .aux files of \include'd files
+	auxInputRe = regexp.MustCompile(`\\@input\{([^}]*)\}`)
+)
+
+// citedKeys returns the keys cited by texFile, read from the .aux files of
+// its discovery run in outDir. The engine has resolved every citation
+// command, including ones hidden in macros. \nocite{*} gives "*".
+func citedKeys(texFile string, outDir string) ([]string, error) {
+	keys := []string{}
+	seen := make(map[string]bool)
+	var read func(aux string) error
+	read = func(aux string) error {
+		if seen[aux] {
+			return nil
+		}
+		seen[aux] = true
+		data, err := ioutil.ReadFile(aux)
+		if err != nil {
+			return err
+		}
+		for _, m := range auxCitationRe.FindAllStringSubmatch(string(data), -1) {
+			for _, key := range strings.Split(m[1], ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					keys = append(keys, key)
+				}
+			}
+		}
+		for _, m := range auxInputRe.FindAllStringSubmatch(string(data), -1) {
+			// A chapter that was never included has no .aux
+			if err := read(filepath.Join(filepath.Dir(aux), m[1])); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	aux := strings.TrimSuffix(flsPath(texFile, outDir), ".fls") + ".aux"
+	if err := read(aux); err != nil {
+		return nil, fmt.Errorf("error reading citations: %v", err)
+	}
+	return keys, nil
+}
+
+// usesBiber reports whether content, or a local class or package it loads,
+// loads biblatex with the biber backend, its default
+func usesBiber(content string) bool {
+	sources := []string{content}
+	for _, f := range localEmbeds(content, []string{".cls", ".sty"}) {
+		if data, err := ioutil.ReadFile(f); err == nil {
+			sources = append(sources, string(data))
+		}
+	}
+	for _, source := range sources {
+		for _, load := range parseLoads(source) {
+			if load.Name == "biblatex" && load.Ext == ".sty" && !strings.Contains(strings.ReplaceAll(load.Options, " ", ""), "backend=bibtex") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usedBibKeys returns the lower-cased keys of the entries of f that the
+// documents need: those cited and the entries they cross-reference
+func usedBibKeys(f *bibFile, cited map[string]bool) map[string]bool {
+	byKey := make(map[string]*bibEntry)
+	for _, e := range f.Entries {
+		if e.isReference() && e.Key != "" {
+			if _, ok := byKey[strings.ToLower(e.Key)]; !ok {
+				byKey[strings.ToLower(e.Key)] = e
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	var use func(key string)
+	use = func(key string) {
+		key = strings.ToLower(strings.TrimSpace(key))
+		e, ok := byKey[key]
+		if !ok || used[key] {
+			return
+		}
+		used[key] = true
+		for _, field := range []string{"crossref", "xref", "xdata"} {
+			for _, parent := range strings.Split(e.field(field), ",") {
+				use(parent)
+			}
+		}
+	}
+	for key := range cited {
+		if key == "*" {
+			for k := range byKey {
+				use(k)
+			}
+		}
+		use(key)
+	}
+	return used
+}
+
+// trimBib returns the content of f with only the used references, keeping
+// every @string and @preamble
+func trimBib(f *bibFile, used map[string]bool) string {
+	var b strings.Builder
+	for _, e := range f.Entries {
+		if e.Type == "comment" || (e.isReference() && !used[strings.ToLower(e.Key)]) {
+			continue
+		}
+		b.WriteString(strings.TrimSpace(f.Content[e.Start:e.End]))
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// BibReport summarizes a .bib file from the command line
+type BibReport struct {
+	File        string   `json:"file"`
+	Entries     int      `json:"entries"`
+	Unused      []string `json:"unused"`
+	Trimmed     bool     `json:"trimmed"`
+	Abbreviated int      `json:"abbreviated"` // Journal names changed by -journals
+}
+
+// printBibDiagnostics prints lint and journal diagnostics, records them in
+// the report and returns the number of errors
+func printBibDiagnostics(diags []texDiagnostic) int {
+	errorCount := 0
+	for _, diag := range diags {
+		if diag.Level == "error" {
+			errorCount++
+			logger.Errorf("%s:%d: %s", diag.File, diag.Line, diag.Message)
+		} else {
+			logger.log(LevelWarn, StyleWarn, "%s:%d: %s", diag.File, diag.Line, diag.Message)
+			report.setStageStatus("warning")
+		}
+	}
+	report.addDiagnostics(diags...)
+	return errorCount
+}
+
+// checkBibFile lints the .bib file path and writes its staged copy with the
+// journal names abbreviated for journals (if not nil) and, if trim is set,
+// only the entries the documents cite. It returns the number of errors found.
+func checkBibFile(path string, staged string, cited map[string]bool, biber bool, trim bool, journals *journalTable) (int, error) {
+	f, diags, err := readBib(path)
+	if err != nil {
+		return 0, err
+	}
+	diags = append(diags, lintBib(f, biber)...)
+
+	content := f.Content
+	result := BibReport{File: path, Unused: []string{}}
+	if journals != nil {
+		edits, journalDiags := journals.bibEdits(f)
+		diags = append(diags, journalDiags...)
+		content = applyBibEdits(content, edits)
+		result.Abbreviated = len(edits)
+	}
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].Line < diags[j].Line })
+	errorCount := printBibDiagnostics(diags)
+
+	used := usedBibKeys(f, cited)
+	for _, e := range f.Entries {
+		if !e.isReference() {
+			continue
+		}
+		result.Entries++
+		if e.Key != "" && !used[strings.ToLower(e.Key)] {
+			result.Unused = append(result.Unused, e.Key)
+		}
+	}
+	if len(result.Unused) > 0 && trim {
+		abbreviated, _ := parseBib(path, content)
+		content = trimBib(abbreviated, used)
+		result.Trimmed = true
+	}
+	if content != f.Content {
+		if err := ioutil.WriteFile(staged, []byte(content), 0644); err != nil {
+			return errorCount, fmt.Errorf("error writing %s: %v", staged, err)
+		}
+	}
+
+	if result.Abbreviated > 0 {
+		logger.Notef("%s: %d journal name(s) abbreviated for %s", path, result.Abbreviated, journals.Profile)
+	}
+	if result.Trimmed {
+		logger.Notef("%s: shipping the %d cited of %d entries", path, result.Entries-len(result.Unused), result.Entries)
+	} else if len(result.Unused) > 0 {
+		logger.Notef("%s: %d of %d entries are not cited (-bib-trim ships only the cited ones)", path, len(result.Unused), result.Entries)
+		logger.Debugf("Not cited: %s", strings.Join(result.Unused, ", "))
+	} else if errorCount == 0 {
+		logger.Successf("%s: %d entries checked", path, result.Entries)
+	}
+	report.update(func() { report.Bibliographies = append(report.Bibliographies, result) })
+	return errorCount, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCitedKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			"bibtex",
+			map[string]string{"main.aux": "\\relax\n\\citation{a,b}\n\\citation{ c }\n\\bibstyle{plain}\n"},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"biblatex",
+			map[string]string{"main.aux": "\\abx@aux@refcontext{nty/global//global/global}\n\\abx@aux@cite{0}{Smith2020}\n\\abx@aux@segm{0}{0}{Smith2020}\n\\abx@aux@cite{0}{Doe2019}\n"},
+			[]string{"Smith2020", "Doe2019"},
+		},
+		{
+			"old biblatex",
+			map[string]string{"main.aux": "\\abx@aux@cite{Jones}\n"},
+			[]string{"Jones"},
+		},
+		{
+			"nocite all",
+			map[string]string{"main.aux": "\\citation{*}\n"},
+			[]string{"*"},
+		},
+		{
+			"included chapters",
+			map[string]string{
+				"main.aux":          "\\citation{a}\n\\@input{chapters/one.aux}\n\\@input{two.aux}\n",
+				"chapters/one.aux":  "\\citation{b}\n",
+				"chapters/skip.aux": "\\citation{unused}\n",
+			},
+			[]string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+				os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+			}
+			got, err := citedKeys("paper/main.tex", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("citedKeys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := citedKeys("main.tex", t.TempDir()); err == nil {
+		t.Error("citedKeys without a .aux file returned no error")
+	}
+}
+
+// bibSummary lists the entries of f as name:line and diags as line: message
+func bibSummary(f *bibFile, diags []texDiagnostic) ([]string, []string) {
+	entries, messages := []string{}, []string{}
+	for _, e := range f.Entries {
+		entries = append(entries, fmt.Sprintf("%s:%d", e.name(), e.Line))
+	}
+	for _, d := range diags {
+		messages = append(messages, fmt.Sprintf("%d: %s", d.Line, d.Message))
+	}
+	return entries, messages
+}
+
+func TestParseBib(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		entries []string
+		diags   []string
+	}{
+		{
+			"well formed",
+			"@String{jacs = \"J. Am. Chem. Soc.\"}\n% @misc in a comment\n@article{a,\n  title = {A {Nested} Title},\n  journal = jacs # \" (Suppl.)\",\n  year = 2020\n}\n@Book(b, title = \"B\")\n",
+			[]string{"@string:1", "a:3", "b:8"},
+			[]string{},
+		},
+		{
+			"unbalanced brace in a field",
+			"@article{a,\n  title = {Broken,\n  year = 2020\n}\n@article{b, title = {B}}\n",
+			[]string{"a:1", "b:5"},
+			[]string{"2: unbalanced braces in the title of a"},
+		},
+		{
+			"closing brace too many",
+			"@article{a,\n  title = {A}},\n  year = 2020\n}\n@article{b, title = {B}}\n",
+			[]string{"a:1", "b:5"},
+			[]string{"2: text after the end of a looks like more fields; its braces are unbalanced"},
+		},
+		{
+			"missing comma",
+			"@article{a,\n  title = {A}\n  year = 2020\n}\n",
+			[]string{"a:1"},
+			[]string{"3: missing comma after the title of a"},
+		},
+		{
+			"field without value",
+			"@article{a,\n  title\n}\n@article{b, title = {B}}\n",
+			[]string{"a:1", "b:4"},
+			[]string{"2: field title of a has no value"},
+		},
+		{
+			"no key",
+			"@article{,\n  title = {A}\n}\n",
+			[]string{"@article:1"},
+			[]string{"1: @article entry has no key"},
+		},
+		{
+			"not closed",
+			"@comment{x\n@article{a, title = {A}",
+			[]string{"@comment:1", "a:2"},
+			[]string{"1: @comment is not closed; its braces are unbalanced", "2: a is not closed; its braces are unbalanced"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, diags := bibSummary(parseBib("refs.bib", tt.content))
+			if !reflect.DeepEqual(entries, tt.entries) {
+				t.Errorf("entries = %q, want %q", entries, tt.entries)
+			}
+			if !reflect.DeepEqual(diags, tt.diags) {
+				t.Errorf("diagnostics = %q, want %q", diags, tt.diags)
+			}
+		})
+	}
+
+	f, _ := parseBib("refs.bib", "@article{a, title = {A {B}}, pages = \"1--2\"}")
+	if got := f.Entries[0].field("title"); got != "A {B}" {
+		t.Errorf("field(title) = %q, want %q", got, "A {B}")
+	}
+	if got := f.Entries[0].field("pages"); got != "1--2" {
+		t.Errorf("field(pages) = %q, want %q", got, "1--2")
+	}
+}
+
+func TestLintBib(t *testing.T) {
+	content := `@article{ok, author = {A}, title = {T}, journal = {J}, year = 2020, doi = {10.1000/xyz}}
+@article{OK, author = {B}}
+@article{bare, author = {A}, title = {T}, journaltitle = {J}, date = {2020}, doi = {https://doi.org/10.1000/abc}}
+@book{nodoi, editor = {E}, title = {T}, publisher = {P}, year = 2020, doi = {xyz}}
+@inproceedings{child, crossref = {ok}}
+@misc{Müller, title = {Über 1–2}}
+@string{s = "ignored"}
+`
+	f, _ := parseBib("refs.bib", content)
+	tests := []struct {
+		biber bool
+		want  []string
+	}{
+		{false, []string{
+			"2: duplicate key OK (first defined on line 1)",
+			"3: the doi of bare should be the bare DOI 10.1000/abc; styles add the resolver themselves",
+			"4: malformed doi \"xyz\" in nodoi",
+			"6: key Müller has non-ASCII characters (ü U+00FC); bibtex can't sort or match it reliably",
+			"6: non-ASCII characters in the title of Müller (Ü U+00DC; – U+2013, write --); bibtex garbles them when sorting, abbreviating names or changing case, use LaTeX accents such as {\\\"o}",
+		}},
+		{true, []string{
+			"2: duplicate key OK (first defined on line 1)",
+			"3: the doi of bare should be the bare DOI 10.1000/abc; styles add the resolver themselves",
+			"4: malformed doi \"xyz\" in nodoi",
+		}},
+	}
+	for _, tt := range tests {
+		_, got := bibSummary(f, lintBib(f, tt.biber))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lintBib(biber=%v) = %q, want %q", tt.biber, got, tt.want)
+		}
+	}
+
+	f, _ = parseBib("refs.bib", "@article{short, title = {T}}\n@phdthesis{thesis, author = {A}, title = {T}, institution = {I}, date = 2020}\n")
+	want := []string{"1: article short has no author", "1: article short has no journal", "1: article short has no year"}
+	if _, got := bibSummary(f, lintBib(f, true)); !reflect.DeepEqual(got, want) {
+		t.Errorf("lintBib = %q, want %q", got, want)
+	}
+}
+
+func TestTrimBib(t *testing.T) {
+	content := `@preamble{"\newcommand{\noop}[1]{}"}
+@string{jacs = "J. Am. Chem. Soc."}
+@comment{old entries below}
+@proceedings{conf, title = {Conference}}
+@inproceedings{talk, crossref = {Conf}, title = {Talk}}
+@article{Cited, journal = jacs}
+@article{unused, title = {U}}
+@set{both, xdata = {Cited,talk}}
+`
+	f, _ := parseBib("refs.bib", content)
+	tests := []struct {
+		name  string
+		cited []string
+		used  []string
+	}{
+		{"case insensitive", []string{"cited"}, []string{"cited"}},
+		{"crossref", []string{"talk"}, []string{"conf", "talk"}},
+		{"xdata list", []string{"both"}, []string{"both", "cited", "conf", "talk"}},
+		{"nocite all", []string{"*"}, []string{"both", "cited", "conf", "talk", "unused"}},
+		{"unknown key", []string{"missing"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cited := make(map[string]bool)
+			for _, key := range tt.cited {
+				cited[key] = true
+			}
+			used := usedBibKeys(f, cited)
+			got := []string{}
+			for key := range used {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.used) {
+				t.Errorf("usedBibKeys(%q) = %q, want %q", tt.cited, got, tt.used)
+			}
+		})
+	}
+
+	used := map[string]bool{"talk": true, "conf": true}
+	want := "@preamble{\"\\newcommand{\\noop}[1]{}\"}\n\n@string{jacs = \"J. Am. Chem. Soc.\"}\n\n@proceedings{conf, title = {Conference}}\n\n@inproceedings{talk, crossref = {Conf}, title = {Talk}}\n\n"
+	if got := trimBib(f, used); got != want {
+		t.Errorf("trimBib = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// maxBuildRuns limits the engine reruns of a full build
+const maxBuildRuns = 5
+
+var (
+	// rerunRe matches the log messages asking for another engine run
+	rerunRe = regexp.MustCompile(`Rerun to get|Please rerun LaTeX|Rerun LaTeX|\(rerunfilecheck\).*Rerun`)
+	// biberRe and bibtexRe match the log messages asking for the bibliography tool
+	biberRe  = regexp.MustCompile(`Please \(re\)run Biber|run Biber on the file`)
+	bibtexRe = regexp.MustCompile(`Please \(re\)run BibTeX|Please rerun BibTeX`)
+	// brokenDestRe matches hyperref links to destinations that don't exist
+	brokenDestRe = regexp.MustCompile(`warning \(dest\): name\{([^}]*)\} has been referenced but does not exist`)
+	// hypersetupRe matches the start of a \hypersetup group
+	hypersetupRe = regexp.MustCompile(`\\hypersetup\s*\{`)
+)
+
+// PDFReport is a compiled PDF and the problems found in it
+type PDFReport struct {
+	Path     string   `json:"path"`
+	Title    string   `json:"title"`
+	Author   string   `json:"author"`
+	Problems []string `json:"problems"`
+}
+
+// runEngine runs a full (non-draft) engine pass, with shell escape limited
+// to allow, and returns its output
+func runEngine(engine string, texFile string, allow []string) (string, error) {
+	logger.Debugf("Running %s on %s", engine, texFile)
+	cmd, finish := engineCommand(engine, allow, engineArgs(texFile, "", "-record")...)
+	output, err := cmd.CombinedOutput()
+	checkWrites(texFile, "", string(output))
+	if err = finish(err); err != nil {
+		return string(output), fmt.Errorf("%s failed for %s: %v", engine, texFile, err)
+	}
+	return string(output), nil
+}
+
+// buildPDF compiles texFile to PDF: the engine, then biber or bibtex if the
+// log asks for them, then reruns until cross references are stable. It
+// returns the output of the last engine run.
+func buildPDF(engine string, texFile string) (string, error) {
+	base := strings.TrimSuffix(texFile, ".tex")
+	ranBib := false
+	output := ""
+	for run := 1; run <= maxBuildRuns; run++ {
+		var err error
+		output, err = runEngine(engine, texFile, shellEscapeAllow)
+		if err != nil {
+			return output, err
+		}
+
+		if !ranBib && (biberRe.MatchString(output) || bibtexRe.MatchString(output)) {
+			tool := "bibtex"
+			if biberRe.MatchString(output) {
+				tool = "biber"
+			}
+			logger.Debugf("Running %s on %s", tool, base)
+			cmd, finish := toolCommand(tool, base)
+			cmd.Env = sandboxEnv(shellEscapeAllow)
+			bibOutput, err := cmd.CombinedOutput()
+			if err = finish(err); err != nil {
+				return output, fmt.Errorf("%s failed for %s: %v\nOutput: %s", tool, base, err, string(bibOutput))
+			}
+			ranBib = true
+			continue
+		}
+
+		if !rerunRe.MatchString(output) {
+			return output, nil
+		}
+	}
+	logger.Warnf("%s still asks for a rerun after %d runs", texFile, maxBuildRuns)
+	return output, nil
+}
+
+// hypersetupValue returns the value of key (e.g. pdftitle) in the last
+// \hypersetup of content, without surrounding braces
+func hypersetupValue(content string, key string) string {
+	value := ""
+	keyRe := regexp.MustCompile(`(?:^|[,\s])` + key + `\s*=\s*`)
+	for _, loc := range hypersetupRe.FindAllStringIndex(content, -1) {
+		group, end := readGroup(content, loc[1]-1)
+		if end < 0 {
+			continue
+		}
+		m := keyRe.FindStringIndex(group)
+		if m == nil {
+			continue
+		}
+		rest := group[m[1]:]
+		if strings.HasPrefix(rest, "{") {
+			if v, end := readGroup(rest, 0); end >= 0 {
+				value = v
+				continue
+			}
+		}
+		if i := strings.Index(rest, ","); i >= 0 {
+			rest = rest[:i]
+		}
+		value = strings.TrimSpace(rest)
+	}
+	return value
+}
+
+// pdfInfo reads the document information of a PDF with pdfinfo
+func pdfInfo(pdfFile string) (map[string]string, error) {
+	cmd, finish := toolCommand("pdfinfo", pdfFile)
+	output, err := cmd.CombinedOutput()
+	if err = finish(err); err != nil {
+		return nil, fmt.Errorf("pdfinfo failed for %s: %v", pdfFile, err)
+	}
+	info := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			info[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return info, nil
+}
+
+// normalizeMeta makes metadata comparable: TeX braces dropped and spaces collapsed
+func normalizeMeta(s string) string {
+	s = strings.NewReplacer("{", "", "}", "", "~", " ").Replace(s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// checkPDF compares the PDF metadata with the \hypersetup of texFile and
+// looks for broken links in the engine output. Fonts are checked by inspectPDF.
+func checkPDF(pdfFile string, texFile string, output string) PDFReport {
+	result := PDFReport{Path: pdfFile, Problems: []string{}}
+	content, _ := expandIncludes(texFile)
+	content = stripTexComments(content)
+	wantTitle := normalizeMeta(hypersetupValue(content, "pdftitle"))
+	wantAuthor := normalizeMeta(hypersetupValue(content, "pdfauthor"))
+
+	if _, err := exec.LookPath("pdfinfo"); err != nil {
+		logger.Warnf("pdfinfo not found; not checking the metadata of %s", pdfFile)
+	} else if info, err := pdfInfo(pdfFile); err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	} else {
+		result.Title = info["Title"]
+		result.Author = info["Author"]
+		// Values with macros can't be compared with the text pdfinfo shows
+		switch {
+		case result.Title == "":
+			result.Problems = append(result.Problems, "PDF has no title (set pdftitle in \\hypersetup)")
+		case wantTitle != "" && !strings.Contains(wantTitle, "\\") && normalizeMeta(result.Title) != wantTitle:
+			result.Problems = append(result.Problems, fmt.Sprintf("PDF title %q does not match pdftitle %q", result.Title, wantTitle))
+		}
+		switch {
+		case result.Author == "":
+			result.Problems = append(result.Problems, "PDF has no author (set pdfauthor in \\hypersetup)")
+		case wantAuthor != "" && !strings.Contains(wantAuthor, "\\") && normalizeMeta(result.Author) != wantAuthor:
+			result.Problems = append(result.Problems, fmt.Sprintf("PDF author %q does not match pdfauthor %q", result.Author, wantAuthor))
+		}
+	}
+
+	for _, m := range brokenDestRe.FindAllStringSubmatch(output, -1) {
+		result.Problems = append(result.Problems, fmt.Sprintf("broken link to %s", m[1]))
+	}
+	for _, diag := range parseTexDiagnostics(texFile, output) {
+		if strings.Contains(diag.Message, "undefined") && (strings.HasPrefix(diag.Message, "Reference") || strings.HasPrefix(diag.Message, "Citation")) {
+			result.Problems = append(result.Problems, diag.Message)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bundle modes for -bundle
+const (
+	BundleSingle = "single"  // One archive with every document
+	BundlePerDoc = "per-doc" // One archive per tex file or -group
+)
+
+// DefaultNameTemplate names archives after the project directory
+const DefaultNameTemplate = "{project}"
+
+// FigureBundleDoc is the {doc} of the figure archive and the -figures upload
+// directory; no document bundle may use it in per-doc mode
+const FigureBundleDoc = "figures"
+
+// emptyDocRe matches an unused {doc} with the separator that joins it to
+// the rest of the template
+var emptyDocRe = regexp.MustCompile(`[-_. ]+\{doc\}|\{doc\}[-_. ]*`)
+
+// bundleGroup is a named set of tex files archived together
+type bundleGroup struct {
+	Name     string
+	TexFiles []string
+}
+
+// groupFlag collects repeated -group NAME=a.tex,b.tex options
+type groupFlag []bundleGroup
+
+func (g *groupFlag) String() string {
+	parts := []string{}
+	for _, group := range *g {
+		parts = append(parts, group.Name+"="+strings.Join(group.TexFiles, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (g *groupFlag) Set(value string) error {
+	name, files, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.TrimSpace(files) == "" {
+		return fmt.Errorf("use NAME=file.tex[,file.tex...]")
+	}
+	group := bundleGroup{Name: name}
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			group.TexFiles = append(group.TexFiles, f)
+		}
+	}
+	*g = append(*g, group)
+	return nil
+}
+
+// bundle is one archive to write: its name without extension and the files
+// in the temp dir that go into it
+type bundle struct {
+	Name  string
+	Files []string
+}
+
+// bundleName expands {project}, {doc} and {date} in the -name template.
+// If the template has no {doc}, a non-empty doc is appended as a suffix so
+// that per-document archives never share a name. An empty doc drops {doc}
+// together with its separator, so {project}-{doc} gives "paper", not "paper-".
+func bundleName(tmpl string, project string, doc string) string {
+	if doc == "" {
+		tmpl = emptyDocRe.ReplaceAllString(tmpl, "")
+		if tmpl == "" {
+			tmpl = DefaultNameTemplate
+		}
+	}
+	name := strings.NewReplacer(
+		"{project}", project,
+		"{doc}", doc,
+		"{date}", time.Now().Format("2006-01-02"),
+	).Replace(tmpl)
+	if doc != "" && !strings.Contains(tmpl, "{doc}") {
+		name += "-" + doc
+	}
+	return name
+}
+
+// bundleDocs splits the tex files into the documents that get their own
+// archive: the -group options first, then every tex file not in a group
+func bundleDocs(config Config, texFiles []string) []bundleGroup {
+	docs := []bundleGroup{}
+	grouped := make(map[string]bool)
+	for _, group := range config.Groups {
+		doc := bundleGroup{Name: group.Name}
+		for _, f := range group.TexFiles {
+			doc.TexFiles = append(doc.TexFiles, filepath.Base(f))
+			grouped[filepath.Base(f)] = true
+		}
+		docs = append(docs, doc)
+	}
+	for _, texFile := range texFiles {
+		if !grouped[texFile] {
+			docs = append(docs, bundleGroup{Name: strings.TrimSuffix(texFile, ".tex"), TexFiles: []string{texFile}})
+		}
+	}
+	return docs
+}
+
+// makeBundles works out the archives to write. docFiles maps each tex file
+// to the files it needs and shared files go into every archive.
+func makeBundles(config Config, project string, texFiles []string, docFiles map[string][]string, shared []string) []bundle {
+	collect := func(texFiles []string) []string {
+		files := []string{}
+		seen := make(map[string]bool)
+		add := func(f string) {
+			if !seen[f] {
+				seen[f] = true
+				files = append(files, f)
+			}
+		}
+		for _, texFile := range texFiles {
+			for _, f := range docFiles[texFile] {
+				add(f)
+			}
+		}
+		for _, f := range shared {
+			add(f)
+		}
+		return files
+	}
+
+	bundles := []bundle{}
+	if config.Bundle == BundlePerDoc {
+		for _, doc := range bundleDocs(config, texFiles) {
+			bundles = append(bundles, bundle{
+				Name:  bundleName(config.NameTemplate, project, doc.Name),
+				Files: collect(doc.TexFiles),
+			})
+		}
+	} else {
+		bundles = append(bundles, bundle{
+			Name:  bundleName(config.NameTemplate, project, ""),
+			Files: collect(texFiles),
+		})
+	}
+
+	// A standalone bundle with every graphic, for portals that want figures separately
+	if config.FigureBundle {
+		figures := []string{}
+		seen := make(map[string]bool)
+		for _, b := range bundles {
+			for _, f := range b.Files {
+				if imageExts[strings.ToLower(filepath.Ext(f))] && !seen[f] && !isCompiledPDF(f, texFiles) {
+					seen[f] = true
+					figures = append(figures, f)
+				}
+			}
+		}
+		sort.Strings(figures)
+		bundles = append(bundles, bundle{Name: bundleName(config.NameTemplate, project, FigureBundleDoc), Files: figures})
+	}
+	return bundles
+}
+
+// checkBundleDocs fails if a document bundle would take the name of the
+// figure archive or the -figures upload directory
+func checkBundleDocs(config Config, texFiles []string) error {
+	if config.Bundle != BundlePerDoc || (!config.FigureBundle && config.FigureProfile == "") {
+		return nil
+	}
+	bases := []string{}
+	for _, texFile := range texFiles {
+		bases = append(bases, filepath.Base(texFile))
+	}
+	for _, doc := range bundleDocs(config, bases) {
+		if doc.Name == FigureBundleDoc {
+			return fmt.Errorf("the document bundle %q has the name reserved for the figures; rename the file or put it in a -group", doc.Name)
+		}
+	}
+	return nil
+}
+
+// isCompiledPDF reports whether f is the PDF of one of the tex files
+func isCompiledPDF(f string, texFiles []string) bool {
+	for _, texFile := range texFiles {
+		if f == strings.TrimSuffix(texFile, ".tex")+".pdf" {
+			return true
+		}
+	}
+	return false
+}
+
+// archivePaths returns the archives written for a bundle
+func archivePaths(config Config, b bundle) []string {
+	paths := []string{}
+	if config.CreateZip {
+		paths = append(paths, filepath.Join(config.OutputDir, b.Name+".zip"))
+	}
+	if config.CreateBz2 {
+		paths = append(paths, filepath.Join(config.OutputDir, b.Name+".tar.bz2"))
+	}
+	return paths
+}
+
+// writeBundles writes every bundle in each requested format. Existing
+// archives are checked for first so that nothing is half written.
+func writeBundles(config Config, bundles []bundle) error {
+	for _, b := range bundles {
+		for _, path := range archivePaths(config, b) {
+			if _, err := os.Stat(path); err == nil && !config.Overwrite {
+				return withExitCode(ExitArchive, fmt.Errorf("output file already exists: %s\nPlease remove it or choose a different output directory", path))
+			}
+		}
+	}
+
+	for _, b := range bundles {
+		// Paths are relative to the temp dir; only include files that actually exist
+		files := []string{}
+		for _, f := range b.Files {
+			fullPath := filepath.Join(config.TmpDir, f)
+			if _, err := os.Stat(fullPath); err == nil {
+				files = append(files, fullPath)
+			}
+		}
+
+		if config.CreateZip {
+			zipPath := filepath.Join(config.OutputDir, b.Name+".zip")
+			logger.Actionf("Creating ZIP archive: %s", zipPath)
+			if err := createZipArchive(zipPath, files); err != nil {
+				return withExitCode(ExitArchive, fmt.Errorf("error creating zip archive: %v", err))
+			}
+			report.addArchive(zipPath, "zip", b.Name)
+		}
+
+		if config.CreateBz2 {
+			bz2Path := filepath.Join(config.OutputDir, b.Name+".tar.bz2")
+			logger.Actionf("Creating tar.bz2 archive: %s", bz2Path)
+			if err := createBz2Archive(bz2Path, files); err != nil {
+				return withExitCode(ExitArchive, fmt.Errorf("error creating bz2 archive: %v", err))
+			}
+			report.addArchive(bz2Path, "tar.bz2", b.Name)
+		}
+	}
+	return nil
+}
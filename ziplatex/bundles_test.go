@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBundleName(t *testing.T) {
+	today := time.Now().Format("2006-01-02")
+	tests := []struct {
+		tmpl    string
+		project string
+		doc     string
+		want    string
+	}{
+		{DefaultNameTemplate, "paper", "", "paper"},
+		{DefaultNameTemplate, "paper", "si", "paper-si"},
+		{"{project}_{doc}", "paper", "main", "paper_main"},
+		{"{doc}", "paper", "figures", "figures"},
+		{"{project}-{date}", "paper", "", "paper-" + today},
+		{"{project}-{date}", "paper", "si", "paper-" + today + "-si"},
+		{"submission", "paper", "", "submission"},
+		{"{unknown}", "paper", "", "{unknown}"},
+		{"{project}-{doc}", "paper", "", "paper"},
+		{"{doc}_{project}", "paper", "", "paper"},
+		{"{project}-{doc}-{date}", "paper", "", "paper-" + today},
+		{"{doc}", "paper", "", "paper"},
+	}
+	for _, tt := range tests {
+		if got := bundleName(tt.tmpl, tt.project, tt.doc); got != tt.want {
+			t.Errorf("bundleName(%q, %q, %q) = %q, want %q", tt.tmpl, tt.project, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBundleDocs(t *testing.T) {
+	texFiles := []string{"manuscript.tex", "src/figures.tex"}
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"single archive", Config{Bundle: BundleSingle, FigureBundle: true}, false},
+		{"no figure archive", Config{Bundle: BundlePerDoc}, false},
+		{"figure archive", Config{Bundle: BundlePerDoc, FigureBundle: true}, true},
+		{"figure export", Config{Bundle: BundlePerDoc, FigureProfile: "tiff"}, true},
+		{"grouped", Config{Bundle: BundlePerDoc, FigureBundle: true, Groups: groupFlag{{Name: "all", TexFiles: []string{"manuscript.tex", "figures.tex"}}}}, false},
+		{"group named figures", Config{Bundle: BundlePerDoc, FigureBundle: true, Groups: groupFlag{{Name: "figures", TexFiles: []string{"manuscript.tex"}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkBundleDocs(tt.config, texFiles); (err != nil) != tt.wantErr {
+				t.Errorf("checkBundleDocs() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// cacheVersion is part of every key; bump it when an entry's meaning changes
+const cacheVersion = "2"
+
+// CacheReport counts the engine and latexpand runs served from the cache
+type CacheReport struct {
+	Dir    string `json:"dir"`
+	Hits   int64  `json:"hits"`
+	Misses int64  `json:"misses"`
+}
+
+// engineCache is a content-addressed cache of engine and latexpand runs. An
+// entry is looked up by a key made of the step, the tool, its arguments and
+// the main tex file, and is only used if every input it recorded still has
+// the same content. A nil *engineCache never hits and stores nothing.
+type engineCache struct {
+	dir   string
+	tools map[string]string // Tool name to path, size and modification time
+	env   []string          // TeX search path variables and distribution trees
+	stats *CacheReport
+}
+
+// cacheEntry is the stored result of one run and the inputs it depends on
+type cacheEntry struct {
+	Inputs      map[string]string `json:"inputs"` // Path to SHA-256, "" if the file must not exist
+	Deps        []string          `json:"deps,omitempty"`
+	Personal    []string          `json:"personal,omitempty"`
+	Generators  []string          `json:"generators,omitempty"`
+	Cited       []string          `json:"cited,omitempty"`
+	Diagnostics []texDiagnostic   `json:"diagnostics,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Content     string            `json:"content,omitempty"`
+}
+
+// defaultCacheDir returns the per-user cache directory, or "" if there is none
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ziplatex")
+}
+
+// newEngineCache opens the cache in dir. The tools are identified by their
+// path, size and modification time, so upgrading TeX invalidates the cache.
+// Which files a run finds, and which of them are personal, also depends on
+// the TeX search paths and the distribution trees in roots.
+func newEngineCache(dir string, roots *texRoots, tools ...string) (*engineCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %v", err)
+	}
+	c := &engineCache{dir: dir, tools: make(map[string]string), env: texPathEnv(os.Environ()), stats: &CacheReport{Dir: dir}}
+	if roots != nil {
+		c.env = append(c.env, fmt.Sprintf("roots %t %s", roots.known, strings.Join(roots.system, string(filepath.ListSeparator))))
+	}
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			c.tools[tool] = fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	report.update(func() { report.Cache = c.stats })
+	return c, nil
+}
+
+// texPathEnv returns the sorted variables of env that engines keep and that
+// change where kpathsea looks for files: the TeX and *INPUTS variables, and
+// HOME for TEXMFHOME. Locale and temp directories don't matter.
+func texPathEnv(env []string) []string {
+	vars := []string{}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == "HOME" || (keepEngineVar(name) && !engineEnvKeep[name] && !strings.HasPrefix(name, "LC_")) {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// hashFile returns the SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// key returns the key of running tool with args on texFile in the current
+// directory. The content of texFile is part of the key so that entries for
+// several versions of a document can coexist, and so are the TeX search
+// paths, so that changing TEXINPUTS or a texmf tree doesn't reuse old entries.
+func (c *engineCache) key(step string, texFile string, tool string, args ...string) string {
+	if c == nil {
+		return ""
+	}
+	cwd, _ := os.Getwd()
+	texHash, _ := hashFile(texFile)
+	h := sha256.New()
+	// Shell escape changes what an engine run may produce
+	parts := []string{cacheVersion, step, c.tools[tool], cwd, texFile, texHash, strings.Join(shellEscapeAllow, ","), fmt.Sprint(generatorShellEscape)}
+	parts = append(parts, c.env...)
+	for _, part := range append(parts, args...) {
+		fmt.Fprintf(h, "%s\x00", part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// path returns the file holding the entry for key
+func (c *engineCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// inputs hashes files for a new entry; missing files are recorded as such
+func (c *engineCache) inputs(files []string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	inputs := make(map[string]string)
+	for _, file := range files {
+		inputs[file], _ = hashFile(file)
+	}
+	return inputs
+}
+
+// docInputs are the inputs of an engine run on texFile: the files it read
+// and its .aux and .bbl, which change the result when they appear
+func docInputs(texFile string, deps []string, personal []string) []string {
+	base := strings.TrimSuffix(texFile, ".tex")
+	files := append([]string{base + ".aux", base + ".bbl"}, deps...)
+	return append(files, personal...)
+}
+
+// get returns the entry for key if all of its inputs are unchanged
+func (c *engineCache) get(key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err == nil {
+		err = json.Unmarshal(data, entry)
+	}
+	if err == nil {
+		for file, want := range entry.Inputs {
+			if got, _ := hashFile(file); got != want {
+				logger.Debugf("Cache entry %s is stale: %s changed", key[:12], file)
+				err = fmt.Errorf("stale")
+				break
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&c.stats.Misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.stats.Hits, 1)
+	return entry, true
+}
+
+// put stores entry under key. Failing to write the cache is not an error.
+func (c *engineCache) put(key string, entry *cacheEntry) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.path(key)), 0755)
+	}
+	if err == nil {
+		// Write and rename so concurrent runs never read half an entry
+		tmp := fmt.Sprintf("%s.%d.tmp", c.path(key), os.Getpid())
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, c.path(key))
+		}
+	}
+	if err != nil {
+		logger.Debugf("Could not write cache entry %s: %v", key[:12], err)
+	}
+}
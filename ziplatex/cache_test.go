@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTexPathEnv(t *testing.T) {
+	env := []string{"TMPDIR=/tmp", "TEXINPUTS=.:/a", "PATH=/bin", "HOME=/home/u", "LC_ALL=C", "BIBINPUTS=/b", "AWS_SECRET=x", "shell_escape=t"}
+	want := []string{"BIBINPUTS=/b", "HOME=/home/u", "TEXINPUTS=.:/a"}
+	if got := texPathEnv(env); !reflect.DeepEqual(got, want) {
+		t.Errorf("texPathEnv = %q, want %q", got, want)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	saved := report
+	defer func() { report = saved }()
+	report = newReport()
+	t.Chdir(t.TempDir())
+	os.WriteFile("main.tex", []byte(`\documentclass{article}`), 0644)
+	t.Setenv("TEXINPUTS", ".:/a")
+	t.Setenv("BIBINPUTS", "")
+	roots := &texRoots{system: []string{"/usr/share/texlive"}, known: true}
+
+	c, err := newEngineCache(t.TempDir(), roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := c.key("discovery", "main.tex", "pdflatex", "-draft")
+	if again := c.key("discovery", "main.tex", "pdflatex", "-draft"); again != key {
+		t.Errorf("key changed between calls: %s, %s", key, again)
+	}
+	if other := c.key("compile", "main.tex", "pdflatex", "-draft"); other == key {
+		t.Error("key doesn't depend on the step")
+	}
+	if other := c.key("discovery", "main.tex", "pdflatex"); other == key {
+		t.Error("key doesn't depend on the arguments")
+	}
+
+	changed := map[string]func(t *testing.T){
+		"tex file":  func(t *testing.T) { os.WriteFile("main.tex", []byte(`\documentclass{report}`), 0644) },
+		"TEXINPUTS": func(t *testing.T) { t.Setenv("TEXINPUTS", ".:/b") },
+		"BIBINPUTS": func(t *testing.T) { t.Setenv("BIBINPUTS", "/bib") },
+		"roots":     func(t *testing.T) { roots = &texRoots{system: []string{"/opt/texlive"}, known: true} },
+	}
+	for name, change := range changed {
+		t.Run(name, func(t *testing.T) {
+			os.WriteFile("main.tex", []byte(`\documentclass{article}`), 0644)
+			roots = &texRoots{system: []string{"/usr/share/texlive"}, known: true}
+			change(t)
+			c, err := newEngineCache(c.dir, roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.key("discovery", "main.tex", "pdflatex", "-draft"); got == key {
+				t.Errorf("changing the %s kept the key", name)
+			}
+		})
+	}
+}
+
+func TestCacheGetPut(t *testing.T) {
+	saved := report
+	defer func() { report = saved }()
+	report = newReport()
+	t.Chdir(t.TempDir())
+	os.WriteFile("main.tex", []byte(`\input{intro}`), 0644)
+	os.WriteFile("intro.tex", []byte("Hello"), 0644)
+
+	c, err := newEngineCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := c.key("discovery", "main.tex", "pdflatex")
+	if _, ok := c.get(key); ok {
+		t.Fatal("get hit an empty cache")
+	}
+	c.put(key, &cacheEntry{Inputs: c.inputs(docInputs("main.tex", []string{"main.tex", "intro.tex"}, nil)), Deps: []string{"intro.tex"}})
+	entry, ok := c.get(key)
+	if !ok || !reflect.DeepEqual(entry.Deps, []string{"intro.tex"}) {
+		t.Fatalf("get = %+v, %v, want the stored entry", entry, ok)
+	}
+
+	// An input edited after put makes the entry stale
+	os.WriteFile("intro.tex", []byte("Hello, world"), 0644)
+	if _, ok := c.get(key); ok {
+		t.Error("get hit after intro.tex changed")
+	}
+	os.WriteFile("intro.tex", []byte("Hello"), 0644)
+	if _, ok := c.get(key); !ok {
+		t.Error("get missed after intro.tex was restored")
+	}
+
+	// So does an input that didn't exist appearing
+	os.WriteFile("main.bbl", []byte(`\begin{thebibliography}{1}`), 0644)
+	if _, ok := c.get(key); ok {
+		t.Error("get hit after main.bbl appeared")
+	}
+	if c.stats.Hits != 2 || c.stats.Misses != 3 {
+		t.Errorf("stats = %+v, want 2 hits and 3 misses", c.stats)
+	}
+}
@@ -2,15 +2,14 @@ package main
 
 import (
 	"fmt"
-	"os/exec"
 	"strings"
 )
 
 // checkRequirements verifies that all required external tools are available
-func checkRequirements(needsBzip2 bool) error {
-	// Check pdflatex
-	if err := checkTool("pdflatex", "--version"); err != nil {
-		return fmt.Errorf("pdflatex not found or not working: %v\nPlease install MacTeX or TeX Live", err)
+func checkRequirements(engine string, needsBzip2 bool) error {
+	// Check the TeX engine
+	if err := checkTool(engine, "--version"); err != nil {
+		return fmt.Errorf("%s not found or not working: %v\nPlease install MacTeX or TeX Live", engine, err)
 	}
 	
 	// Check latexpand
@@ -30,8 +29,9 @@ func checkRequirements(needsBzip2 bool) error {
 
 // checkTool verifies a command exists and can be executed
 func checkTool(tool string, arg string) error {
-	cmd := exec.Command(tool, arg)
+	cmd, finish := toolCommand(tool, arg)
 	output, err := cmd.CombinedOutput()
+	err = finish(err)
 	
 	if err != nil {
 		// Check if it's a "command not found" error
@@ -49,8 +49,9 @@ func checkTool(tool string, arg string) error {
 
 // getToolVersion returns version info for a tool (for debugging)
 func getToolVersion(tool string, arg string) string {
-	cmd := exec.Command(tool, arg)
+	cmd, finish := toolCommand(tool, arg)
 	output, err := cmd.CombinedOutput()
+	err = finish(err)
 	
 	if err != nil && len(output) == 0 {
 		return "unknown"
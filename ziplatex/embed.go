@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// loadRe matches the commands that load a class, package or style, with
+	// their optional arguments. The mandatory argument is read with readGroup.
+	loadRe = regexp.MustCompile(`\\(documentclass|LoadClass|LoadClassWithOptions|usepackage|RequirePackage|RequirePackageWithOptions|bibliographystyle)\s*(?:\[([^\]]*)\])?\s*\{`)
+	// documentclassRe finds the line that loads the class
+	documentclassRe = regexp.MustCompile(`(?m)^[ \t]*\\documentclass\b`)
+	// latexReleaseRe reads the kernel date from latexrelease.sty
+	latexReleaseRe = regexp.MustCompile(`\\def\\latexreleaseversion\{(\d{4}-\d{2}-\d{2})\}`)
+)
+
+// embedExts are the kinds of local files embedded with filecontents*
+var embedExts = []string{".cls", ".sty", ".bst", ".cbx", ".bbx"}
+
+// texLoad is a file loaded by a tex file, e.g. {rcclab .cls} for \documentclass{rcclab}
+type texLoad struct {
+	Name    string
+	Ext     string
+	Options string
+}
+
+// parseLoads returns the classes, packages and styles loaded by content,
+// including the biblatex styles named in the options of the class or of
+// biblatex. Comments are ignored.
+func parseLoads(content string) []texLoad {
+	content = stripTexComments(content)
+	loads := []texLoad{}
+	for _, m := range loadRe.FindAllStringSubmatchIndex(content, -1) {
+		cmd := content[m[2]:m[3]]
+		options := ""
+		if m[4] >= 0 {
+			options = content[m[4]:m[5]]
+		}
+		arg, end := readGroup(content, m[1]-1)
+		if end < 0 {
+			continue
+		}
+
+		ext := ".sty"
+		switch {
+		case strings.Contains(cmd, "Class") || cmd == "documentclass":
+			ext = ".cls"
+		case cmd == "bibliographystyle":
+			ext = ".bst"
+		}
+		for _, name := range strings.Split(arg, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.Contains(name, "\\") {
+				continue
+			}
+			loads = append(loads, texLoad{Name: name, Ext: ext, Options: options})
+			if name == "biblatex" || ext == ".cls" {
+				loads = append(loads, biblatexStyles(options)...)
+			}
+		}
+	}
+	return loads
+}
+
+// biblatexStyles returns the .bbx and .cbx files named by the style,
+// bibstyle and citestyle options of biblatex (or a class passing them on)
+func biblatexStyles(options string) []texLoad {
+	loads := []texLoad{}
+	for _, opt := range strings.Split(options, ",") {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), "{}")
+		if value == "" || strings.Contains(value, "\\") {
+			continue
+		}
+		switch key {
+		case "style":
+			loads = append(loads, texLoad{Name: value, Ext: ".bbx"}, texLoad{Name: value, Ext: ".cbx"})
+		case "bibstyle":
+			loads = append(loads, texLoad{Name: value, Ext: ".bbx"})
+		case "citestyle":
+			loads = append(loads, texLoad{Name: value, Ext: ".cbx"})
+		}
+	}
+	return loads
+}
+
+// localEmbeds returns the local files content needs that should be embedded,
+// following the loads of embedded classes and packages. exts limits the kinds
+// of files; files that don't exist in the current directory are ignored.
+func localEmbeds(content string, exts []string) []string {
+	wanted := make(map[string]bool)
+	for _, ext := range exts {
+		wanted[ext] = true
+	}
+
+	files := []string{}
+	seen := make(map[string]bool)
+	var visit func(content string)
+	visit = func(content string) {
+		for _, load := range parseLoads(content) {
+			file := load.Name
+			if filepath.Ext(file) != load.Ext {
+				file += load.Ext
+			}
+			file = filepath.Clean(file)
+			if seen[file] || !wanted[load.Ext] || filepath.IsAbs(file) || strings.HasPrefix(file, "..") || !fileExists(file) {
+				continue
+			}
+			seen[file] = true
+			files = append(files, file)
+			// A local class or package may load other local files
+			if load.Ext == ".cls" || load.Ext == ".sty" {
+				if data, err := ioutil.ReadFile(file); err == nil {
+					visit(string(data))
+				}
+			}
+		}
+	}
+	visit(content)
+	return files
+}
+
+// findCustomClass looks for the class file name in classPath, a list of
+// class files and directories separated by the OS path list separator. The
+// first entry that is, or contains, a file with that name wins.
+func findCustomClass(name string, classPath string) string {
+	for _, entry := range filepath.SplitList(classPath) {
+		info, err := os.Stat(entry)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			if filepath.Base(entry) == name {
+				return entry
+			}
+			continue
+		}
+		if candidate := filepath.Join(entry, name); fileExists(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// filecontentsOverwrite reports whether the LaTeX kernel supports the
+// [overwrite] option of filecontents, added in the 2019-10-01 release. If the
+// release can't be found a current kernel is assumed.
+func filecontentsOverwrite() bool {
+	cmd, finish := toolCommand("kpsewhich", "latexrelease.sty")
+	path, err := cmd.Output()
+	if finish(err) != nil {
+		return true
+	}
+	data, err := ioutil.ReadFile(strings.TrimSpace(string(path)))
+	if err != nil {
+		return true
+	}
+	m := latexReleaseRe.FindSubmatch(data)
+	return m == nil || string(m[1]) >= "2019-10-01"
+}
+
+// embedFile inserts a filecontents* environment holding data right before
+// the \documentclass line of content, so the file is written before the
+// class or any package is loaded
+func embedFile(content string, name string, data string, overwrite bool) (string, error) {
+	loc := documentclassRe.FindStringIndex(stripTexCommentsKeepOffsets(content))
+	if loc == nil {
+		return "", fmt.Errorf("no \\documentclass to embed %s before", name)
+	}
+	if !strings.HasSuffix(data, "\n") {
+		data += "\n"
+	}
+	option := ""
+	if overwrite {
+		option = "[overwrite]"
+	}
+	block := fmt.Sprintf("\\begin{filecontents*}%s{%s}\n%s\\end{filecontents*}\n", option, name, data)
+	return content[:loc[0]] + block + content[loc[0]:], nil
+}
+
+// isEmbedded reports whether content already has a filecontents environment for name
+func isEmbedded(content string, name string) bool {
+	re := regexp.MustCompile(`\\begin\{filecontents\*?\}(?:\[[^\]]*\])?\{` + regexp.QuoteMeta(name) + `\}`)
+	return re.MatchString(content)
+}
+
+// stripTexCommentsKeepOffsets blanks out comments with spaces so that
+// offsets found in the result are valid in the original content
+func stripTexCommentsKeepOffsets(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		stripped := stripTexComment(line)
+		lines[i] = stripped + strings.Repeat(" ", len(line)-len(stripped))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLoads(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []texLoad
+	}{
+		{
+			"class",
+			`\documentclass[11pt,a4paper]{rcclab}`,
+			[]texLoad{{Name: "rcclab", Ext: ".cls", Options: "11pt,a4paper"}},
+		},
+		{
+			"package list",
+			"\\usepackage{amsmath, mymacros}\n\\RequirePackage[final]{lab}",
+			[]texLoad{{Name: "amsmath", Ext: ".sty"}, {Name: "mymacros", Ext: ".sty"}, {Name: "lab", Ext: ".sty", Options: "final"}},
+		},
+		{
+			"class and style files",
+			"\\LoadClass{article}\n\\bibliographystyle{labstyle}",
+			[]texLoad{{Name: "article", Ext: ".cls"}, {Name: "labstyle", Ext: ".bst"}},
+		},
+		{
+			"biblatex styles",
+			`\usepackage[backend=biber, style=lab, citestyle={authoryear}]{biblatex}`,
+			[]texLoad{
+				{Name: "biblatex", Ext: ".sty", Options: "backend=biber, style=lab, citestyle={authoryear}"},
+				{Name: "lab", Ext: ".bbx"}, {Name: "lab", Ext: ".cbx"}, {Name: "authoryear", Ext: ".cbx"},
+			},
+		},
+		{
+			"biblatex style through the class",
+			`\documentclass[bibstyle=lab]{report}`,
+			[]texLoad{{Name: "report", Ext: ".cls", Options: "bibstyle=lab"}, {Name: "lab", Ext: ".bbx"}},
+		},
+		{
+			"spaces before the argument",
+			"\\usepackage [draft] \n {lab}",
+			[]texLoad{{Name: "lab", Ext: ".sty", Options: "draft"}},
+		},
+		{
+			"comments and macros",
+			"% \\usepackage{old}\n\\usepackage{\\mypkg}\n\\usepackage{kept} % \\usepackage{other}",
+			[]texLoad{{Name: "kept", Ext: ".sty"}},
+		},
+		{
+			"no argument",
+			`\usepackage`,
+			[]texLoad{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLoads(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLoads(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metadataRecord is a reference from a metadata store, with its fields in
+// BibTeX form
+type metadataRecord struct {
+	Source string // Store file
+	Title  string
+	Year   string
+	Short  string            // Abbreviated journal name, if the store has one
+	Fields map[string]string // doi, journal, volume and pages
+}
+
+// metadataStore indexes the records of the metadata files by DOI and title
+type metadataStore struct {
+	byDOI   map[string][]*metadataRecord
+	byTitle map[string][]*metadataRecord
+	count   int
+}
+
+// loadMetadataStore reads CSL-JSON (.json) and BibTeX files, such as a
+// library exported from Zotero
+func loadMetadataStore(paths []string) (*metadataStore, error) {
+	store := &metadataStore{byDOI: make(map[string][]*metadataRecord), byTitle: make(map[string][]*metadataRecord)}
+	for _, path := range paths {
+		var records []*metadataRecord
+		var err error
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			records, err = readCSLJSON(path)
+		} else {
+			records, err = readBibStore(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugf("%s: %d records", path, len(records))
+		for _, r := range records {
+			if doi := normalizeDOI(r.Fields["doi"]); doi != "" {
+				store.byDOI[doi] = append(store.byDOI[doi], r)
+			}
+			if title := normalizeTitle(r.Title); title != "" {
+				store.byTitle[title] = append(store.byTitle[title], r)
+			}
+		}
+		store.count += len(records)
+	}
+	return store, nil
+}
+
+// cslItem holds the CSL-JSON variables enrich uses. Exporters write some of
+// them as strings, numbers or lists, so they are decoded by cslString.
+type cslItem struct {
+	Title          json.RawMessage `json:"title"`
+	ContainerTitle json.RawMessage `json:"container-title"`
+	ShortTitle     json.RawMessage `json:"container-title-short"`
+	JournalAbbrev  json.RawMessage `json:"journalAbbreviation"`
+	Volume         json.RawMessage `json:"volume"`
+	Page           json.RawMessage `json:"page"`
+	DOI            json.RawMessage `json:"DOI"`
+	Issued         struct {
+		DateParts [][]json.RawMessage `json:"date-parts"`
+		Raw       string              `json:"raw"`
+	} `json:"issued"`
+}
+
+// cslString returns a CSL-JSON value as a string: the first element of a
+// list, or a number as written
+func cslString(raw json.RawMessage) string {
+	var value interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &value) != nil {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		if len(v) > 0 {
+			first, _ := json.Marshal(v[0])
+			return cslString(first)
+		}
+	}
+	return ""
+}
+
+var (
+	// pageRangeRe matches the dash of a page range in any of its forms
+	pageRangeRe = regexp.MustCompile(`\s*[-‐‑–—]+\s*`)
+	// yearRe finds the year in a date
+	yearRe = regexp.MustCompile(`\d{4}`)
+)
+
+// readCSLJSON reads a CSL-JSON file, a list of items
+func readCSLJSON(path string) ([]*metadataRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	items := []cslItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("error reading %s: not a CSL-JSON list of items: %v", path, err)
+	}
+
+	records := []*metadataRecord{}
+	for _, item := range items {
+		r := &metadataRecord{
+			Source: path,
+			Title:  cslString(item.Title),
+			Year:   yearRe.FindString(item.Issued.Raw),
+			Short:  cslString(item.ShortTitle),
+			Fields: map[string]string{
+				"doi":     doiPrefixRe.ReplaceAllString(cslString(item.DOI), ""),
+				"journal": cslString(item.ContainerTitle),
+				"volume":  cslString(item.Volume),
+				"pages":   pageRangeRe.ReplaceAllString(cslString(item.Page), "--"),
+			},
+		}
+		if r.Short == "" {
+			r.Short = cslString(item.JournalAbbrev)
+		}
+		if len(item.Issued.DateParts) > 0 && len(item.Issued.DateParts[0]) > 0 {
+			r.Year = cslString(item.Issued.DateParts[0][0])
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// readBibStore reads the references of a .bib file used as a metadata store
+func readBibStore(path string) ([]*metadataRecord, error) {
+	f, diags, err := readBib(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(diags) > 0 {
+		logger.Warnf("%s has %d syntax error(s); the broken entries may be incomplete", path, len(diags))
+	}
+	macros := f.macros()
+
+	records := []*metadataRecord{}
+	for _, e := range f.Entries {
+		if !e.isReference() {
+			continue
+		}
+		r := &metadataRecord{
+			Source: path,
+			Title:  bibValue(e, "title", macros),
+			Year:   yearRe.FindString(bibValue(e, "year", macros) + " " + bibValue(e, "date", macros)),
+			Short:  bibValue(e, "shortjournal", macros),
+			Fields: map[string]string{
+				"doi":     doiPrefixRe.ReplaceAllString(bibValue(e, "doi", macros), ""),
+				"journal": bibValue(e, "journal", macros),
+				"volume":  bibValue(e, "volume", macros),
+				"pages":   bibValue(e, "pages", macros),
+			},
+		}
+		if r.Fields["journal"] == "" {
+			r.Fields["journal"] = bibValue(e, "journaltitle", macros)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// normalizeDOI returns a DOI in the form used to compare DOIs
+func normalizeDOI(doi string) string {
+	return strings.ToLower(doiPrefixRe.ReplaceAllString(strings.TrimSpace(doi), ""))
+}
+
+// latexCommandRe matches a control word or symbol such as \textit or \'
+var latexCommandRe = regexp.MustCompile(`\\(?:[a-zA-Z]+|.)`)
+
+// accentFolds maps accented letters to the letter they are written on
+var accentFolds = func() map[rune]rune {
+	folds := make(map[rune]rune)
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđ", 'e': "èéêëēĕėęě", 'g': "ĝğġģ",
+		'i': "ìíîïĩīĭįı", 'l': "ĺļľŀł", 'n': "ñńņňŉ", 'o': "òóôõöøōŏő", 'r': "ŕŗř",
+		's': "śŝşšș", 't': "ţťŧț", 'u': "ùúûüũūŭůűų", 'y': "ýÿŷ", 'z': "źżž",
+	} {
+		for _, r := range accented {
+			folds[r] = base
+		}
+	}
+	return folds
+}()
+
+// normalizeTitle reduces a title or journal name to its lower-case letters
+// and digits, so that {\"o}, \"o and ö compare equal
+func normalizeTitle(title string) string {
+	return strings.Join(titleWords(title), "")
+}
+
+// titleWords returns the words of a title or journal name, lower case and
+// without accents or LaTeX commands
+func titleWords(title string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(latexCommandRe.ReplaceAllString(title, "")) {
+		if base, ok := accentFolds[r]; ok {
+			r = base
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+// journalStopWords are left out of abbreviated journal names
+var journalStopWords = map[string]bool{"of": true, "the": true, "and": true, "for": true, "in": true, "on": true, "de": true, "der": true, "fur": true}
+
+// abbreviates reports whether short is an abbreviation of the journal name
+// full, such as J. Am. Chem. Soc. of Journal of the American Chemical
+// Society: every word of short starts the next word of full, and the words of
+// full it skips are stop words
+func abbreviates(short string, full string) bool {
+	shortWords, fullWords := titleWords(short), titleWords(full)
+	i := 0
+	for _, word := range fullWords {
+		if i < len(shortWords) && strings.HasPrefix(word, shortWords[i]) {
+			i++
+		} else if !journalStopWords[word] {
+			return false
+		}
+	}
+	return i == len(shortWords) && i > 0
+}
+
+// match returns the record for a reference: the one with its DOI, or else
+// the only one with its title and year. When the title matches but no record
+// can be told apart from the others, the record is nil and skipped says why.
+func (s *metadataStore) match(doi string, title string, year string) (r *metadataRecord, skipped string) {
+	if records := s.byDOI[normalizeDOI(doi)]; doi != "" && len(records) > 0 {
+		return records[0], ""
+	}
+	if title = normalizeTitle(title); title == "" || len(s.byTitle[title]) == 0 {
+		return nil, ""
+	}
+	if year == "" {
+		return nil, "the title matches but the entry has no year to compare"
+	}
+	var candidates []*metadataRecord
+	undated := 0
+	for _, r := range s.byTitle[title] {
+		switch {
+		case r.Year == "":
+			undated++
+		case r.Year == year:
+			candidates = append(candidates, r)
+		}
+	}
+	switch {
+	case len(candidates) == 0 && undated > 0:
+		return nil, "the title matches but the record has no year to compare"
+	case len(candidates) == 0:
+		return nil, ""
+	}
+	// Copies of one paper in several store files share its DOI
+	first := normalizeDOI(candidates[0].Fields["doi"])
+	for _, r := range candidates[1:] {
+		if first == "" || normalizeDOI(r.Fields["doi"]) != first {
+			return nil, fmt.Sprintf("%d records have the title and year %s", len(candidates), year)
+		}
+	}
+	return candidates[0], ""
+}
+
+// enrichFields returns the fields enrich completes for an entry type
+func enrichFields(entryType string) []string {
+	if entryType == "article" {
+		return []string{"doi", "journal", "volume", "pages"}
+	}
+	return []string{"doi"}
+}
+
+// sameBibValue reports whether two values of a field mean the same
+func sameBibValue(field string, value string, r *metadataRecord) bool {
+	other := r.Fields[field]
+	switch field {
+	case "doi":
+		return normalizeDOI(value) == normalizeDOI(other)
+	case "journal":
+		return normalizeTitle(value) == normalizeTitle(other) || (r.Short != "" && normalizeTitle(value) == normalizeTitle(r.Short)) ||
+			abbreviates(value, other) || abbreviates(other, value)
+	case "pages":
+		return pageRangeRe.ReplaceAllString(value, "-") == pageRangeRe.ReplaceAllString(other, "-")
+	}
+	return strings.TrimSpace(value) == strings.TrimSpace(other)
+}
+
+// BibFieldChange is a field enrich filled in, or one whose value differs
+// from the metadata store
+type BibFieldChange struct {
+	Key     string `json:"key"`
+	Line    int    `json:"line"`
+	Field   string `json:"field"`
+	Current string `json:"current,omitempty"`
+	Store   string `json:"store"`
+	Source  string `json:"source"`
+}
+
+// BibIncomplete is an entry that still lacks fields after enriching
+type BibIncomplete struct {
+	Key     string   `json:"key"`
+	Line    int      `json:"line"`
+	Missing []string `json:"missing"`
+	Matched bool     `json:"matched"` // Found in the metadata store
+}
+
+// BibAmbiguous is an entry whose title matches store records that enrich
+// can't choose between
+type BibAmbiguous struct {
+	Key    string `json:"key"`
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// EnrichFileReport is the outcome of enriching one .bib file
+type EnrichFileReport struct {
+	File        string           `json:"file"`
+	Entries     int              `json:"entries"`
+	Filled      []BibFieldChange `json:"filled"`
+	Conflicts   []BibFieldChange `json:"conflicts"`
+	Incomplete  []BibIncomplete  `json:"incomplete"`
+	Ambiguous   []BibAmbiguous   `json:"ambiguous"`
+	Diagnostics []texDiagnostic  `json:"diagnostics"`
+	Written     bool             `json:"written"`
+}
+
+// EnrichReport is the JSON report of ziplatex enrich
+type EnrichReport struct {
+	Schema   int                `json:"schema"`
+	Status   string             `json:"status"`
+	ExitCode int                `json:"exit_code"`
+	Error    string             `json:"error,omitempty"`
+	Stores   []string           `json:"stores"`
+	Records  int                `json:"records"`
+	Files    []EnrichFileReport `json:"files"`
+}
+
+// bibEdit replaces the text between Start and End of a .bib file
+type bibEdit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// applyBibEdits applies edits that don't overlap to content
+func applyBibEdits(content string, edits []bibEdit) string {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].Start > edits[j].Start })
+	for _, edit := range edits {
+		content = content[:edit.Start] + edit.Text + content[edit.End:]
+	}
+	return content
+}
+
+// addBibFields returns the edit adding fields (name and value pairs) at the
+// end of e, following the layout of its last field: on its own line with the
+// same indentation, or on the same line for one-line entries, with a
+// trailing comma if the entry has one and names capitalized like its first
+// field
+func addBibFields(f *bibFile, e *bibEntry, fields [][2]string) bibEdit {
+	end := e.End - 1
+	for end > e.Start && strings.IndexByte(" \t\r\n", f.Content[end-1]) >= 0 {
+		end--
+	}
+	trailingComma := f.Content[end-1] == ','
+
+	sep, capitalize := "\n  ", false
+	if len(e.Fields) > 0 {
+		first, last := e.Fields[0], e.Fields[len(e.Fields)-1]
+		capitalize = f.Content[first.NameStart] >= 'A' && f.Content[first.NameStart] <= 'Z'
+		lineStart := strings.LastIndexByte(f.Content[:last.NameStart], '\n') + 1
+		if indent := f.Content[lineStart:last.NameStart]; strings.TrimSpace(indent) == "" {
+			sep = "\n" + indent
+		} else {
+			sep = " "
+		}
+	}
+
+	var b strings.Builder
+	for _, field := range fields {
+		name := field[0]
+		if capitalize {
+			name = strings.ToUpper(name[:1]) + name[1:]
+		}
+		if trailingComma {
+			fmt.Fprintf(&b, "%s%s = {%s},", sep, name, field[1])
+		} else {
+			fmt.Fprintf(&b, ",%s%s = {%s}", sep, name, field[1])
+		}
+	}
+	return bibEdit{Start: end, End: end, Text: b.String()}
+}
+
+// unescapedAmpRe matches an & that isn't written as \&
+var unescapedAmpRe = regexp.MustCompile(`(^|[^\\])&`)
+
+// escapeBibValue escapes the ampersands of a plain-text value from the store;
+// DOIs are written as they are
+func escapeBibValue(field string, value string) string {
+	if field == "doi" {
+		return value
+	}
+	return unescapedAmpRe.ReplaceAllString(value, `$1\&`)
+}
+
+// enrichBib completes the entries of the .bib file path from store. Filled
+// fields are written back only if write is set and the file has no syntax
+// errors.
+func enrichBib(path string, store *metadataStore, write bool) (EnrichFileReport, error) {
+	result := EnrichFileReport{File: path, Filled: []BibFieldChange{}, Conflicts: []BibFieldChange{}, Incomplete: []BibIncomplete{}, Ambiguous: []BibAmbiguous{}, Diagnostics: []texDiagnostic{}}
+	f, diags, err := readBib(path)
+	if err != nil {
+		return result, err
+	}
+	result.Diagnostics = append(result.Diagnostics, diags...)
+	for _, diag := range diags {
+		logger.Errorf("%s:%d: %s", diag.File, diag.Line, diag.Message)
+	}
+	macros := f.macros()
+
+	edits := []bibEdit{}
+	for _, e := range f.Entries {
+		if !e.isReference() || e.Key == "" {
+			continue
+		}
+		result.Entries++
+		r, skipped := store.match(bibValue(e, "doi", macros), bibValue(e, "title", macros),
+			yearRe.FindString(bibValue(e, "year", macros)+" "+bibValue(e, "date", macros)))
+		if skipped != "" {
+			result.Ambiguous = append(result.Ambiguous, BibAmbiguous{Key: e.Key, Line: e.Line, Reason: skipped})
+			logger.log(LevelWarn, StyleWarn, "%s:%d: %s: not filled: %s; add its doi", path, e.Line, e.Key, skipped)
+		}
+
+		missing, added := []string{}, [][2]string{}
+		for _, field := range enrichFields(e.Type) {
+			current := strings.TrimSpace(bibValue(e, field, macros))
+			if current == "" && field == "journal" {
+				current = strings.TrimSpace(bibValue(e, "journaltitle", macros))
+			}
+			switch {
+			case r == nil || r.Fields[field] == "":
+				if current == "" {
+					missing = append(missing, field)
+				}
+			case current == "":
+				value := escapeBibValue(field, r.Fields[field])
+				result.Filled = append(result.Filled, BibFieldChange{Key: e.Key, Line: e.Line, Field: field, Store: value, Source: r.Source})
+				logger.Notef("%s:%d: %s: adding %s = {%s} from %s", path, e.Line, e.Key, field, value, r.Source)
+				if edit, ok := replaceEmptyBibField(e, field, value); ok {
+					edits = append(edits, edit)
+				} else {
+					added = append(added, [2]string{field, value})
+				}
+			case !sameBibValue(field, current, r):
+				result.Conflicts = append(result.Conflicts, BibFieldChange{Key: e.Key, Line: e.Line, Field: field, Current: current, Store: r.Fields[field], Source: r.Source})
+				logger.log(LevelWarn, StyleWarn, "%s:%d: %s: %s is %q but %s has %q; keeping it", path, e.Line, e.Key, field, current, r.Source, r.Fields[field])
+			}
+		}
+		if len(added) > 0 {
+			edits = append(edits, addBibFields(f, e, added))
+		}
+		if len(missing) > 0 {
+			result.Incomplete = append(result.Incomplete, BibIncomplete{Key: e.Key, Line: e.Line, Missing: missing, Matched: r != nil})
+			where := "not in the metadata store"
+			if r != nil {
+				where = "the metadata store doesn't have it either"
+			}
+			logger.Infof("%s:%d: %s: no %s (%s)", path, e.Line, e.Key, strings.Join(missing, ", "), where)
+		}
+	}
+
+	if !write || len(edits) == 0 {
+		return result, nil
+	}
+	if len(diags) > 0 {
+		logger.Warnf("not writing %s because of its syntax errors", path)
+		return result, nil
+	}
+	if err := writeFileAtomic(path, []byte(applyBibEdits(f.Content, edits))); err != nil {
+		return result, err
+	}
+	result.Written = true
+	return result, nil
+}
+
+// replaceEmptyBibField returns the edit setting field of e if e has it with
+// an empty value, as in doi = {}
+func replaceEmptyBibField(e *bibEntry, field string, value string) (bibEdit, bool) {
+	for _, f := range e.Fields {
+		if f.Name == field {
+			return bibEdit{Start: f.Start, End: f.End, Text: "{" + value + "}"}, true
+		}
+	}
+	return bibEdit{}, false
+}
+
+// writeFileAtomic replaces path with data, keeping its permissions, so an
+// interrupted write never leaves half a file
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// listFlag collects the values of a repeatable option
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// enrichMain runs ziplatex enrich and returns its exit code
+func enrichMain(args []string) int {
+	var config Config
+	var stores listFlag
+	flags := flag.NewFlagSet("enrich", flag.ExitOnError)
+	flags.Var(&stores, "store", "CSL-JSON (.json) or BibTeX file with reference metadata, such as an exported Zotero library (repeatable)")
+	write := flags.Bool("w", false, "Write the filled fields into the .bib files")
+	jsonOutput := flags.Bool("json", false, "Print a machine-readable JSON report on stdout")
+	flags.BoolVar(&config.Quiet, "q", false, "Quiet: only show warnings and errors")
+	flags.BoolVar(&config.Verbose, "v", false, "Verbose: show debug messages")
+	flags.StringVar(&config.ColorMode, "color", ColorAuto, "Color output: auto, always or never")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s enrich -store FILE [-store FILE ...] [-w] [-json] [-q|-v] [-color MODE] refs.bib [more.bib ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Fills missing DOIs, journals, volumes and pages from local metadata and reports conflicting values.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config.Format = "text"
+	if *jsonOutput {
+		config.Format = "json"
+	}
+	if flags.NArg() == 0 || len(stores) == 0 {
+		flags.Usage()
+		return ExitUsage
+	}
+	if config.ColorMode != ColorAuto && config.ColorMode != ColorAlways && config.ColorMode != ColorNever {
+		usageFatalf("Unknown -color %q (use auto, always or never)", config.ColorMode)
+	}
+	if config.Quiet && config.Verbose {
+		usageFatalf("-q and -v cannot be used together")
+	}
+	closeLog, err := setupLogger(config)
+	if err != nil {
+		usageFatalf("%v", err)
+	}
+	defer closeLog()
+
+	result := EnrichReport{Schema: reportSchemaVersion, Status: "ok", Stores: stores, Files: []EnrichFileReport{}}
+	err = enrich(&result, stores, flags.Args(), *write)
+	if err != nil {
+		result.Status = "error"
+		result.ExitCode = exitCode(err)
+		result.Error = err.Error()
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	} else if err != nil {
+		logger.Errorf("%v", err)
+	}
+	return exitCode(err)
+}
+
+// enrich fills result by enriching each .bib file from the stores
+func enrich(result *EnrichReport, stores []string, files []string, write bool) error {
+	store, err := loadMetadataStore(stores)
+	if err != nil {
+		return err
+	}
+	result.Records = store.count
+	logger.Infof("Read %d records from %s", store.count, strings.Join(stores, ", "))
+
+	syntaxErrors := 0
+	for _, file := range files {
+		fileResult, err := enrichBib(file, store, write)
+		if err != nil {
+			return err
+		}
+		result.Files = append(result.Files, fileResult)
+		syntaxErrors += len(fileResult.Diagnostics)
+
+		summary := fmt.Sprintf("%s: %d field(s) filled, %d conflict(s), %d ambiguous, %d of %d entries incomplete", file, len(fileResult.Filled), len(fileResult.Conflicts), len(fileResult.Ambiguous), len(fileResult.Incomplete), fileResult.Entries)
+		if len(fileResult.Conflicts) > 0 || len(fileResult.Ambiguous) > 0 || len(fileResult.Incomplete) > 0 {
+			logger.Notef("%s", summary)
+		} else {
+			logger.Successf("%s", summary)
+		}
+		if len(fileResult.Filled) > 0 && !write {
+			logger.Infof("Run with -w to write the filled fields into %s", file)
+		}
+	}
+	if syntaxErrors > 0 {
+		return withExitCode(ExitBibliography, fmt.Errorf("%d syntax error(s) in the .bib files", syntaxErrors))
+	}
+	return nil
+}
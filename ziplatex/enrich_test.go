@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testStore = `@article{a, title = {Editorial}, year = 2020, doi = {10.1/a}}
+@article{b, title = {Editorial}, year = 2020, doi = {10.1/b}}
+@article{c, title = {Editorial}, year = 2021, doi = {10.1/c}}
+@article{d, title = {Deep {Learning}}, year = 2019, doi = {10.1/d}}
+@article{e, title = {Undated Paper}, doi = {10.1/e}}
+@article{f, title = {Copied Paper}, year = 2018, doi = {10.1/f}}
+@article{g, title = {Copied Paper}, year = 2018, doi = {https://doi.org/10.1/F}}
+`
+
+func TestMetadataStoreMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.bib")
+	if err := os.WriteFile(path, []byte(testStore), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := loadMetadataStore([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		doi     string
+		title   string
+		year    string
+		want    string // DOI of the matched record
+		skipped bool
+	}{
+		{"doi", "https://doi.org/10.1/b", "Editorial", "", "10.1/b", false},
+		{"title and year", "", "deep learning", "2019", "10.1/d", false},
+		{"only one with the year", "", "Editorial", "2021", "10.1/c", false},
+		{"several with the year", "", "Editorial", "2020", "", true},
+		{"entry without year", "", "Deep Learning", "", "", true},
+		{"record without year", "", "Undated Paper", "2017", "", true},
+		{"other year", "", "Deep Learning", "2005", "", false},
+		{"unknown title", "", "Something Else", "2019", "", false},
+		{"copies of one paper", "", "Copied Paper", "2018", "10.1/f", false},
+		{"unknown doi", "10.9/x", "Deep Learning", "2019", "10.1/d", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, skipped := store.match(tt.doi, tt.title, tt.year)
+			got := ""
+			if r != nil {
+				got = r.Fields["doi"]
+			}
+			if got != tt.want || (skipped != "") != tt.skipped {
+				t.Errorf("match(%q, %q, %q) = %q, %q; want %q, skipped %v", tt.doi, tt.title, tt.year, got, skipped, tt.want, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestAddBibFields(t *testing.T) {
+	fields := [][2]string{{"doi", "10.1/x"}, {"volume", "5"}}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			"own lines",
+			"@article{a,\n    title = {T},\n    year = 2020\n}\n",
+			"@article{a,\n    title = {T},\n    year = 2020,\n    doi = {10.1/x},\n    volume = {5}\n}\n",
+		},
+		{
+			"trailing comma",
+			"@article{a,\n\ttitle = {T},\n}\n",
+			"@article{a,\n\ttitle = {T},\n\tdoi = {10.1/x},\n\tvolume = {5},\n}\n",
+		},
+		{
+			"one line",
+			"@article{a, title = {T}, year = 2020}\n",
+			"@article{a, title = {T}, year = 2020, doi = {10.1/x}, volume = {5}}\n",
+		},
+		{
+			"capitalized names",
+			"@Article{a,\n  Title = {T}\n}\n",
+			"@Article{a,\n  Title = {T},\n  Doi = {10.1/x},\n  Volume = {5}\n}\n",
+		},
+		{
+			"no fields",
+			"@misc{a}\n",
+			"@misc{a,\n  doi = {10.1/x},\n  volume = {5}}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, diags := parseBib("refs.bib", tt.content)
+			if len(diags) > 0 {
+				t.Fatal(diags)
+			}
+			edit := addBibFields(f, f.Entries[0], fields)
+			if got := applyBibEdits(tt.content, []bibEdit{edit}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyBibEdits(t *testing.T) {
+	content := "@article{a, doi = {}, year = 2020}\n@article{b, year = 2021}\n"
+	f, _ := parseBib("refs.bib", content)
+	filled, ok := replaceEmptyBibField(f.Entries[0], "doi", "10.1/a")
+	if !ok {
+		t.Fatal("replaceEmptyBibField didn't find the empty doi")
+	}
+	if _, ok := replaceEmptyBibField(f.Entries[1], "doi", "10.1/b"); ok {
+		t.Error("replaceEmptyBibField found a doi in an entry without one")
+	}
+	// Given in file order, but applied from the end so offsets stay valid
+	edits := []bibEdit{
+		filled,
+		addBibFields(f, f.Entries[0], [][2]string{{"volume", "1"}}),
+		addBibFields(f, f.Entries[1], [][2]string{{"doi", "10.1/b"}}),
+		{Start: 1, End: 8, Text: "Article"},
+	}
+	want := "@Article{a, doi = {10.1/a}, year = 2020, volume = {1}}\n@article{b, year = 2021, doi = {10.1/b}}\n"
+	if got := applyBibEdits(content, edits); got != want {
+		t.Errorf("applyBibEdits = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// figureProfile describes how figures are converted for a journal
+type figureProfile struct {
+	Name      string
+	Convert   map[string]string // Source extension -> extension used in the flattened tex
+	Export    string            // Extension of the numbered upload files, "" for none
+	DPI       int               // Resolution for rasterized figures
+	MaxWidth  int               // Maximum width in pixels of exported figures, 0 for no limit
+	MaxHeight int               // Maximum height in pixels of exported figures, 0 for no limit
+}
+
+// figureProfiles are the built-in profiles selectable with -figures
+var figureProfiles = map[string]figureProfile{
+	"eps": {
+		Name:    "eps",
+		Convert: map[string]string{".pdf": ".eps"},
+	},
+	"tiff": {
+		Name:    "tiff",
+		Convert: map[string]string{},
+		Export:  ".tif",
+		DPI:     600,
+	},
+	"eps-tiff": {
+		Name:    "eps-tiff",
+		Convert: map[string]string{".pdf": ".eps"},
+		Export:  ".tif",
+		DPI:     600,
+	},
+	"png": {
+		Name:    "png",
+		Convert: map[string]string{},
+		Export:  ".png",
+		DPI:     300,
+	},
+}
+
+// figureProfileNames lists the built-in profiles for usage messages
+func figureProfileNames() string {
+	return "eps, tiff, eps-tiff or png"
+}
+
+// parseMaxSize parses a WIDTHxHEIGHT pixel limit such as 3000x3000
+func parseMaxSize(size string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(size), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size %q (use WIDTHxHEIGHT)", size)
+	}
+	w, err1 := strconv.Atoi(parts[0])
+	h, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q (use WIDTHxHEIGHT)", size)
+	}
+	return w, h, nil
+}
+
+// figureToolVersionArgs is the argument each conversion tool accepts for checkTool
+var figureToolVersionArgs = map[string]string{
+	"pdftops":  "-v",
+	"pdftoppm": "-v",
+	"magick":   "-version",
+}
+
+// figureTools returns the external tools a profile needs
+func figureTools(profile *figureProfile) []string {
+	tools := []string{}
+	needs := func(tool string) {
+		for _, t := range tools {
+			if t == tool {
+				return
+			}
+		}
+		tools = append(tools, tool)
+	}
+	for src, dst := range profile.Convert {
+		if src == ".pdf" && dst == ".eps" {
+			needs("pdftops")
+		} else {
+			needs("magick")
+		}
+	}
+	if profile.Export != "" {
+		needs("pdftoppm")
+		needs("magick")
+	}
+	return tools
+}
+
+// convertFigure converts src to dst using the tool for the pair of formats.
+// Rasterized output uses dpi and is shrunk to fit maxW x maxH if given.
+func convertFigure(src string, dst string, dpi int, maxW int, maxH int) error {
+	srcExt := strings.ToLower(filepath.Ext(src))
+	dstExt := strings.ToLower(filepath.Ext(dst))
+
+	var name string
+	var args []string
+	switch {
+	case srcExt == ".pdf" && dstExt == ".eps":
+		name, args = "pdftops", []string{"-eps", src, dst}
+	case srcExt == ".pdf" && (dstExt == ".tif" || dstExt == ".tiff" || dstExt == ".png"):
+		format := "-png"
+		if dstExt != ".png" {
+			format = "-tiff"
+		}
+		stem := strings.TrimSuffix(dst, filepath.Ext(dst))
+		name, args = "pdftoppm", []string{format, "-singlefile", "-r", strconv.Itoa(dpi), src, stem}
+	default:
+		name, args = "magick", []string{src}
+		if dpi > 0 {
+			args = append(args, "-units", "PixelsPerInch", "-density", strconv.Itoa(dpi))
+		}
+		args = append(args, dst)
+	}
+
+	cmd, finish := toolCommand(name, args...)
+	logger.Debugf("Running %s", strings.Join(cmd.Args, " "))
+	output, err := cmd.CombinedOutput()
+	if err = finish(err); err != nil {
+		return fmt.Errorf("%s failed converting %s: %v\nOutput: %s", name, src, err, string(output))
+	}
+
+	// pdftoppm writes .tif for -tiff regardless of the requested name
+	if srcExt == ".pdf" && dstExt == ".tiff" {
+		os.Rename(strings.TrimSuffix(dst, filepath.Ext(dst))+".tif", dst)
+	}
+
+	if maxW > 0 && maxH > 0 && dstExt != ".eps" {
+		cmd, finish := toolCommand("magick", dst, "-resize", fmt.Sprintf("%dx%d>", maxW, maxH), dst)
+		logger.Debugf("Running %s", strings.Join(cmd.Args, " "))
+		output, err := cmd.CombinedOutput()
+		if err = finish(err); err != nil {
+			return fmt.Errorf("magick failed resizing %s: %v\nOutput: %s", dst, err, string(output))
+		}
+	}
+	return nil
+}
+
+var (
+	// figureEnvRe matches the start and end of figure environments (figure,
+	// figure* and wrapfigure) and of the subfigure panels inside them
+	figureEnvRe = regexp.MustCompile(`\\(begin|end)\{(figure\*?|wrapfigure|subfigure)\}`)
+	// classOptionsRe matches the options of \documentclass
+	classOptionsRe = regexp.MustCompile(`\\documentclass\s*\[([^\]]*)\]`)
+)
+
+// figureRef is a graphic included by a document, in order of appearance
+type figureRef struct {
+	File   string // Resolved file in the temp dir
+	Figure int    // Number of the enclosing figure environment, 0 if none
+	Index  int    // Position within the figure environment, starting at 0
+}
+
+// documentFigures lists the graphics of a flattened tex file in order
+func documentFigures(texFile string, engine string) ([]figureRef, error) {
+	content, err := ioutil.ReadFile(texFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the preamble, which may hold embedded class files with figure code
+	text := string(content)
+	if i := strings.Index(text, "\\begin{document}"); i >= 0 {
+		text = text[i:]
+	}
+
+	refs := []figureRef{}
+	figure := 0
+	inFigure := false
+	index := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = stripTexComment(line)
+		// Walk the line in order so figure boundaries and graphics interleave correctly
+		envs := figureEnvRe.FindAllStringSubmatchIndex(line, -1)
+		gfx := graphicsRefRe.FindAllStringSubmatchIndex(line, -1)
+		for len(envs) > 0 || len(gfx) > 0 {
+			if len(gfx) == 0 || (len(envs) > 0 && envs[0][0] < gfx[0][0]) {
+				begin := line[envs[0][2]:envs[0][3]] == "begin"
+				switch {
+				case line[envs[0][4]:envs[0][5]] == "subfigure":
+					// Panels belong to the enclosing figure
+				case begin:
+					figure++
+					inFigure = true
+					index = 0
+				default:
+					inFigure = false
+				}
+				envs = envs[1:]
+				continue
+			}
+			ref := strings.TrimSpace(line[gfx[0][4]:gfx[0][5]])
+			gfx = gfx[1:]
+			resolved := resolveGraphic(ref, nil, engine, fileExists)
+			if resolved == "" {
+				continue
+			}
+			r := figureRef{File: resolved}
+			if inFigure {
+				r.Figure = figure
+				r.Index = index
+				index++
+			}
+			refs = append(refs, r)
+		}
+	}
+	return refs, nil
+}
+
+// isSupportingInfo guesses whether a document is supporting information,
+// whose figures are numbered S1, S2, ...
+func isSupportingInfo(texFile string) bool {
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(texFile), ".tex"))
+	if strings.Contains(name, "supporting") || strings.Contains(name, "suppl") ||
+		name == "si" || strings.HasPrefix(name, "si_") || strings.HasSuffix(name, "_si") {
+		return true
+	}
+	content, err := ioutil.ReadFile(texFile)
+	if err != nil {
+		return false
+	}
+	// rcclab uses \documentclass[suppinfo]{rcclab}
+	m := classOptionsRe.FindStringSubmatch(stripTexComments(string(content)))
+	return m != nil && strings.Contains(m[1], "suppinfo")
+}
+
+// exportName returns the upload file name for a figure, e.g. Figure1.tif,
+// FigureS2b.tif, or the graphic's own name for graphics outside a figure
+func exportName(ref figureRef, si bool, ext string, multi bool) string {
+	if ref.Figure == 0 {
+		return strings.TrimSuffix(filepath.Base(ref.File), filepath.Ext(ref.File)) + ext
+	}
+	prefix := "Figure"
+	if si {
+		prefix = "FigureS"
+	}
+	name := fmt.Sprintf("%s%d", prefix, ref.Figure)
+	if multi {
+		name += subfigureLetters(ref.Index)
+	}
+	return name + ext
+}
+
+// subfigureLetters numbers subfigures a, b, ..., z, aa, ab, ... like
+// spreadsheet columns
+func subfigureLetters(index int) string {
+	letters := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		letters = string(rune('a'+(index-1)%26)) + letters
+	}
+	return letters
+}
+
+// planExports names the upload copies of the figures of every document.
+// Numbering restarts in each document, so a name already taken by an earlier
+// document gets the document name as a prefix (manuscript.tex and
+// letter.tex both have a Figure1; the second becomes letter-Figure1.tif).
+// A graphic exported twice under the same name is only exported once.
+func planExports(texFiles []string, ext string, engine string) ([]FileMove, error) {
+	exports := []FileMove{}
+	taken := make(map[string]string)
+	for _, texFile := range texFiles {
+		refs, err := documentFigures(texFile, engine)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", texFile, err)
+		}
+		si := isSupportingInfo(texFile)
+		doc := strings.TrimSuffix(filepath.Base(texFile), filepath.Ext(texFile))
+
+		perFigure := make(map[int]int)
+		for _, ref := range refs {
+			perFigure[ref.Figure]++
+		}
+		for _, ref := range refs {
+			name := exportName(ref, si, ext, perFigure[ref.Figure] > 1)
+			if src, ok := taken[name]; ok && src != ref.File {
+				name = doc + "-" + name
+			}
+			if src, ok := taken[name]; ok {
+				if src == ref.File {
+					continue
+				}
+				return nil, fmt.Errorf("figure exports %s and %s would both be named %s", src, ref.File, name)
+			}
+			taken[name] = ref.File
+			exports = append(exports, FileMove{From: ref.File, To: name})
+		}
+	}
+	return exports, nil
+}
+
+// processFigures exports numbered copies of the figures to exportDir if the
+// profile asks for it, then converts figures used in the flattened tex files.
+// It must run after flattenDirs so every graphic is in the current directory.
+func processFigures(texFiles []string, profile *figureProfile, engine string, exportDir string) ([]FileMove, error) {
+	// Export numbered figures for upload portals from the original files
+	if profile.Export != "" {
+		if err := os.MkdirAll(exportDir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating figure directory: %v", err)
+		}
+		exports, err := planExports(texFiles, profile.Export, engine)
+		if err != nil {
+			return nil, err
+		}
+		for _, export := range exports {
+			dst := filepath.Join(exportDir, export.To)
+			logger.Actionf("Exporting %s as %s", export.From, dst)
+			if err := convertFigure(export.From, dst, profile.DPI, profile.MaxWidth, profile.MaxHeight); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Convert figures used in the source
+	converted := make(map[string]string)
+	conversions := []FileMove{}
+	for _, texFile := range texFiles {
+		refs, err := documentFigures(texFile, engine)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", texFile, err)
+		}
+		for _, ref := range refs {
+			dstExt, ok := profile.Convert[strings.ToLower(filepath.Ext(ref.File))]
+			if !ok || converted[ref.File] != "" {
+				continue
+			}
+			dst := strings.TrimSuffix(ref.File, filepath.Ext(ref.File)) + dstExt
+			if !allowedGraphic(dst, engine) {
+				logger.Warnf("%s can't include %s files; leaving %s as is", engine, dstExt, ref.File)
+				continue
+			}
+			logger.Notef("Converting %s to %s", ref.File, dst)
+			if err := convertFigure(ref.File, dst, profile.DPI, 0, 0); err != nil {
+				return nil, err
+			}
+			converted[ref.File] = dst
+			conversions = append(conversions, FileMove{From: ref.File, To: dst})
+		}
+	}
+	if len(converted) == 0 {
+		return conversions, nil
+	}
+
+	// Point the references at the converted files, with an explicit extension
+	// so the engine can't pick up a leftover file in another format
+	for _, texFile := range texFiles {
+		content, err := ioutil.ReadFile(texFile)
+		if err != nil {
+			continue
+		}
+		newContent := graphicsRefRe.ReplaceAllStringFunc(string(content), func(m string) string {
+			parts := graphicsRefRe.FindStringSubmatch(m)
+			resolved := resolveGraphic(strings.TrimSpace(parts[2]), nil, engine, fileExists)
+			if dst, ok := converted[resolved]; ok {
+				return parts[1] + dst + parts[3]
+			}
+			return m
+		})
+		if err := ioutil.WriteFile(texFile, []byte(newContent), 0644); err != nil {
+			return nil, fmt.Errorf("error updating tex file: %v", err)
+		}
+	}
+	for src := range converted {
+		os.Remove(src)
+	}
+
+	return conversions, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExportName(t *testing.T) {
+	tests := []struct {
+		ref   figureRef
+		si    bool
+		multi bool
+		want  string
+	}{
+		{figureRef{File: "figs/plot.pdf", Figure: 1}, false, false, "Figure1.tif"},
+		{figureRef{File: "figs/plot.pdf", Figure: 2, Index: 1}, true, true, "FigureS2b.tif"},
+		{figureRef{File: "figs/plot.pdf", Figure: 3, Index: 25}, false, true, "Figure3z.tif"},
+		{figureRef{File: "figs/plot.pdf", Figure: 3, Index: 26}, false, true, "Figure3aa.tif"},
+		{figureRef{File: "figs/plot.pdf", Figure: 3, Index: 27}, false, true, "Figure3ab.tif"},
+		{figureRef{File: "figs/plot.pdf", Figure: 3, Index: 52}, false, true, "Figure3ba.tif"},
+		{figureRef{File: "figs/toc.png"}, false, false, "toc.tif"},
+	}
+	for _, tt := range tests {
+		if got := exportName(tt.ref, tt.si, ".tif", tt.multi); got != tt.want {
+			t.Errorf("exportName(%+v) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentFigures(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, f := range []string{"a.pdf", "b.pdf", "c.png", "d.pdf", "toc.png"} {
+		os.WriteFile(f, []byte("x"), 0644)
+	}
+	os.WriteFile("main.tex", []byte(`\documentclass{article}
+\begin{document}
+\includegraphics{toc}
+\begin{figure}
+  \begin{subfigure}{0.5\linewidth}\includegraphics{a}\end{subfigure}
+  \begin{subfigure}{0.5\linewidth}
+    \includegraphics{b}
+  \end{subfigure}
+  \includegraphics{c}
+\end{figure}
+%\begin{figure}\includegraphics{a}\end{figure}
+\begin{wrapfigure}{r}{0.3\linewidth}\includegraphics{d}\end{wrapfigure}
+\begin{figure*}\includegraphics{missing}\includegraphics{c.png}\end{figure*}
+\end{document}
+`), 0644)
+
+	refs, err := documentFigures("main.tex", EnginePdfLaTeX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []figureRef{
+		{File: "toc.png"},
+		{File: "a.pdf", Figure: 1, Index: 0},
+		{File: "b.pdf", Figure: 1, Index: 1},
+		{File: "c.png", Figure: 1, Index: 2},
+		{File: "d.pdf", Figure: 2, Index: 0},
+		{File: "c.png", Figure: 3, Index: 0},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("documentFigures = %+v, want %+v", refs, want)
+	}
+}
+
+func TestPlanExports(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, f := range []string{"a.pdf", "b.pdf", "c.pdf", "toc.png"} {
+		os.WriteFile(f, []byte("x"), 0644)
+	}
+	doc := func(body string) []byte {
+		return []byte("\\documentclass{article}\n\\begin{document}\n" + body + "\n\\end{document}\n")
+	}
+	os.WriteFile("manuscript.tex", doc(`\includegraphics{toc}\begin{figure}\includegraphics{a}\end{figure}`), 0644)
+	os.WriteFile("letter.tex", doc(`\includegraphics{toc}\begin{figure}\includegraphics{b}\end{figure}`), 0644)
+	os.WriteFile("supporting_information.tex", doc(`\begin{figure}\includegraphics{c}\end{figure}`), 0644)
+
+	exports, err := planExports([]string{"manuscript.tex", "letter.tex", "supporting_information.tex"}, ".tif", EnginePdfLaTeX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileMove{
+		{From: "toc.png", To: "toc.tif"},
+		{From: "a.pdf", To: "Figure1.tif"},
+		{From: "b.pdf", To: "letter-Figure1.tif"},
+		{From: "c.pdf", To: "FigureS1.tif"},
+	}
+	if !reflect.DeepEqual(exports, want) {
+		t.Errorf("planExports = %+v, want %+v", exports, want)
+	}
+
+	// A prefixed name can still collide with another export
+	os.WriteFile("letter-Figure1.png", []byte("x"), 0644)
+	os.WriteFile("manuscript.tex", doc(`\includegraphics{letter-Figure1}\begin{figure}\includegraphics{a}\end{figure}`), 0644)
+	if _, err := planExports([]string{"manuscript.tex", "letter.tex"}, ".tif", EnginePdfLaTeX); err == nil {
+		t.Error("planExports: expected an error for letter-Figure1.tif")
+	}
+}
@@ -7,9 +7,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -36,14 +35,15 @@ func copyFile(src, dst string) error {
 	return err
 }
 
-// catClass concatenates custom class files into tex files for portability
+// catClass embeds the local class, package and bibliography style files each
+// tex file loads with filecontents* so the flattened file is self-contained.
+// Classes that aren't local are looked up in customClass, a list of class
+// files and directories like the CUSTOM_CLASS setting of ziptex.sh.
 func catClass(texFiles []string, customClass string) error {
-	printBlue("Looking for cls files to concatenate.\n")
-	
-	// Look for any .cls files in the current directory
-	clsFiles, err := filepath.Glob("*.cls")
-	if err != nil || len(clsFiles) == 0 {
-		return nil // No class files found, skip
+	logger.Stagef("Looking for cls, sty, bst, cbx and bbx files to embed.")
+	overwrite := filecontentsOverwrite()
+	if !overwrite {
+		logger.Warnf("this LaTeX release predates filecontents [overwrite]; embedded files won't replace existing copies")
 	}
 	
 	for _, texFile := range texFiles {
@@ -51,48 +51,61 @@ func catClass(texFiles []string, customClass string) error {
 		if err != nil {
 			continue
 		}
+		newContent := string(content)
 		
-		// For each cls file, check if it's used in this tex file
-		for _, clsFile := range clsFiles {
-			className := strings.TrimSuffix(filepath.Base(clsFile), ".cls")
+		for _, file := range localEmbeds(newContent, embedExts) {
+			if isEmbedded(newContent, file) {
+				continue
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				logger.Warnf("error reading %s: %v", file, err)
+				continue
+			}
+			embedded, err := embedFile(newContent, file, string(data), overwrite)
+			if err != nil {
+				logger.Warnf("not embedding %s in %s: %v", file, texFile, err)
+				continue
+			}
+			logger.Notef("Embedding %s in %s for portability", file, texFile)
+			newContent = embedded
 			
-			// Check if this tex file uses this class
-			if strings.Contains(string(content), "\\documentclass") && 
-			   strings.Contains(string(content), className) {
-				
-				printLimeYellow("Concatenating %s into %s for portability\n", clsFile, texFile)
-				
-				// Read class file content
-				classContent, err := ioutil.ReadFile(clsFile)
-				if err != nil {
-					fmt.Printf("Warning: error reading class file %s: %v\n", clsFile, err)
-					continue
-				}
-				
-				// Create new content with embedded class
-				classContentStr := string(classContent)
-				// Ensure class content ends with newline
-				if !strings.HasSuffix(classContentStr, "\n") {
-					classContentStr += "\n"
-				}
-				
-				newContent := fmt.Sprintf("\\begin{filecontents}{%s}\n%s\\end{filecontents}\n%s",
-					filepath.Base(clsFile),
-					classContentStr,
-					string(content))
-				
-				// Write back to tex file
-				if err := ioutil.WriteFile(texFile, []byte(newContent), 0644); err != nil {
-					return fmt.Errorf("error writing tex file: %v", err)
-				}
-				
-				// Track file for deletion - add to .todel
-				todelFile, _ := os.OpenFile(".todel", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				fmt.Fprintf(todelFile, "%s\n", clsFile)
-				todelFile.Close()
-				
-				// Reload content for next cls file check
-				content = []byte(newContent)
+			// Track file for deletion - add to .todel
+			todelFile, _ := os.OpenFile(".todel", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			fmt.Fprintf(todelFile, "%s\n", file)
+			todelFile.Close()
+		}
+		
+		// Classes that aren't in the project come from the -class search path
+		for _, load := range parseLoads(newContent) {
+			if load.Ext != ".cls" || customClass == "" {
+				continue
+			}
+			name := load.Name + ".cls"
+			if fileExists(name) || isEmbedded(newContent, name) {
+				continue
+			}
+			clsFile := findCustomClass(name, customClass)
+			if clsFile == "" {
+				continue
+			}
+			data, err := ioutil.ReadFile(clsFile)
+			if err != nil {
+				logger.Warnf("error reading class file %s: %v", clsFile, err)
+				continue
+			}
+			embedded, err := embedFile(newContent, name, string(data), overwrite)
+			if err != nil {
+				logger.Warnf("not embedding %s in %s: %v", clsFile, texFile, err)
+				continue
+			}
+			logger.Notef("Embedding %s in %s for portability", clsFile, texFile)
+			newContent = embedded
+		}
+		
+		if newContent != string(content) {
+			if err := ioutil.WriteFile(texFile, []byte(newContent), 0644); err != nil {
+				return fmt.Errorf("error writing tex file: %v", err)
 			}
 		}
 	}
@@ -102,7 +115,7 @@ func catClass(texFiles []string, customClass string) error {
 
 // catAux concatenates aux files into tex files for portability
 func catAux(texFiles []string) error {
-	printBlue("Looking for aux files to concatenate.\n")
+	logger.Stagef("Looking for aux files to concatenate.")
 	
 	for _, texFile := range texFiles {
 		texContent, err := ioutil.ReadFile(texFile)
@@ -116,11 +129,11 @@ func catAux(texFiles []string) error {
 		
 		// Check if the aux file exists
 		if _, err := os.Stat(auxFile); err == nil {
-			printLimeYellow("Concatenating %s into %s for portability\n", auxFile, texFile)
+			logger.Notef("Concatenating %s into %s for portability", auxFile, texFile)
 			
 			auxContent, err := ioutil.ReadFile(auxFile)
 			if err != nil {
-				fmt.Printf("Warning: error reading aux file %s: %v\n", auxFile, err)
+				logger.Warnf("error reading aux file %s: %v", auxFile, err)
 				continue
 			}
 			
@@ -153,62 +166,114 @@ func catAux(texFiles []string) error {
 	return nil
 }
 
-// flattenDirs flattens directory structure by moving graphics files
-func flattenDirs(texFiles []string) error {
+// flattenDirs moves the files in each graphicspath directory to the root,
+// renaming files whose base names collide and rewriting the references to
+// them. Files that aren't in used are deleted instead of moved. It returns
+// the moves that were made.
+func flattenDirs(texFiles []string, engine string, used map[string]bool) ([]FileMove, error) {
+	gfxDirsByTex := make(map[string][]string)
+	filesByTex := make(map[string][]string)
+	keepGraphicsPath := make(map[string]bool)
+	toMove := []string{}
+	seen := make(map[string]bool)
+	
 	for _, texFile := range texFiles {
-		content, err := ioutil.ReadFile(texFile)
-		if err != nil {
-			continue
-		}
-		
-		// Find graphicspath - handle double braces like \graphicspath{{figures/}}
-		re := regexp.MustCompile(`\\graphicspath\{[^}]*\{([^}]+)\}[^}]*\}`)
-		matches := re.FindStringSubmatch(string(content))
+		// The graphicspath may be set in an included file such as head.tex
+		content, files := expandIncludes(texFile)
+		filesByTex[texFile] = files
 		
-		if len(matches) > 1 {
-			gfxPath := strings.Trim(matches[1], "{}")
-			gfxPath = strings.TrimSuffix(gfxPath, "/")
-			
-			printLimeYellow("Flattening directory structure for %s\n", texFile)
-			
+		for _, gfxPath := range parseGraphicsPaths(content) {
+			if filepath.IsAbs(gfxPath) || strings.HasPrefix(gfxPath, "..") {
+				logger.Warnf("graphicspath \"%s\" is outside the project and won't be flattened", gfxPath)
+				keepGraphicsPath[texFile] = true
+				continue
+			}
 			// Check if graphics path exists
-			if info, err := os.Stat(gfxPath); err == nil && info.IsDir() {
-				// Move all files from graphics path to current directory
-				err := filepath.Walk(gfxPath, func(path string, info os.FileInfo, err error) error {
-					if err != nil || info.IsDir() {
-						return nil
+			if info, err := os.Stat(gfxPath); err != nil || !info.IsDir() {
+				logger.Warnf("graphicspath \"%s\" not found", gfxPath)
+				continue
+			}
+			gfxDirsByTex[texFile] = append(gfxDirsByTex[texFile], gfxPath)
+			
+			for _, f := range filesUnder(gfxPath) {
+				if !used[f] {
+					if !seen[f] {
+						logger.Infof("Pruning unused %s", f)
+						os.Remove(f)
 					}
-					
-					// Move file to current directory
-					destPath := filepath.Base(path)
-					fmt.Printf("Moving %s to %s\n", path, destPath)
-					return os.Rename(path, destPath)
-				})
-				
-				if err != nil {
-					fmt.Printf("Warning: error moving files from %s: %v\n", gfxPath, err)
+					seen[f] = true
+					continue
+				}
+				if !seen[f] {
+					seen[f] = true
+					toMove = append(toMove, f)
 				}
-			} else {
-				fmt.Printf("Warning: graphicspath \"%s\" not found\n", gfxPath)
+			}
+		}
+	}
+	
+	// Names already used in the root can't be reused for moved files
+	taken := make(map[string]bool)
+	rootFiles, _ := filepath.Glob("*")
+	for _, f := range rootFiles {
+		if fileExists(f) {
+			taken[f] = true
+		}
+	}
+	
+	names, collisions := flatNames(toMove, taken)
+	for _, c := range collisions {
+		logger.Warnf("%s", c)
+	}
+	
+	// Rewrite references while the files are still in place so they resolve
+	for _, texFile := range texFiles {
+		for _, file := range filesByTex[texFile] {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				continue
 			}
 			
+			newContent := rewriteGraphicsRefs(string(content), gfxDirsByTex[texFile], engine, names, fileExists)
 			// Remove the entire graphicspath command from tex file
-			// Use a regex that matches the complete command including double braces
-			replaceRe := regexp.MustCompile(`\\graphicspath\{[^}]*\{[^}]+\}[^}]*\}`)
-			newContent := replaceRe.ReplaceAllString(string(content), "")
-			if err := ioutil.WriteFile(texFile, []byte(newContent), 0644); err != nil {
-				return fmt.Errorf("error updating tex file: %v", err)
+			if !keepGraphicsPath[texFile] {
+				newContent = removeGraphicsPaths(newContent)
+			}
+			
+			if newContent != string(content) {
+				logger.Notef("Flattening directory structure for %s", file)
+				if err := ioutil.WriteFile(file, []byte(newContent), 0644); err != nil {
+					return nil, fmt.Errorf("error updating tex file: %v", err)
+				}
 			}
 		}
 	}
 	
+	// Move the files to the current directory
+	sort.Strings(toMove)
+	moves := []FileMove{}
+	for _, f := range toMove {
+		dest := names[f]
+		logger.Infof("Moving %s to %s", f, dest)
+		if err := os.Rename(f, dest); err != nil {
+			logger.Warnf("error moving %s: %v", f, err)
+			continue
+		}
+		moves = append(moves, FileMove{From: f, To: dest})
+	}
+	
 	// Remove empty directories
+	for _, dirs := range gfxDirsByTex {
+		for _, dir := range dirs {
+			removeEmptyDirs(dir)
+		}
+	}
 	dirs, _ := filepath.Glob("*/")
 	for _, dir := range dirs {
 		os.Remove(dir) // Will only succeed if empty
 	}
 	
-	return nil
+	return moves, nil
 }
 
 // createZipArchive creates a zip file with the specified files
@@ -316,9 +381,9 @@ func addFileToTar(tarWriter *tar.Writer, filename string) error {
 }
 
 func compressBz2(inputPath, outputPath string) error {
-	cmd := exec.Command("bzip2", "-c", inputPath)
+	cmd, finish := toolCommand("bzip2", "-c", inputPath)
 	output, err := cmd.Output()
-	if err != nil {
+	if err = finish(err); err != nil {
 		return fmt.Errorf("bzip2 compression failed: %v", err)
 	}
 	
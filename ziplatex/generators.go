@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// generator is a package that runs a program through shell escape to make
+// files the document then includes. The journal compiles without shell
+// escape, so the files are made once and the document is switched to a mode
+// that only reads them.
+type generator struct {
+	Name     string
+	Markers  []string // Recorder inputs showing the package is loaded
+	Programs []string // Programs shell escape must allow, only with -generate
+	Generate string   // Preamble code for the run making the files
+	Freeze   string   // Preamble code for using the files without shell escape
+}
+
+// generatorShellEscape is set by -generate: generators may run their
+// programs through restricted shell escape. Without it only generators that
+// need no program are handled.
+var generatorShellEscape bool
+
+// generators are the packages handled, in the order they are reported
+var generators = []generator{
+	{
+		Name:     "minted",
+		Markers:  []string{"minted.sty"},
+		Programs: []string{"pygmentize"},
+		Generate: `\PassOptionsToPackage{finalizecache}{minted}`,
+		Freeze:   `\PassOptionsToPackage{frozencache}{minted}`,
+	},
+	{
+		// Externalizing runs the engine itself, which restricted shell escape
+		// must never allow, so only the PDFs the project already has are used
+		Name:    "tikzexternalize",
+		Markers: []string{"tikzlibraryexternal.code.tex", "pgflibraryexternal.code.tex"},
+		Freeze:  `\AtBeginDocument{\tikzset{external/mode=graphics if exists}}`,
+	},
+	{
+		Name:     "svg",
+		Markers:  []string{"svg.sty"},
+		Programs: []string{"inkscape"},
+		Freeze:   `\PassOptionsToPackage{inkscape=false}{svg}`,
+	},
+	{
+		Name:     "gnuplottex",
+		Markers:  []string{"gnuplottex.sty"},
+		Programs: []string{"gnuplot"},
+		Freeze:   `\PassOptionsToPackage{noshell}{gnuplottex}`,
+	},
+}
+
+// generatedMarker starts the preamble lines ziplatex adds for generators
+const generatedMarker = "% ziplatex: generated files"
+
+// GeneratedReport lists the files a generator made for a document
+type GeneratedReport struct {
+	File      string   `json:"file"`
+	Packages  []string `json:"packages"`
+	Artifacts []string `json:"artifacts"`
+}
+
+// findGenerators returns the names of the generators texFile loads, from the
+// INPUT lines of its .fls. A partial .fls from a failed run is enough.
+func findGenerators(texFile string, outDir string) []string {
+	content, err := ioutil.ReadFile(flsPath(texFile, outDir))
+	if err != nil {
+		return nil
+	}
+	inputs := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "INPUT ") {
+			inputs[filepath.Base(strings.TrimPrefix(line, "INPUT "))] = true
+		}
+	}
+
+	names := []string{}
+	for _, g := range generators {
+		for _, marker := range g.Markers {
+			if inputs[marker] {
+				names = append(names, g.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// generatorPrograms returns the programs the generators in names run
+// through shell escape that the user's allowlist doesn't have
+func generatorPrograms(names []string) []string {
+	programs := []string{}
+	for _, g := range generators {
+		if !contains(names, g.Name) {
+			continue
+		}
+		for _, program := range g.Programs {
+			if !contains(shellEscapeAllow, program) && !contains(programs, program) {
+				programs = append(programs, program)
+			}
+		}
+	}
+	return programs
+}
+
+// usableGenerators returns the generators in names that can run: all of them
+// with -generate, otherwise those that need no program the user hasn't
+// allowed. The others are reported, since their files won't be made.
+func usableGenerators(texFile string, names []string) []string {
+	if generatorShellEscape {
+		return names
+	}
+	usable := []string{}
+	for _, name := range names {
+		if programs := generatorPrograms([]string{name}); len(programs) > 0 {
+			logger.Warnf("%s uses %s, which runs %s through shell escape; use -generate to allow it", texFile, name, strings.Join(programs, ", "))
+			continue
+		}
+		usable = append(usable, name)
+	}
+	return usable
+}
+
+// generatorAllow returns the shell escape allowlist for running texFile with
+// the generators in names, warning about the programs -generate adds
+func generatorAllow(texFile string, names []string) []string {
+	programs := generatorPrograms(names)
+	if len(programs) == 0 {
+		return shellEscapeAllow
+	}
+	logger.Warnf("Running %s with restricted shell escape allowing %s for %s", texFile, strings.Join(programs, ", "), strings.Join(names, ", "))
+	return append(append([]string{}, shellEscapeAllow...), programs...)
+}
+
+// contains reports whether list has s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverDeps runs findDeps with the user's shell escape settings. If the
+// document uses generators and fails, which is what minted does without
+// shell escape, it is run again with their programs allowed if -generate
+// was given.
+func discoverDeps(engine string, texFile string, outDir string) ([]string, []string, error) {
+	deps, err := findDeps(engine, texFile, outDir, shellEscapeAllow)
+	names := findGenerators(texFile, outDir)
+	if programs := generatorPrograms(names); err != nil && len(programs) > 0 {
+		if !generatorShellEscape {
+			return deps, names, fmt.Errorf("%v\n%s uses %s; use -generate to let shell escape run %s", err, texFile, strings.Join(names, ", "), strings.Join(programs, ", "))
+		}
+		deps, err = findDeps(engine, texFile, outDir, generatorAllow(texFile, names))
+	}
+	return deps, names, err
+}
+
+// setGeneratorMode replaces the generator lines ziplatex added to texFile
+// with the Generate (freeze false) or Freeze code of the generators in names.
+// The lines go before \documentclass so the options reach the packages.
+func setGeneratorMode(texFile string, names []string, freeze bool) error {
+	data, err := ioutil.ReadFile(texFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", texFile, err)
+	}
+	content := string(data)
+	if i := strings.Index(content, generatedMarker+"\n"); i >= 0 {
+		end := strings.Index(content[i:], "\n"+generatedMarker+" end\n")
+		if end >= 0 {
+			content = content[:i] + content[i+end+len("\n"+generatedMarker+" end\n"):]
+		}
+	}
+
+	lines := []string{}
+	for _, g := range generators {
+		code := g.Generate
+		if freeze {
+			code = g.Freeze
+		}
+		if contains(names, g.Name) && code != "" {
+			lines = append(lines, code)
+		}
+	}
+	if len(lines) > 0 {
+		loc := documentclassRe.FindStringIndex(stripTexCommentsKeepOffsets(content))
+		if loc == nil {
+			return fmt.Errorf("no \\documentclass in %s", texFile)
+		}
+		block := generatedMarker + "\n" + strings.Join(lines, "\n") + "\n" + generatedMarker + " end\n"
+		content = content[:loc[0]] + block + content[loc[0]:]
+	}
+	return ioutil.WriteFile(texFile, []byte(content), 0644)
+}
+
+// listFiles returns the files below dir
+func listFiles(dir string) map[string]bool {
+	files := make(map[string]bool)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files[filepath.Clean(path)] = true
+		}
+		return nil
+	})
+	return files
+}
+
+// generateFiles runs the engine once on texFile, in the current directory,
+// with the generators' programs allowed, then freezes the document so that
+// it only reads what they made. Without a generator to run it only freezes. It returns the new files; those the frozen
+// document reads are shipped through the recorder like any dependency.
+func generateFiles(engine string, texFile string, names []string) ([]string, error) {
+	jobName := strings.TrimSuffix(texFile, ".tex")
+	auxExisted := fileExists(jobName + ".aux")
+	before := listFiles(".")
+
+	// Generators without a program, such as tikzexternalize, only freeze
+	generate := false
+	for _, g := range generators {
+		generate = generate || (contains(names, g.Name) && (g.Generate != "" || len(g.Programs) > 0))
+	}
+	if generate {
+		if err := setGeneratorMode(texFile, names, false); err != nil {
+			return nil, err
+		}
+		output, err := runEngine(engine, texFile, generatorAllow(texFile, names))
+		if err != nil {
+			return nil, fmt.Errorf("%v\n%s", err, lastLines(output, 20))
+		}
+	}
+	if err := setGeneratorMode(texFile, names, true); err != nil {
+		return nil, err
+	}
+	// The staged .aux was embedded by catAux; a new one would be shipped
+	if !auxExisted {
+		os.Remove(jobName + ".aux")
+	}
+
+	artifacts := []string{}
+	for path := range listFiles(".") {
+		base := filepath.Base(path)
+		if before[path] || strings.HasPrefix(base, jobName+".") {
+			continue
+		}
+		artifacts = append(artifacts, path)
+	}
+	sort.Strings(artifacts)
+	return artifacts, nil
+}
+
+// lastLines returns the last n lines of output
+func lastLines(output string, n int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
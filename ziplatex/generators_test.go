@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindGenerators(t *testing.T) {
+	tests := []struct {
+		name string
+		fls  string
+		want []string
+	}{
+		{"none", "PWD /p\nINPUT /tex/article.cls\nOUTPUT main.aux\n", []string{}},
+		{"minted", "INPUT /tex/minted/minted.sty\n", []string{"minted"}},
+		{"tikz external", "INPUT /tex/pgf/tikzlibraryexternal.code.tex\nINPUT /tex/pgf/pgflibraryexternal.code.tex\n", []string{"tikzexternalize"}},
+		{"in generator order", "INPUT /tex/gnuplottex.sty\nINPUT /tex/svg.sty\nINPUT /tex/minted.sty\n", []string{"minted", "svg", "gnuplottex"}},
+		{"output only", "OUTPUT /p/minted.sty\n", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			os.WriteFile(filepath.Join(dir, "main.fls"), []byte(tt.fls), 0644)
+			if got := findGenerators("main.tex", dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findGenerators = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := findGenerators("main.tex", t.TempDir()); got != nil {
+		t.Errorf("findGenerators without a .fls = %q, want nil", got)
+	}
+}
+
+func TestSetGeneratorMode(t *testing.T) {
+	const doc = "% \\documentclass{old}\n\\documentclass{article}\n\\usepackage{minted}\n\\begin{document}\n\\end{document}\n"
+	tests := []struct {
+		name  string
+		steps []func(string) error
+		want  string
+	}{
+		{
+			"generate",
+			[]func(string) error{
+				func(f string) error { return setGeneratorMode(f, []string{"minted"}, false) },
+			},
+			"% \\documentclass{old}\n" + generatedMarker + "\n\\PassOptionsToPackage{finalizecache}{minted}\n" + generatedMarker + " end\n\\documentclass{article}\n",
+		},
+		{
+			"freeze replaces generate",
+			[]func(string) error{
+				func(f string) error { return setGeneratorMode(f, []string{"minted", "svg"}, false) },
+				func(f string) error { return setGeneratorMode(f, []string{"minted", "svg"}, true) },
+			},
+			"% \\documentclass{old}\n" + generatedMarker + "\n\\PassOptionsToPackage{frozencache}{minted}\n\\PassOptionsToPackage{inkscape=false}{svg}\n" + generatedMarker + " end\n\\documentclass{article}\n",
+		},
+		{
+			"re-run replaces the block",
+			[]func(string) error{
+				func(f string) error { return setGeneratorMode(f, []string{"minted"}, true) },
+				func(f string) error { return setGeneratorMode(f, []string{"minted"}, true) },
+			},
+			"% \\documentclass{old}\n" + generatedMarker + "\n\\PassOptionsToPackage{frozencache}{minted}\n" + generatedMarker + " end\n\\documentclass{article}\n",
+		},
+		{
+			"no code removes the block",
+			[]func(string) error{
+				func(f string) error { return setGeneratorMode(f, []string{"minted"}, true) },
+				func(f string) error { return setGeneratorMode(f, []string{"tikzexternalize"}, false) },
+			},
+			doc,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "main.tex")
+			os.WriteFile(file, []byte(doc), 0644)
+			for _, step := range tt.steps {
+				if err := step(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, _ := os.ReadFile(file)
+			if !strings.HasPrefix(string(got), tt.want) {
+				t.Errorf("got\n%s\nwant it to start with\n%s", got, tt.want)
+			}
+			if n := strings.Count(string(got), generatedMarker+"\n"); n > 1 {
+				t.Errorf("%d generator blocks, want at most 1", n)
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "part.tex")
+	os.WriteFile(file, []byte("\\section{Part}\n"), 0644)
+	if err := setGeneratorMode(file, []string{"minted"}, true); err == nil {
+		t.Error("setGeneratorMode without \\documentclass: expected an error")
+	}
+}
+
+func TestGeneratorPrograms(t *testing.T) {
+	saved := shellEscapeAllow
+	defer func() { shellEscapeAllow = saved }()
+	tests := []struct {
+		names []string
+		allow []string
+		want  []string
+	}{
+		{nil, defaultShellEscapeAllow, []string{}},
+		{[]string{"minted"}, defaultShellEscapeAllow, []string{"pygmentize"}},
+		{[]string{"gnuplottex", "svg", "minted"}, defaultShellEscapeAllow, []string{"pygmentize", "inkscape", "gnuplot"}},
+		{[]string{"minted", "svg"}, []string{"repstopdf", "pygmentize"}, []string{"inkscape"}},
+		// Externalizing needs the engine, which is never allowed
+		{[]string{"tikzexternalize"}, defaultShellEscapeAllow, []string{}},
+	}
+	for _, tt := range tests {
+		shellEscapeAllow = tt.allow
+		got := generatorPrograms(tt.names)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("generatorPrograms(%q) with %q allowed = %q, want %q", tt.names, tt.allow, got, tt.want)
+		}
+		for _, program := range got {
+			if isTexEngine(program) {
+				t.Errorf("generatorPrograms(%q) allows the engine %s", tt.names, program)
+			}
+		}
+	}
+	for _, g := range generators {
+		for _, program := range g.Programs {
+			if program == "" || isTexEngine(program) {
+				t.Errorf("generator %s runs %q", g.Name, program)
+			}
+		}
+	}
+}
+
+func TestUsableGenerators(t *testing.T) {
+	saved, savedReport := generatorShellEscape, report
+	defer func() { generatorShellEscape, report = saved, savedReport }()
+	report = newReport()
+	names := []string{"minted", "tikzexternalize", "svg"}
+
+	generatorShellEscape = false
+	if got := usableGenerators("main.tex", names); !reflect.DeepEqual(got, []string{"tikzexternalize"}) {
+		t.Errorf("usableGenerators without -generate = %q, want only tikzexternalize", got)
+	}
+	if len(report.Warnings) != 2 || !strings.Contains(report.Warnings[0], "pygmentize") || !strings.Contains(report.Warnings[1], "inkscape") {
+		t.Errorf("warnings = %q, want one naming each program", report.Warnings)
+	}
+
+	generatorShellEscape = true
+	if got := usableGenerators("main.tex", names); !reflect.DeepEqual(got, names) {
+		t.Errorf("usableGenerators with -generate = %q, want %q", got, names)
+	}
+
+	report = newReport()
+	allow := generatorAllow("main.tex", names)
+	if want := append(append([]string{}, shellEscapeAllow...), "pygmentize", "inkscape"); !reflect.DeepEqual(allow, want) {
+		t.Errorf("generatorAllow = %q, want %q", allow, want)
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "pygmentize, inkscape") {
+		t.Errorf("warnings = %q, want one naming pygmentize and inkscape", report.Warnings)
+	}
+}
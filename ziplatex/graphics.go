@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FileMove is a graphics file moved out of a graphicspath directory
+type FileMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// engineGraphicsExts are the graphics formats each engine can include
+// directly, in the order graphicx tries them when \includegraphics omits the
+// extension (.eps is converted on the fly by epstopdf under pdflatex and
+// lualatex)
+var engineGraphicsExts = map[string][]string{
+	EnginePdfLaTeX: {".pdf", ".png", ".jpg", ".jpeg", ".jbig2", ".jb2", ".mps", ".eps"},
+	EngineLuaLaTeX: {".pdf", ".png", ".jpg", ".jpeg", ".jbig2", ".jb2", ".mps", ".eps"},
+	EngineXeLaTeX:  {".pdf", ".png", ".jpg", ".jpeg", ".eps", ".ps", ".bmp"},
+}
+
+// imageExts are the file types reported as unused graphics
+var imageExts = map[string]bool{
+	".pdf": true, ".png": true, ".jpg": true, ".jpeg": true, ".eps": true, ".ps": true,
+	".tif": true, ".tiff": true, ".gif": true, ".bmp": true, ".svg": true, ".mps": true,
+}
+
+// inputExts are tried in order when \input omits the extension
+var inputExts = []string{".tex", ".tikz", ".pgf"}
+
+var (
+	// \includegraphics[...]{file} and \includepdf[...]{file}
+	graphicsRefRe = regexp.MustCompile(`(\\(?:includegraphics|includepdf)\*?\s*(?:\[[^\]]*\]\s*)*\{)([^}]+)(\})`)
+	// \input{file} (TikZ/pgf pictures kept next to the figures)
+	inputRefRe = regexp.MustCompile(`(\\input\s*\{)([^}]+)(\})`)
+	// \input{file} and \include{file} when following included files
+	includeRe = regexp.MustCompile(`\\(?:input|include)\s*\{([^}]+)\}`)
+)
+
+// readGroup returns the contents of the brace group starting at content[start]
+// and the index just past its closing brace, or -1 if there is no group
+func readGroup(content string, start int) (string, int) {
+	for start < len(content) && (content[start] == ' ' || content[start] == '\t' || content[start] == '\n') {
+		start++
+	}
+	if start >= len(content) || content[start] != '{' {
+		return "", -1
+	}
+	depth := 0
+	for i := start; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return content[start+1 : i], i + 1
+			}
+		}
+	}
+	return "", -1
+}
+
+// parseGraphicsPaths returns the directories of the \graphicspath in effect at
+// the end of content, in search order and without trailing slashes. Like
+// LaTeX, a later \graphicspath replaces an earlier one.
+func parseGraphicsPaths(content string) []string {
+	content = stripTexComments(content)
+	dirs := []string{}
+
+	idx := strings.LastIndex(content, "\\graphicspath")
+	if idx < 0 {
+		return dirs
+	}
+	group, end := readGroup(content, idx+len("\\graphicspath"))
+	if end < 0 {
+		return dirs
+	}
+
+	// Each entry is its own brace group: {{figures/}{figures/SI/}}
+	for pos := 0; pos < len(group); {
+		entry, next := readGroup(group, pos)
+		if next < 0 {
+			break
+		}
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			dir := filepath.Clean(strings.TrimSuffix(entry, "/"))
+			dirs = append(dirs, dir)
+		}
+		pos = next
+	}
+	return dirs
+}
+
+// removeGraphicsPaths deletes every \graphicspath{...} command from content
+func removeGraphicsPaths(content string) string {
+	for {
+		idx := strings.Index(content, "\\graphicspath")
+		if idx < 0 {
+			return content
+		}
+		_, end := readGroup(content, idx+len("\\graphicspath"))
+		if end < 0 {
+			return content
+		}
+		content = content[:idx] + content[end:]
+	}
+}
+
+// stripTexComments removes % comments from every line of content
+func stripTexComments(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = stripTexComment(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// expandIncludes returns texFile with its \input and \include files inlined,
+// along with every file that was read, in order
+func expandIncludes(texFile string) (string, []string) {
+	files := []string{}
+	visited := make(map[string]bool)
+
+	var expand func(file string) string
+	expand = func(file string) string {
+		if visited[file] {
+			return ""
+		}
+		visited[file] = true
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return ""
+		}
+		files = append(files, file)
+
+		return includeRe.ReplaceAllStringFunc(stripTexComments(string(content)), func(m string) string {
+			ref := strings.TrimSpace(includeRe.FindStringSubmatch(m)[1])
+			if included := resolveInput(ref, fileExists); included != "" && filepath.Ext(included) == ".tex" {
+				return expand(included)
+			}
+			return m
+		})
+	}
+
+	return expand(filepath.Clean(texFile)), files
+}
+
+// flatNames assigns a root-level name to every file that will be moved out of
+// its directory. Files whose base name is unique keep it. When several files
+// share a base name, or the name is already taken in the root, each of them
+// is renamed to its directory path joined with underscores
+// (figures/SI/Figure1.pdf -> figures_SI_Figure1.pdf), with a numeric suffix
+// as a last resort. The result only depends on the set of paths.
+func flatNames(files []string, taken map[string]bool) (map[string]string, []string) {
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+
+	byBase := make(map[string][]string)
+	for _, f := range sorted {
+		base := filepath.Base(f)
+		byBase[base] = append(byBase[base], f)
+	}
+
+	names := make(map[string]string)
+	used := make(map[string]bool)
+	for name := range taken {
+		used[name] = true
+	}
+	collisions := []string{}
+
+	// Unique names first so that renamed files can't steal them
+	for _, f := range sorted {
+		base := filepath.Base(f)
+		if len(byBase[base]) == 1 && !used[base] {
+			names[f] = base
+			used[base] = true
+		}
+	}
+
+	for _, f := range sorted {
+		if _, ok := names[f]; ok {
+			continue
+		}
+		base := filepath.Base(f)
+		name := strings.ReplaceAll(filepath.ToSlash(filepath.Clean(f)), "/", "_")
+		if used[name] {
+			ext := filepath.Ext(name)
+			stem := strings.TrimSuffix(name, ext)
+			for i := 2; used[name]; i++ {
+				name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+			}
+		}
+		names[f] = name
+		used[name] = true
+		collisions = append(collisions, fmt.Sprintf("%s collides with another %s; renamed to %s", f, base, name))
+	}
+
+	return names, collisions
+}
+
+// graphicsSearchExts returns the extensions graphicx appends for engine, in
+// its order: the engine's formats, then the same in upper case
+func graphicsSearchExts(engine string) []string {
+	exts, ok := engineGraphicsExts[engine]
+	if !ok {
+		exts = engineGraphicsExts[EnginePdfLaTeX]
+	}
+	search := append([]string{}, exts...)
+	for _, ext := range exts {
+		search = append(search, strings.ToUpper(ext))
+	}
+	return search
+}
+
+// resolveGraphic finds the file LaTeX would load for a graphics reference.
+// A name with an extension is looked up in the current directory, then in
+// each graphicspath entry. Without one, graphicx tries each of the engine's
+// extensions in turn across all of those directories, so figures/a.pdf wins
+// over a.png.
+func resolveGraphic(ref string, gfxDirs []string, engine string, exists func(string) bool) string {
+	dirs := append([]string{""}, gfxDirs...)
+	if filepath.Ext(ref) != "" {
+		for _, dir := range dirs {
+			if candidate := filepath.Clean(filepath.Join(dir, ref)); exists(candidate) {
+				return candidate
+			}
+		}
+	}
+	for _, ext := range graphicsSearchExts(engine) {
+		for _, dir := range dirs {
+			if candidate := filepath.Clean(filepath.Join(dir, ref)) + ext; exists(candidate) {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// resolveInput finds the file TeX would load for an \input reference
+func resolveInput(ref string, exists func(string) bool) string {
+	candidate := filepath.Clean(ref)
+	if filepath.Ext(ref) != "" && exists(candidate) {
+		return candidate
+	}
+	for _, ext := range inputExts {
+		if exists(candidate + ext) {
+			return candidate + ext
+		}
+	}
+	return ""
+}
+
+// newReference builds the replacement argument for a moved file, keeping the
+// extension off if the original reference didn't have one
+func newReference(ref string, resolved string, names map[string]string) (string, bool) {
+	name, ok := names[resolved]
+	if !ok {
+		return ref, false
+	}
+	if filepath.Ext(ref) == "" || !strings.EqualFold(filepath.Ext(ref), filepath.Ext(resolved)) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name, name != ref
+}
+
+// rewriteGraphicsRefs points every \includegraphics, \includepdf and \input
+// that resolves to a moved file at its new root-level name
+func rewriteGraphicsRefs(content string, gfxDirs []string, engine string, names map[string]string, exists func(string) bool) string {
+	content = graphicsRefRe.ReplaceAllStringFunc(content, func(m string) string {
+		parts := graphicsRefRe.FindStringSubmatch(m)
+		ref := strings.TrimSpace(parts[2])
+		resolved := resolveGraphic(ref, gfxDirs, engine, exists)
+		if newRef, changed := newReference(ref, resolved, names); changed {
+			return parts[1] + newRef + parts[3]
+		}
+		return m
+	})
+
+	return inputRefRe.ReplaceAllStringFunc(content, func(m string) string {
+		parts := inputRefRe.FindStringSubmatch(m)
+		ref := strings.TrimSpace(parts[2])
+		resolved := resolveInput(ref, exists)
+		if newRef, changed := newReference(ref, resolved, names); changed {
+			return parts[1] + newRef + parts[3]
+		}
+		return m
+	})
+}
+
+// filesUnder lists the regular files below dir
+func filesUnder(dir string) []string {
+	files := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, filepath.Clean(path))
+		}
+		return nil
+	})
+	return files
+}
+
+// removeEmptyDirs removes dir and its subdirectories bottom-up if they are empty
+func removeEmptyDirs(dir string) {
+	dirs := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // Will only succeed if empty
+	}
+}
+
+// fileExists reports whether path is an existing regular file
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// allowedGraphic reports whether the engine can include a file with this extension
+func allowedGraphic(path string, engine string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, allowed := range engineGraphicsExts[engine] {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGraphics statically resolves every \includegraphics and \includepdf in
+// texFile and the files it includes. It returns the graphics that are used
+// and a diagnostic for every reference that is missing or has a format the
+// engine can't include.
+func checkGraphics(texFile string, engine string) ([]string, []texDiagnostic) {
+	content, files := expandIncludes(texFile)
+	gfxDirs := parseGraphicsPaths(content)
+
+	used := []string{}
+	diags := []texDiagnostic{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			for _, m := range graphicsRefRe.FindAllStringSubmatch(stripTexComment(line), -1) {
+				ref := strings.TrimSpace(m[2])
+				if strings.Contains(ref, "#") {
+					continue // Macro parameter inside a definition
+				}
+				resolved := resolveGraphic(ref, gfxDirs, engine, fileExists)
+				switch {
+				case resolved == "":
+					diags = append(diags, texDiagnostic{File: file, Line: i + 1, Level: "error",
+						Message: fmt.Sprintf("graphics file %s not found", ref)})
+				case !allowedGraphic(resolved, engine):
+					diags = append(diags, texDiagnostic{File: file, Line: i + 1, Level: "error",
+						Message: fmt.Sprintf("%s can't be included by %s (use one of %s)", resolved, engine, strings.Join(engineGraphicsExts[engine], ", "))})
+				default:
+					used = append(used, resolved)
+				}
+			}
+		}
+	}
+	return used, diags
+}
+
+// findUnusedGraphics lists the image files below root that aren't in used,
+// skipping hidden directories and the temp directory
+func findUnusedGraphics(root string, tmpDir string, used map[string]bool) []string {
+	unused := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != root && (strings.HasPrefix(name, ".") || filepath.Clean(path) == filepath.Clean(tmpDir)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		// Compiled documents sit next to their .tex file
+		if strings.EqualFold(filepath.Ext(rel), ".pdf") && fileExists(strings.TrimSuffix(path, filepath.Ext(path))+".tex") {
+			return nil
+		}
+		if imageExts[strings.ToLower(filepath.Ext(rel))] && !used[rel] {
+			unused = append(unused, rel)
+		}
+		return nil
+	})
+	return unused
+}
+
+// reportUnusedGraphics lists graphics that no document uses
+func reportUnusedGraphics(unused []string) {
+	report.update(func() { report.UnusedGraphics = append(report.UnusedGraphics, unused...) })
+	if len(unused) == 0 {
+		return
+	}
+	logger.Notef("%d graphics file(s) in the project are not used by any document:", len(unused))
+	for _, f := range unused {
+		logger.Infof("  %s", f)
+	}
+}
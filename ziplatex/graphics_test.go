@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlatNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		taken      []string
+		want       map[string]string
+		collisions int
+	}{
+		{
+			"unique names",
+			[]string{"figures/a.pdf", "figures/SI/b.png"},
+			nil,
+			map[string]string{"figures/a.pdf": "a.pdf", "figures/SI/b.png": "b.png"},
+			0,
+		},
+		{
+			"same base name",
+			[]string{"figures/SI/Figure1.pdf", "figures/Figure1.pdf"},
+			nil,
+			map[string]string{"figures/Figure1.pdf": "figures_Figure1.pdf", "figures/SI/Figure1.pdf": "figures_SI_Figure1.pdf"},
+			2,
+		},
+		{
+			"taken in the root",
+			[]string{"figures/logo.png"},
+			[]string{"logo.png"},
+			map[string]string{"figures/logo.png": "figures_logo.png"},
+			1,
+		},
+		{
+			"renamed name taken too",
+			[]string{"figures/logo.png"},
+			[]string{"logo.png", "figures_logo.png"},
+			map[string]string{"figures/logo.png": "figures_logo-2.png"},
+			1,
+		},
+		{
+			"renamed file can't steal a unique name",
+			[]string{"a/x.pdf", "b/x.pdf", "a_x.pdf"},
+			nil,
+			map[string]string{"a_x.pdf": "a_x.pdf", "a/x.pdf": "a_x-2.pdf", "b/x.pdf": "b_x.pdf"},
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken := make(map[string]bool)
+			for _, name := range tt.taken {
+				taken[name] = true
+			}
+			got, collisions := flatNames(tt.files, taken)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flatNames(%q) = %v, want %v", tt.files, got, tt.want)
+			}
+			if len(collisions) != tt.collisions {
+				t.Errorf("collisions = %q, want %d", collisions, tt.collisions)
+			}
+		})
+	}
+
+	// The names don't depend on the order of the files
+	a, _ := flatNames([]string{"x/f.pdf", "y/f.pdf"}, nil)
+	b, _ := flatNames([]string{"y/f.pdf", "x/f.pdf"}, nil)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("flatNames depends on order: %v, %v", a, b)
+	}
+}
+
+func TestRewriteGraphicsRefs(t *testing.T) {
+	existing := map[string]bool{
+		"figures/plot.pdf":      true,
+		"figures/SI/plot.pdf":   true,
+		"figures/diagram.tikz":  true,
+		"figures/photo.jpg":     true,
+		"figures/scan.PDF":      true,
+		"figures/SI/extra.png":  true,
+		"figures/SI/slides.pdf": true,
+	}
+	exists := func(path string) bool { return existing[path] }
+	names := map[string]string{
+		"figures/plot.pdf":      "figures_plot.pdf",
+		"figures/SI/plot.pdf":   "figures_SI_plot.pdf",
+		"figures/diagram.tikz":  "diagram.tikz",
+		"figures/photo.jpg":     "photo.jpg",
+		"figures/scan.PDF":      "scan.PDF",
+		"figures/SI/extra.png":  "extra.png",
+		"figures/SI/slides.pdf": "slides.pdf",
+	}
+	gfxDirs := []string{"figures", "figures/SI"}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"full path", `\includegraphics[width=\linewidth]{figures/plot.pdf}`, `\includegraphics[width=\linewidth]{figures_plot.pdf}`},
+		{"without extension", `\includegraphics{figures/SI/plot}`, `\includegraphics{figures_SI_plot}`},
+		{"through graphicspath", `\includegraphics*[scale=2]{photo.jpg} \includegraphics{extra}`, `\includegraphics*[scale=2]{photo.jpg} \includegraphics{extra}`},
+		{"first graphicspath entry wins", `\includegraphics{plot}`, `\includegraphics{figures_plot}`},
+		{"includepdf", `\includepdf[pages=-]{figures/SI/slides.pdf}`, `\includepdf[pages=-]{slides.pdf}`},
+		{"input", `\input{figures/diagram.tikz}`, `\input{diagram.tikz}`},
+		{"input without extension", `\input{figures/diagram}`, `\input{diagram}`},
+		{"upper case extension", `\includegraphics{figures/scan}`, `\includegraphics{scan}`},
+		{"unknown file", `\includegraphics{missing} \input{sections/intro}`, `\includegraphics{missing} \input{sections/intro}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteGraphicsRefs(tt.content, gfxDirs, EnginePdfLaTeX, names, exists); got != tt.want {
+				t.Errorf("rewriteGraphicsRefs(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphicsPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"none", `\includegraphics{a}`, []string{}},
+		{"one entry", `\graphicspath{{figures/}}`, []string{"figures"}},
+		{"several entries", `\graphicspath{{figures/}{figures/SI/} {./plots}}`, []string{"figures", "figures/SI", "plots"}},
+		{"spaces and newlines", "\\graphicspath {\n  {figures/}\n  {extra/}\n}", []string{"figures", "extra"}},
+		{"later one wins", `\graphicspath{{old/}} \graphicspath{{new/}}`, []string{"new"}},
+		{"commented out", "\\graphicspath{{figures/}}\n% \\graphicspath{{old/}}", []string{"figures"}},
+		{"escaped percent", `\graphicspath{{100\%/}}`, []string{`100\%`}},
+		{"unclosed", `\graphicspath{{figures/}`, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseGraphicsPaths(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGraphicsPaths(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveGraphic(t *testing.T) {
+	existing := map[string]bool{
+		"a/fig.png":   true,
+		"b/fig.pdf":   true,
+		"b/fig.eps":   true,
+		"b/logo.png":  true,
+		"logo.JPG":    true,
+		"a/scan.png":  true,
+		"b/scan.png":  true,
+		"b/photo.bmp": true,
+	}
+	exists := func(path string) bool { return existing[path] }
+	dirs := []string{"a", "b"}
+
+	tests := []struct {
+		ref    string
+		engine string
+		want   string
+	}{
+		{"fig", EnginePdfLaTeX, "b/fig.pdf"},
+		{"fig", EngineXeLaTeX, "b/fig.pdf"},
+		{"fig.png", EnginePdfLaTeX, "a/fig.png"},
+		{"fig.eps", EnginePdfLaTeX, "b/fig.eps"},
+		{"logo", EnginePdfLaTeX, "b/logo.png"},
+		{"scan", EnginePdfLaTeX, "a/scan.png"},
+		{"photo", EngineXeLaTeX, "b/photo.bmp"},
+		{"photo", EnginePdfLaTeX, ""},
+		{"missing", EnginePdfLaTeX, ""},
+	}
+	for _, tt := range tests {
+		if got := resolveGraphic(tt.ref, dirs, tt.engine, exists); got != tt.want {
+			t.Errorf("resolveGraphic(%q, %s) = %q, want %q", tt.ref, tt.engine, got, tt.want)
+		}
+	}
+	// The upper-case spellings come after every lower-case extension
+	if got := resolveGraphic("logo", nil, EnginePdfLaTeX, exists); got != "logo.JPG" {
+		t.Errorf("resolveGraphic(logo) = %q, want logo.JPG", got)
+	}
+}
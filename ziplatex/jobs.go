@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// forEachJob runs work(i) for i in 0..n-1 on up to jobs goroutines and calls
+// done(i) from the calling goroutine in index order, as soon as job i has
+// finished. Output printed from done is therefore ordered and never
+// interleaved between documents. The first error returned by done stops
+// further done calls and skips the jobs that haven't started yet; running
+// jobs are still waited for.
+func forEachJob(n int, jobs int, work func(i int), done func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	finished := make([]chan struct{}, n)
+	for i := range finished {
+		finished[i] = make(chan struct{})
+	}
+
+	queue := make(chan int)
+	var stopped atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if !stopped.Load() {
+					work(i)
+				}
+				close(finished[i])
+			}
+		}()
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	var err error
+	for i := 0; i < n; i++ {
+		<-finished[i]
+		if err == nil {
+			if err = done(i); err != nil {
+				stopped.Store(true)
+			}
+		}
+	}
+	wg.Wait()
+	return err
+}
+
+// scratchDirs hands out the per-document directories the engine writes its
+// .aux, .log and .fls files to, so concurrent runs never share them
+type scratchDirs struct {
+	root string
+}
+
+// newScratchDirs creates the scratch root in the system temp directory
+func newScratchDirs() (*scratchDirs, error) {
+	root, err := os.MkdirTemp("", "ziplatex-jobs-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating scratch directory: %v", err)
+	}
+	return &scratchDirs{root: root}, nil
+}
+
+// dir returns a fresh scratch directory for one engine pass over texFile
+func (s *scratchDirs) dir(stage string, texFile string) (string, error) {
+	dir := filepath.Join(s.root, stage, strings.TrimSuffix(filepath.Base(texFile), ".tex"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating scratch directory: %v", err)
+	}
+	return dir, nil
+}
+
+// contains reports whether path is inside the scratch root
+func (s *scratchDirs) contains(path string) bool {
+	return s != nil && strings.HasPrefix(filepath.Clean(path), s.root+string(filepath.Separator))
+}
+
+// remove deletes every scratch directory
+func (s *scratchDirs) remove() {
+	os.RemoveAll(s.root)
+}
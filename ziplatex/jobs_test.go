@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachJobOrder(t *testing.T) {
+	// Later jobs finish first, but done still sees them in index order
+	const n = 4
+	finished := make([]chan struct{}, n)
+	for i := range finished {
+		finished[i] = make(chan struct{})
+	}
+	var order []int
+	err := forEachJob(n, n, func(i int) {
+		if i < n-1 {
+			<-finished[i+1]
+		}
+		close(finished[i])
+	}, func(i int) error {
+		order = append(order, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(order, want) {
+		t.Errorf("done order = %v, want %v", order, want)
+	}
+}
+
+func TestForEachJobLimit(t *testing.T) {
+	for _, jobs := range []int{-1, 0, 1, 3, 20} {
+		var running, peak, ran int32
+		var mu sync.Mutex
+		err := forEachJob(10, jobs, func(i int) {
+			now := atomic.AddInt32(&running, 1)
+			mu.Lock()
+			if now > peak {
+				peak = now
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&ran, 1)
+		}, func(i int) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		limit := int32(jobs)
+		if limit < 1 {
+			limit = 1
+		}
+		if ran != 10 || peak > limit {
+			t.Errorf("jobs=%d: ran %d jobs, %d at once", jobs, ran, peak)
+		}
+	}
+}
+
+func TestForEachJobError(t *testing.T) {
+	failed := errors.New("failed")
+	gate := make(chan struct{})
+	var worked []int
+	var mu sync.Mutex
+	var done []int
+	err := forEachJob(10, 1, func(i int) {
+		if i == 1 {
+			// Hold the only worker until job 0's error has been seen
+			<-gate
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		worked = append(worked, i)
+		mu.Unlock()
+	}, func(i int) error {
+		done = append(done, i)
+		if i == 0 {
+			close(gate)
+			return failed
+		}
+		return nil
+	})
+	if err != failed {
+		t.Errorf("forEachJob() = %v, want %v", err, failed)
+	}
+	if want := []int{0}; !reflect.DeepEqual(done, want) {
+		t.Errorf("done called for %v, want %v", done, want)
+	}
+	// Job 1 may have started before the error; the others are skipped
+	if len(worked) > 2 || worked[0] != 0 {
+		t.Errorf("work called for %v, want 0 and at most 1", worked)
+	}
+}
+
+func TestForEachJobNone(t *testing.T) {
+	err := forEachJob(0, 4, func(i int) { t.Errorf("work(%d) called", i) }, func(i int) error {
+		t.Errorf("done(%d) called", i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
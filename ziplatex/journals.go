@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// cassiAbbreviations are the CAS Source Index abbreviations of the journals
+// chemistry papers cite most, by full name. Older or alternative full names
+// are listed too.
+var cassiAbbreviations = map[string]string{
+	// ACS
+	"Accounts of Chemical Research":                "Acc. Chem. Res.",
+	"ACS Applied Electronic Materials":             "ACS Appl. Electron. Mater.",
+	"ACS Applied Energy Materials":                 "ACS Appl. Energy Mater.",
+	"ACS Applied Materials & Interfaces":           "ACS Appl. Mater. Interfaces",
+	"ACS Applied Nano Materials":                   "ACS Appl. Nano Mater.",
+	"ACS Catalysis":                                "ACS Catal.",
+	"ACS Central Science":                          "ACS Cent. Sci.",
+	"ACS Chemical Biology":                         "ACS Chem. Biol.",
+	"ACS Energy Letters":                           "ACS Energy Lett.",
+	"ACS Macro Letters":                            "ACS Macro Lett.",
+	"ACS Materials Letters":                        "ACS Mater. Lett.",
+	"ACS Nano":                                     "ACS Nano",
+	"ACS Omega":                                    "ACS Omega",
+	"ACS Photonics":                                "ACS Photonics",
+	"ACS Sensors":                                  "ACS Sens.",
+	"ACS Sustainable Chemistry & Engineering":      "ACS Sustainable Chem. Eng.",
+	"Analytical Chemistry":                         "Anal. Chem.",
+	"Biochemistry":                                 "Biochemistry",
+	"Bioconjugate Chemistry":                       "Bioconjugate Chem.",
+	"Chemical Reviews":                             "Chem. Rev.",
+	"Chemistry of Materials":                       "Chem. Mater.",
+	"Crystal Growth & Design":                      "Cryst. Growth Des.",
+	"Energy & Fuels":                               "Energy Fuels",
+	"Environmental Science & Technology":           "Environ. Sci. Technol.",
+	"Industrial & Engineering Chemistry Research":  "Ind. Eng. Chem. Res.",
+	"Inorganic Chemistry":                          "Inorg. Chem.",
+	"Journal of Chemical Education":                "J. Chem. Educ.",
+	"Journal of Chemical Information and Modeling": "J. Chem. Inf. Model.",
+	"Journal of Chemical Theory and Computation":   "J. Chem. Theory Comput.",
+	"Journal of Medicinal Chemistry":               "J. Med. Chem.",
+	"Journal of Organic Chemistry":                 "J. Org. Chem.",
+	"Journal of Physical Chemistry":                "J. Phys. Chem.",
+	"Journal of Physical Chemistry A":              "J. Phys. Chem. A",
+	"Journal of Physical Chemistry B":              "J. Phys. Chem. B",
+	"Journal of Physical Chemistry C":              "J. Phys. Chem. C",
+	"Journal of Physical Chemistry Letters":        "J. Phys. Chem. Lett.",
+	"Journal of the American Chemical Society":     "J. Am. Chem. Soc.",
+	"Langmuir":        "Langmuir",
+	"Macromolecules":  "Macromolecules",
+	"Nano Letters":    "Nano Lett.",
+	"Organic Letters": "Org. Lett.",
+	"Organometallics": "Organometallics",
+
+	// RSC
+	"Analyst":                                               "Analyst",
+	"Catalysis Science & Technology":                        "Catal. Sci. Technol.",
+	"Chemical Communications":                               "Chem. Commun.",
+	"Chemical Science":                                      "Chem. Sci.",
+	"Chemical Society Reviews":                              "Chem. Soc. Rev.",
+	"CrystEngComm":                                          "CrystEngComm",
+	"Dalton Transactions":                                   "Dalton Trans.",
+	"Energy & Environmental Science":                        "Energy Environ. Sci.",
+	"Faraday Discussions":                                   "Faraday Discuss.",
+	"Green Chemistry":                                       "Green Chem.",
+	"Journal of Materials Chemistry":                        "J. Mater. Chem.",
+	"Journal of Materials Chemistry A":                      "J. Mater. Chem. A",
+	"Journal of Materials Chemistry B":                      "J. Mater. Chem. B",
+	"Journal of Materials Chemistry C":                      "J. Mater. Chem. C",
+	"Journal of the Chemical Society, Faraday Transactions": "J. Chem. Soc., Faraday Trans.",
+	"Lab on a Chip":                                         "Lab Chip",
+	"Materials Horizons":                                    "Mater. Horiz.",
+	"Nanoscale":                                             "Nanoscale",
+	"Nanoscale Advances":                                    "Nanoscale Adv.",
+	"New Journal of Chemistry":                              "New J. Chem.",
+	"Organic & Biomolecular Chemistry":                      "Org. Biomol. Chem.",
+	"Physical Chemistry Chemical Physics":                   "Phys. Chem. Chem. Phys.",
+	"Polymer Chemistry":                                     "Polym. Chem.",
+	"RSC Advances":                                          "RSC Adv.",
+	"Soft Matter":                                           "Soft Matter",
+
+	// Wiley
+	"Advanced Electronic Materials":                      "Adv. Electron. Mater.",
+	"Advanced Energy Materials":                          "Adv. Energy Mater.",
+	"Advanced Functional Materials":                      "Adv. Funct. Mater.",
+	"Advanced Materials":                                 "Adv. Mater.",
+	"Advanced Optical Materials":                         "Adv. Opt. Mater.",
+	"Advanced Science":                                   "Adv. Sci.",
+	"Angewandte Chemie":                                  "Angew. Chem.",
+	"Angewandte Chemie International Edition":            "Angew. Chem., Int. Ed.",
+	"Angewandte Chemie International Edition in English": "Angew. Chem., Int. Ed. Engl.",
+	"ChemBioChem":                                        "ChemBioChem",
+	"ChemCatChem":                                        "ChemCatChem",
+	"ChemElectroChem":                                    "ChemElectroChem",
+	"Chemistry - A European Journal":                     "Chem. - Eur. J.",
+	"Chemistry - An Asian Journal":                       "Chem. - Asian J.",
+	"ChemistrySelect":                                    "ChemistrySelect",
+	"ChemPhysChem":                                       "ChemPhysChem",
+	"ChemSusChem":                                        "ChemSusChem",
+	"European Journal of Inorganic Chemistry":            "Eur. J. Inorg. Chem.",
+	"European Journal of Organic Chemistry":              "Eur. J. Org. Chem.",
+	"Israel Journal of Chemistry":                        "Isr. J. Chem.",
+	"Journal of Computational Chemistry":                 "J. Comput. Chem.",
+	"Small":                                              "Small",
+
+	// Nature and Science
+	"Communications Chemistry": "Commun. Chem.",
+	"Nature":                   "Nature",
+	"Nature Catalysis":         "Nat. Catal.",
+	"Nature Chemistry":         "Nat. Chem.",
+	"Nature Communications":    "Nat. Commun.",
+	"Nature Electronics":       "Nat. Electron.",
+	"Nature Energy":            "Nat. Energy",
+	"Nature Materials":         "Nat. Mater.",
+	"Nature Nanotechnology":    "Nat. Nanotechnol.",
+	"Nature Photonics":         "Nat. Photonics",
+	"Nature Physics":           "Nat. Phys.",
+	"Nature Reviews Chemistry": "Nat. Rev. Chem.",
+	"Nature Reviews Materials": "Nat. Rev. Mater.",
+	"Science":                  "Science",
+	"Science Advances":         "Sci. Adv.",
+	"Scientific Reports":       "Sci. Rep.",
+
+	// Physics and others
+	"Applied Physics Letters":                         "Appl. Phys. Lett.",
+	"Beilstein Journal of Nanotechnology":             "Beilstein J. Nanotechnol.",
+	"Beilstein Journal of Organic Chemistry":          "Beilstein J. Org. Chem.",
+	"Chem":                                            "Chem",
+	"Chemical Physics Letters":                        "Chem. Phys. Lett.",
+	"Coordination Chemistry Reviews":                  "Coord. Chem. Rev.",
+	"Electrochimica Acta":                             "Electrochim. Acta",
+	"Joule":                                           "Joule",
+	"Journal of Applied Physics":                      "J. Appl. Phys.",
+	"Journal of Chemical Physics":                     "J. Chem. Phys.",
+	"Journal of Electroanalytical Chemistry":          "J. Electroanal. Chem.",
+	"Journal of Physics: Condensed Matter":            "J. Phys.: Condens. Matter",
+	"Matter":                                          "Matter",
+	"Nano Energy":                                     "Nano Energy",
+	"Nano Today":                                      "Nano Today",
+	"Nanotechnology":                                  "Nanotechnology",
+	"Organic Electronics":                             "Org. Electron.",
+	"Physical Review":                                 "Phys. Rev.",
+	"Physical Review A":                               "Phys. Rev. A",
+	"Physical Review B":                               "Phys. Rev. B",
+	"Physical Review E":                               "Phys. Rev. E",
+	"Physical Review Letters":                         "Phys. Rev. Lett.",
+	"Proceedings of the National Academy of Sciences": "Proc. Natl. Acad. Sci. U. S. A.",
+	"Proceedings of the National Academy of Sciences of the United States of America": "Proc. Natl. Acad. Sci. U. S. A.",
+	"Reviews of Modern Physics": "Rev. Mod. Phys.",
+	"Surface Science":           "Surf. Sci.",
+	"Synthetic Metals":          "Synth. Met.",
+	"Tetrahedron":               "Tetrahedron",
+	"Tetrahedron Letters":       "Tetrahedron Lett.",
+	"Thin Solid Films":          "Thin Solid Films",
+}
+
+// journalProfile is the way a bibliography style abbreviates journal names:
+// CASSI, with the house style of the publisher where it differs
+type journalProfile struct {
+	Name      string
+	Overrides map[string]string // Full name -> abbreviation
+}
+
+// journalProfiles are the built-in profiles selectable with -journals, named
+// after the biblatex-chem styles the template supports
+var journalProfiles = map[string]journalProfile{
+	"chem-acs": {
+		Name:      "chem-acs",
+		Overrides: map[string]string{},
+	},
+	"chem-rsc": {
+		Name: "chem-rsc",
+		Overrides: map[string]string{
+			"Chemistry - A European Journal": "Chem.--Eur. J.",
+			"Chemistry - An Asian Journal":   "Chem.--Asian J.",
+		},
+	},
+	"chem-angew": {
+		Name: "chem-angew",
+		Overrides: map[string]string{
+			"Angewandte Chemie International Edition":                                         "Angew. Chem. Int. Ed.",
+			"Angewandte Chemie International Edition in English":                              "Angew. Chem. Int. Ed. Engl.",
+			"Chemistry - A European Journal":                                                  "Chem. Eur. J.",
+			"Chemistry - An Asian Journal":                                                    "Chem. Asian J.",
+			"Proceedings of the National Academy of Sciences":                                 "Proc. Natl. Acad. Sci. USA",
+			"Proceedings of the National Academy of Sciences of the United States of America": "Proc. Natl. Acad. Sci. USA",
+		},
+	},
+}
+
+// journalProfileNames lists the built-in profiles for usage messages
+func journalProfileNames() string {
+	return "chem-acs, chem-rsc or chem-angew"
+}
+
+// journalTable maps journal names, full or abbreviated in any style, to the
+// abbreviation of a profile
+type journalTable struct {
+	Profile  string
+	abbrevs  map[string]string // journalKey of a name -> abbreviation
+	reported map[string]bool   // Unknown journals already reported
+}
+
+// journalKey reduces a journal name to the form names are looked up by, so
+// that "The Journal of ...", "&" and "and" or missing periods don't matter
+func journalKey(name string) string {
+	words := []string{}
+	for _, word := range titleWords(name) {
+		if word != "the" && word != "and" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// newJournalTable returns the table of profile, with the abbreviations read
+// from file (if not "") taking precedence
+func newJournalTable(profile journalProfile, file string) (*journalTable, error) {
+	chosen := make(map[string]string)
+	for full, abbrev := range cassiAbbreviations {
+		chosen[full] = abbrev
+	}
+	for full, abbrev := range profile.Overrides {
+		chosen[full] = abbrev
+	}
+	custom := map[string]string{}
+	if file != "" {
+		var err error
+		if custom, err = readJournalAbbrevs(file); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &journalTable{Profile: profile.Name, abbrevs: make(map[string]string), reported: make(map[string]bool)}
+	// Every spelling of a journal leads to the abbreviation chosen for it
+	for full, abbrev := range chosen {
+		t.abbrevs[journalKey(full)] = abbrev
+		t.abbrevs[journalKey(cassiAbbreviations[full])] = abbrev
+		for _, other := range journalProfiles {
+			if alt, ok := other.Overrides[full]; ok {
+				t.abbrevs[journalKey(alt)] = abbrev
+			}
+		}
+	}
+	for full, abbrev := range custom {
+		if old, ok := t.abbrevs[journalKey(full)]; ok {
+			t.abbrevs[journalKey(old)] = abbrev
+		}
+		t.abbrevs[journalKey(full)] = abbrev
+		t.abbrevs[journalKey(abbrev)] = abbrev
+	}
+	return t, nil
+}
+
+// readJournalAbbrevs reads "Full Name = Abbrev." lines, or JabRef's
+// "Full Name;Abbrev." lines. # starts a comment.
+func readJournalAbbrevs(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal abbreviations: %v", err)
+	}
+	abbrevs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		full, abbrev, ok := strings.Cut(line, "=")
+		if !ok {
+			full, abbrev, ok = strings.Cut(line, ";")
+		}
+		// JabRef lists may have a third column with a shorter form
+		abbrev, _, _ = strings.Cut(abbrev, ";")
+		full, abbrev = strings.TrimSpace(full), strings.TrimSpace(abbrev)
+		if !ok || full == "" || abbrev == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"Full Name = Abbrev.\"", path, n)
+		}
+		abbrevs[full] = abbrev
+	}
+	return abbrevs, nil
+}
+
+// lookup returns the abbreviation of a journal name
+func (t *journalTable) lookup(name string) (string, bool) {
+	abbrev, ok := t.abbrevs[journalKey(name)]
+	return abbrev, ok
+}
+
+// unknown returns a warning for a journal that isn't in the table, once
+func (t *journalTable) unknown(file string, line int, name string) []texDiagnostic {
+	if t.reported[journalKey(name)] {
+		return nil
+	}
+	t.reported[journalKey(name)] = true
+	return []texDiagnostic{{File: file, Line: line, Level: "warning",
+		Message: fmt.Sprintf("unknown journal %q; it is left as is (add it to a -journal-abbrevs file)", name)}}
+}
+
+// bibEdits returns the edits abbreviating the journal and journaltitle
+// fields of f. A name given by an @string is changed in the @string.
+func (t *journalTable) bibEdits(f *bibFile) ([]bibEdit, []texDiagnostic) {
+	macros := make(map[string]bibField)
+	for _, e := range f.Entries {
+		if e.Type == "string" {
+			for _, field := range e.Fields {
+				macros[field.Name] = field
+			}
+		}
+	}
+
+	edits := []bibEdit{}
+	diags := []texDiagnostic{}
+	edited := make(map[int]bool)
+	for _, e := range f.Entries {
+		if !e.isReference() {
+			continue
+		}
+		for _, field := range e.Fields {
+			if field.Name != "journal" && field.Name != "journaltitle" {
+				continue
+			}
+			if macro, ok := macros[strings.ToLower(field.Value)]; ok {
+				field = macro
+			}
+			// Names joined with # are left alone
+			if strings.Contains(field.Value, "#") {
+				continue
+			}
+			name := unquoteBib(field.Value)
+			abbrev, ok := t.lookup(name)
+			if !ok {
+				diags = append(diags, t.unknown(f.Path, e.Line, name)...)
+				continue
+			}
+			if abbrev != name && !edited[field.Start] {
+				logger.Debugf("%s: %s -> %s", e.Key, name, abbrev)
+				edits = append(edits, bibEdit{Start: field.Start, End: field.End, Text: "{" + abbrev + "}"})
+				edited[field.Start] = true
+			}
+		}
+	}
+	return edits, diags
+}
+
+// bblJournalRe finds the journal names in a .bbl written by biber, or by a
+// BibTeX style that marks fields with \bibinfo
+var bblJournalRe = regexp.MustCompile(`\\(?:field|bibinfo)\s*\{(?:journal|journaltitle)\}\s*\{`)
+
+// normalizeBbl abbreviates the journal names in the .bbl file path and
+// returns how many it changed
+func (t *journalTable) normalizeBbl(path string) (int, []texDiagnostic, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	content := string(data)
+	edits := []bibEdit{}
+	diags := []texDiagnostic{}
+	for _, m := range bblJournalRe.FindAllStringIndex(content, -1) {
+		name, end := readGroup(content, m[1]-1)
+		if end < 0 {
+			continue
+		}
+		abbrev, ok := t.lookup(name)
+		if !ok {
+			diags = append(diags, t.unknown(path, strings.Count(content[:m[0]], "\n")+1, name)...)
+			continue
+		}
+		if abbrev != name {
+			edits = append(edits, bibEdit{Start: m[1], End: end - 1, Text: abbrev})
+		}
+	}
+	if len(edits) > 0 {
+		if err := ioutil.WriteFile(path, []byte(applyBibEdits(content, edits)), 0644); err != nil {
+			return 0, diags, fmt.Errorf("error writing %s: %v", path, err)
+		}
+	}
+	return len(edits), diags, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Journal of the American Chemical Society", "journal of american chemical society"},
+		{"The Journal of the American Chemical Society", "journal of american chemical society"},
+		{"J. Am. Chem. Soc.", "j am chem soc"},
+		{"J Am Chem Soc", "j am chem soc"},
+		{"ACS Applied Materials & Interfaces", "acs applied materials interfaces"},
+		{"ACS Applied Materials and Interfaces", "acs applied materials interfaces"},
+		{"Chemistry -- A European Journal", "chemistry a european journal"},
+		{"Zeitschrift für Naturforschung", "zeitschrift fur naturforschung"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := journalKey(tt.name); got != tt.want {
+			t.Errorf("journalKey(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJournalBibEdits(t *testing.T) {
+	abbrevs := filepath.Join(t.TempDir(), "abbrevs.txt")
+	os.WriteFile(abbrevs, []byte("# lab journals\nJournal of Lab Results = J. Lab Res.\n"), 0644)
+	table, err := newJournalTable(journalProfiles["chem-angew"], abbrevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := `@string{jacs = {Journal of the American Chemical Society}}
+@article{a, journal = jacs}
+@article{b, journal = jacs}
+@article{c, journaltitle = "Chem. - Eur. J."}
+@article{d, journal = {Angew. Chem. Int. Ed.}}
+@article{e, journal = {Journal of Lab Results}}
+@article{f, journal = {Unknown Letters}}
+@article{g, journal = {Unknown Letters}}
+@article{h, journal = jacs # { Suppl.}}
+@article{i, title = {Journal of the American Chemical Society}}
+`
+	f, diags := parseBib("refs.bib", content)
+	if len(diags) > 0 {
+		t.Fatal(diags)
+	}
+	edits, diags := table.bibEdits(f)
+	want := `@string{jacs = {J. Am. Chem. Soc.}}
+@article{a, journal = jacs}
+@article{b, journal = jacs}
+@article{c, journaltitle = {Chem. Eur. J.}}
+@article{d, journal = {Angew. Chem. Int. Ed.}}
+@article{e, journal = {J. Lab Res.}}
+@article{f, journal = {Unknown Letters}}
+@article{g, journal = {Unknown Letters}}
+@article{h, journal = jacs # { Suppl.}}
+@article{i, title = {Journal of the American Chemical Society}}
+`
+	if got := applyBibEdits(content, edits); got != want {
+		t.Errorf("bibEdits gave\n%s\nwant\n%s", got, want)
+	}
+	if _, messages := bibSummary(f, diags); !reflect.DeepEqual(messages, []string{`7: unknown journal "Unknown Letters"; it is left as is (add it to a -journal-abbrevs file)`}) {
+		t.Errorf("diagnostics = %q", messages)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// systemTreeVars are the kpathsea variables naming trees that every TeX
+// installation has, or that only hold generated files (formats, font maps)
+var systemTreeVars = []string{
+	"TEXMFROOT", "TEXMFDIST", "TEXMFMAIN", "TEXMFSYSDIST", "TEXMFDEBIAN",
+	"TEXMFSYSVAR", "TEXMFSYSCONFIG", "TEXMFVAR", "TEXMFCONFIG", "TEXMFCACHE",
+}
+
+// texRoots classifies absolute dependencies as coming from the TeX
+// distribution or from a personal or site-local location (TEXMFHOME,
+// TEXMFLOCAL, TEXINPUTS, ...) that a journal won't have
+type texRoots struct {
+	system []string
+	known  bool // kpsewhich named the trees; without them nothing can be classified
+}
+
+// findTexRoots asks kpsewhich for the distribution trees of engine
+func findTexRoots(engine string) *texRoots {
+	roots := &texRoots{}
+	add := func(value string) bool {
+		added := false
+		// Values can be lists such as {!!/a,/b} or /a:/b
+		for _, path := range strings.FieldsFunc(value, func(r rune) bool {
+			return r == '{' || r == '}' || r == ',' || r == filepath.ListSeparator
+		}) {
+			path = strings.TrimPrefix(strings.TrimSpace(path), "!!")
+			if filepath.IsAbs(path) && !strings.Contains(path, "$") {
+				roots.system = append(roots.system, filepath.Clean(path))
+				added = true
+			}
+		}
+		return added
+	}
+
+	for _, name := range systemTreeVars {
+		cmd, finish := toolCommand("kpsewhich", "-engine="+engine, "-var-value="+name)
+		output, err := cmd.Output()
+		if finish(err) == nil && add(strings.TrimSpace(string(output))) {
+			roots.known = true
+		}
+	}
+	if !roots.known {
+		logger.Warnf("kpsewhich did not name the TeX distribution trees; files from personal texmf trees and TEXINPUTS are not bundled")
+		return roots
+	}
+	// texmf.cnf lives in the distribution even where the trees are split up
+	cmd, finish := toolCommand("kpsewhich", "texmf.cnf")
+	if output, err := cmd.Output(); finish(err) == nil {
+		if cnf := strings.TrimSpace(string(output)); cnf != "" {
+			add(filepath.Dir(filepath.Dir(cnf)))
+		}
+	}
+	logger.Debugf("TeX distribution trees: %s", strings.Join(roots.system, ", "))
+	return roots
+}
+
+// isSystem reports whether path is inside a distribution tree
+func (r *texRoots) isSystem(path string) bool {
+	path = filepath.Clean(path)
+	for _, root := range r.system {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// personalDeps returns the absolute INPUT files in the .fls of texFile that
+// don't come from the distribution or outDir. findDeps must have run first
+// with the same outDir. Without the distribution trees there are none.
+func personalDeps(texFile string, outDir string, roots *texRoots) []string {
+	if !roots.known {
+		return nil
+	}
+	content, err := ioutil.ReadFile(flsPath(texFile, outDir))
+	if err != nil {
+		return nil
+	}
+
+	deps := []string{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "INPUT ") {
+			continue
+		}
+		dep := strings.TrimPrefix(line, "INPUT ")
+		if !filepath.IsAbs(dep) || seen[dep] || roots.isSystem(dep) ||
+			(outDir != "" && strings.HasPrefix(dep, outDir+string(filepath.Separator))) {
+			continue
+		}
+		// Formats, font maps and configuration are never worth shipping
+		if ext := filepath.Ext(dep); ext == ".fmt" || ext == ".map" || ext == ".cnf" {
+			continue
+		}
+		seen[dep] = true
+		deps = append(deps, dep)
+	}
+	return deps
+}
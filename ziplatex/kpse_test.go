@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPersonalDeps(t *testing.T) {
+	dir := t.TempDir()
+	fls := strings.Join([]string{
+		"PWD /home/me/paper",
+		"INPUT /usr/share/texlive/texmf-dist/tex/latex/base/article.cls",
+		"INPUT /home/me/texmf/tex/latex/mine/mine.sty",
+		"INPUT /home/me/texmf/tex/latex/mine/mine.sty",
+		"INPUT " + filepath.Join(dir, "main.aux"),
+		"INPUT /var/lib/texmf/web2c/pdftex/pdflatex.fmt",
+		"INPUT main.tex",
+		"OUTPUT /home/me/out.log",
+	}, "\n")
+	os.WriteFile(filepath.Join(dir, "main.fls"), []byte(fls), 0644)
+
+	tests := []struct {
+		name  string
+		roots *texRoots
+		want  []string
+	}{
+		{"known trees", &texRoots{system: []string{"/usr/share/texlive/texmf-dist"}, known: true}, []string{"/home/me/texmf/tex/latex/mine/mine.sty"}},
+		{"sibling of a tree", &texRoots{system: []string{"/usr/share/texlive/texmf"}, known: true}, []string{"/usr/share/texlive/texmf-dist/tex/latex/base/article.cls", "/home/me/texmf/tex/latex/mine/mine.sty"}},
+		{"unknown trees", &texRoots{}, nil},
+	}
+	for _, tt := range tests {
+		if got := personalDeps("main.tex", dir, tt.roots); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: personalDeps = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindTexRootsWithoutKpsewhich(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	saved := report
+	defer func() { report = saved }()
+	report = newReport()
+
+	roots := findTexRoots(EnginePdfLaTeX)
+	if roots.known || len(roots.system) != 0 {
+		t.Errorf("findTexRoots without kpsewhich = %+v, want no trees", roots)
+	}
+	if len(report.Warnings) != 1 {
+		t.Errorf("got warnings %q, want one", report.Warnings)
+	}
+}
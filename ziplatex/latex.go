@@ -6,34 +6,76 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-// findDeps runs pdflatex with -record flag to find all dependencies
-func findDeps(texFile string) ([]string, error) {
-	cmd := exec.Command("pdflatex", "-draft", "-record", "-halt-on-error", "-interaction=nonstopmode", texFile)
+// Supported TeX engines
+const (
+	EnginePdfLaTeX = "pdflatex"
+	EngineXeLaTeX  = "xelatex"
+	EngineLuaLaTeX = "lualatex"
+)
+
+// validEngine reports whether engine is one of the supported TeX engines
+func validEngine(engine string) bool {
+	switch engine {
+	case EnginePdfLaTeX, EngineXeLaTeX, EngineLuaLaTeX:
+		return true
+	}
+	return false
+}
+
+// engineArgs returns the engine arguments for texFile, writing the engine's
+// own files to outDir if it is not empty
+func engineArgs(texFile string, outDir string, flags ...string) []string {
+	args := append(flags, "-halt-on-error", "-interaction=nonstopmode")
+	if outDir != "" {
+		args = append(args, "-output-directory="+outDir)
+	}
+	return append(args, texFile)
+}
+
+// flsPath returns the recorder file the engine writes for texFile
+func flsPath(texFile string, outDir string) string {
+	if outDir != "" {
+		return filepath.Join(outDir, strings.TrimSuffix(filepath.Base(texFile), ".tex")+".fls")
+	}
+	return strings.TrimSuffix(texFile, ".tex") + ".fls"
+}
+
+// findDeps runs the engine with -record flag to find all dependencies.
+// If outDir is set the engine writes its .aux, .log and .fls files there.
+// Shell escape may only run the programs in allow.
+func findDeps(engine string, texFile string, outDir string, allow []string) ([]string, error) {
+	logger.Debugf("Running %s -draft -record on %s", engine, texFile)
+	cmd, finish := engineCommand(engine, allow, engineArgs(texFile, outDir, "-draft", "-record")...)
 	output, err := cmd.CombinedOutput()
+	err = finish(err)
+	checkWrites(texFile, outDir, string(output))
 	
 	if err != nil {
 		// Provide more context about what went wrong
 		if strings.Contains(err.Error(), "executable file not found") {
-			return nil, fmt.Errorf("pdflatex not found in PATH")
+			return nil, fmt.Errorf("%s not found in PATH", engine)
 		}
-		// If pdflatex ran but failed, include some output for debugging
+		// If the engine ran but failed, include some output for debugging
 		outputStr := string(output)
 		if len(outputStr) > 1000 {
 			// Show last 1000 chars which usually contain the error
 			outputStr = "..." + outputStr[len(outputStr)-1000:]
 		}
-		return nil, fmt.Errorf("pdflatex failed for %s: %v\nOutput: %s", texFile, err, outputStr)
+		return nil, fmt.Errorf("%s failed for %s: %v\nOutput: %s", engine, texFile, err, outputStr)
 	}
 	
-	// Read the .fls file
-	flsFile := strings.TrimSuffix(texFile, ".tex") + ".fls"
-	content, err := ioutil.ReadFile(flsFile)
+	return readFls(texFile, outDir)
+}
+
+// readFls returns the relative INPUT files of the .fls of texFile
+func readFls(texFile string, outDir string) ([]string, error) {
+	content, err := ioutil.ReadFile(flsPath(texFile, outDir))
 	if err != nil {
 		return nil, fmt.Errorf("error reading .fls file: %v", err)
 	}
@@ -64,72 +106,66 @@ func findDeps(texFile string) ([]string, error) {
 	return deps, nil
 }
 
-// checkTex verifies that a tex file compiles without errors
-func checkTex(texFile string) error {
-	cmd := exec.Command("pdflatex", "-draft", "-halt-on-error", "-interaction=nonstopmode", texFile)
-	output, err := cmd.CombinedOutput()
-	
-	if err != nil {
-		return fmt.Errorf("LaTeX compilation failed for %s:\n%s", texFile, string(output))
-	}
-	
-	return nil
-}
-
-// findBadChars searches the log file for Unicode characters that break pdflatex
-func findBadChars(logFile string) ([]string, error) {
-	content, err := ioutil.ReadFile(logFile)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Look for "There is no X (U+XXXX) in font" patterns
-	re := regexp.MustCompile(`There is no (.) \(.*?\) in font`)
-	matches := re.FindAllStringSubmatch(string(content), -1)
-	
-	badChars := []string{}
-	seen := make(map[string]bool)
-	
-	for _, match := range matches {
-		if len(match) > 1 && !seen[match[1]] {
-			badChars = append(badChars, match[1])
-			seen[match[1]] = true
-		}
-	}
-	
-	return badChars, nil
+// texDiagnostic is an error or warning parsed from engine output
+type texDiagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Level   string `json:"level"` // "error" or "warning"
+	Message string `json:"message"`
 }
 
-// findBadCharLocations searches for bad characters in tex/bib files (not bbl)
-func findBadCharLocations(badChar string, dir string) ([]string, error) {
-	locations := []string{}
+var (
+	texLineRe    = regexp.MustCompile(`^l\.(\d+)`)
+	texWarningRe = regexp.MustCompile(`^(?:LaTeX|Package \S+|Class \S+) Warning: (.*)`)
+	onLineRe     = regexp.MustCompile(`on input line (\d+)`)
+)
 
-	patterns := []string{"*.tex", "*.bib"}
-	for _, pattern := range patterns {
-		files, err := filepath.Glob(filepath.Join(dir, pattern))
-		if err != nil {
+// parseTexDiagnostics extracts errors and warnings from engine output
+func parseTexDiagnostics(texFile string, output string) []texDiagnostic {
+	diags := []texDiagnostic{}
+	lines := strings.Split(output, "\n")
+	
+	for i, line := range lines {
+		if strings.HasPrefix(line, "! ") {
+			diag := texDiagnostic{File: texFile, Level: "error", Message: strings.TrimPrefix(line, "! ")}
+			// The offending line number follows shortly after as "l.<n>"
+			for j := i + 1; j < len(lines) && j <= i+10; j++ {
+				if m := texLineRe.FindStringSubmatch(lines[j]); m != nil {
+					diag.Line, _ = strconv.Atoi(m[1])
+					break
+				}
+			}
+			diags = append(diags, diag)
 			continue
 		}
 		
-		for _, file := range files {
-			content, err := ioutil.ReadFile(file)
-			if err != nil {
-				continue
-			}
-			
-			if strings.Contains(string(content), badChar) {
-				// Find line numbers
-				lines := strings.Split(string(content), "\n")
-				for i, line := range lines {
-					if strings.Contains(line, badChar) {
-						locations = append(locations, fmt.Sprintf("%s:%d: %s", file, i+1, strings.TrimSpace(line)))
-					}
-				}
+		if m := texWarningRe.FindStringSubmatch(line); m != nil {
+			diag := texDiagnostic{File: texFile, Level: "warning", Message: strings.TrimSpace(m[1])}
+			if n := onLineRe.FindStringSubmatch(line); n != nil {
+				diag.Line, _ = strconv.Atoi(n[1])
 			}
+			diags = append(diags, diag)
 		}
 	}
 	
-	return locations, nil
+	return diags
+}
+
+// checkTex verifies that a tex file compiles without errors and returns
+// the errors and warnings reported by the engine. The files it read are
+// recorded in the .fls, see readFls.
+func checkTex(engine string, texFile string, outDir string) ([]texDiagnostic, error) {
+	logger.Debugf("Running %s -draft on %s", engine, texFile)
+	cmd, finish := engineCommand(engine, shellEscapeAllow, engineArgs(texFile, outDir, "-draft", "-record")...)
+	output, err := cmd.CombinedOutput()
+	diags := parseTexDiagnostics(texFile, string(output))
+	checkWrites(texFile, outDir, string(output))
+	
+	if err = finish(err); err != nil {
+		return diags, fmt.Errorf("LaTeX compilation failed for %s: %v\n%s", texFile, err, string(output))
+	}
+	
+	return diags, nil
 }
 
 // runLatexpand flattens the tex file using latexpand
@@ -153,8 +189,10 @@ func runLatexpand(texFile string, bblFile string) error {
 	
 	args = append(args, "-o", texFile, tmpFile)
 	
-	cmd := exec.Command("latexpand", args...)
+	logger.Debugf("Running latexpand %s", strings.Join(args, " "))
+	cmd, finish := toolCommand("latexpand", args...)
 	output, err := cmd.CombinedOutput()
+	err = finish(err)
 	
 	if err != nil {
 		// Try to restore original file
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ANSI color codes
+const (
+	ColorReset      = "\033[0m"
+	ColorRed        = "\033[31m"
+	ColorGreen      = "\033[32m"
+	ColorYellow     = "\033[33m"
+	ColorBlue       = "\033[34m"
+	ColorLimeYellow = "\033[93m" // Bright yellow
+	ColorPowderBlue = "\033[96m" // Bright cyan
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Style is the role of an info message, used to pick its color
+type Style int
+
+const (
+	StylePlain    Style = iota
+	StyleStage          // Start of a pipeline stage
+	StyleProgress       // Per-file progress
+	StyleNote           // Something was embedded or moved
+	StyleAction         // Files added or archives written
+	StyleSuccess
+	StyleWarn
+	StyleError
+)
+
+// Theme maps message styles to ANSI color codes
+type Theme map[Style]string
+
+// defaultTheme matches the colors used by ziptex.sh
+var defaultTheme = Theme{
+	StyleStage:    ColorBlue,
+	StyleProgress: ColorYellow,
+	StyleNote:     ColorLimeYellow,
+	StyleAction:   ColorPowderBlue,
+	StyleSuccess:  ColorGreen,
+	StyleWarn:     ColorYellow,
+	StyleError:    ColorRed,
+}
+
+// Color modes for -color
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// Logger writes leveled messages. Info goes to stdout, warnings, errors and
+// debug output go to stderr, and everything is copied to the log file if set.
+type Logger struct {
+	Level     Level
+	ColorMode string
+	Theme     Theme
+	Stdout    io.Writer
+	Stderr    io.Writer
+	File      io.Writer
+
+	mu sync.Mutex // Keeps lines from concurrent jobs whole
+}
+
+// logger is used by every stage of the pipeline
+var logger = &Logger{
+	Level:     LevelInfo,
+	ColorMode: ColorAuto,
+	Theme:     defaultTheme,
+	Stdout:    os.Stdout,
+	Stderr:    os.Stderr,
+}
+
+// useColor decides whether to color output written to w
+func (l *Logger) useColor(w io.Writer) bool {
+	switch l.ColorMode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	// Don't use colors if NO_COLOR environment variable is set
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(w)
+}
+
+// isTerminal checks if w is a terminal
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return (fileInfo.Mode() & os.ModeCharDevice) != 0
+}
+
+// log formats a message and writes it to the console and the log file.
+// The message is formatted before colors are applied so that a % in a
+// filename can't corrupt the output.
+func (l *Logger) log(level Level, style Style, format string, args ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.File != nil {
+		for _, line := range strings.Split(msg, "\n") {
+			fmt.Fprintf(l.File, "%s %-5s %s\n", time.Now().Format("2006-01-02 15:04:05"), level, line)
+		}
+	}
+
+	if level < l.Level {
+		return
+	}
+
+	w := l.Stdout
+	if level != LevelInfo {
+		w = l.Stderr
+	}
+
+	if color := l.Theme[style]; color != "" && l.useColor(w) {
+		msg = color + msg + ColorReset
+	}
+	fmt.Fprintln(w, msg)
+}
+
+// Debugf logs details that are only shown with -v
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, StylePlain, format, args...)
+}
+
+// Infof logs a plain informational message
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, StylePlain, format, args...)
+}
+
+// Stagef announces the start of a pipeline stage
+func (l *Logger) Stagef(format string, args ...interface{}) {
+	l.log(LevelInfo, StyleStage, format, args...)
+}
+
+// Progressf reports per-file progress
+func (l *Logger) Progressf(format string, args ...interface{}) {
+	l.log(LevelInfo, StyleProgress, format, args...)
+}
+
+// Notef reports files being embedded, moved or rewritten
+func (l *Logger) Notef(format string, args ...interface{}) {
+	l.log(LevelInfo, StyleNote, format, args...)
+}
+
+// Actionf reports files being added or archives being written
+func (l *Logger) Actionf(format string, args ...interface{}) {
+	l.log(LevelInfo, StyleAction, format, args...)
+}
+
+// Successf reports a successful check
+func (l *Logger) Successf(format string, args ...interface{}) {
+	l.log(LevelInfo, StyleSuccess, format, args...)
+}
+
+// Warnf logs a warning and records it in the report
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	report.addWarning(msg)
+	l.log(LevelWarn, StyleWarn, "Warning: %s", msg)
+}
+
+// Errorf logs an error
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, StyleError, format, args...)
+}
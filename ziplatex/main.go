@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type Config struct {
@@ -16,22 +21,150 @@ type Config struct {
 	CreateZip    bool
 	CreateBz2    bool
 	Force        bool
+	Engine       string    // TeX engine: pdflatex, xelatex or lualatex
 	Debug        bool
+	DryRun       bool      // Only run discovery and print the plan
+	Fix          bool      // Rewrite bad Unicode characters in the staged files
+	FixMode      string    // "macro" or "declare"
+	FixDryRun    bool      // Show what the fixer would change without writing
+	Format       string    // Output format: "text" or "json"
+	Quiet        bool      // Only show warnings and errors
+	Verbose      bool      // Show debug messages
+	ColorMode    string    // "auto", "always" or "never"
+	LogFile      string    // Copy all messages to this file
+	FigureProfile string   // Figure conversion profile, "" for none
+	FigureDPI    int       // Overrides the profile resolution
+	FigureMax    string    // Overrides the profile size limit, WIDTHxHEIGHT
+	Figures      *figureProfile
+	Bundle       string    // "single" or "per-doc"
+	Groups       groupFlag // Tex files archived together in per-doc mode
+	NameTemplate string    // Archive name with {project}, {doc} and {date}
+	FigureBundle bool      // Also write an archive with only the graphics
+	IncludePDF   bool      // Add each document's compiled PDF to its archive
+	Build        bool      // Build the PDFs in the temp dir and check them
+	PDFA         bool      // Also check the compiled PDFs for basic PDF/A requirements
+	CustomClass  string    // Class files or directories searched for classes that aren't local
+	Jobs         int       // Tex files processed at the same time
+	CacheDir     string    // Cache of engine and latexpand runs, "" for none
+	Timeout      time.Duration // Limit for each external tool run, 0 for none
+	ShellEscape  string    // Programs \write18 may run, comma separated; "" disables shell escape
+	Generate     bool      // Let generator packages run their programs through shell escape
+	Watch        bool      // Rebuild whenever a dependency changes
+	Debounce     time.Duration // Quiet time after a change before rebuilding
+	Poll         time.Duration // Poll for changes at this interval instead of using inotify
+	Overwrite    bool      // Replace archives, figure directories and PDFs from a previous run
+	BibTrim      bool      // Ship .bib files with only the cited entries
+	JournalProfile string  // Journal abbreviation profile, "" for none
+	JournalAbbrevs string  // File adding to or overriding the journal abbreviations
+	Journals     *journalTable
 	TexFiles     []string
 	AllFiles     []string  // All command line files including .bib
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "enrich" {
+		os.Exit(enrichMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "table" {
+		os.Exit(tableMain(os.Args[2:]))
+	}
 	config := parseArgs()
 	
-	if err := run(config); err != nil {
-		log.Fatal(err)
+	closeLog, err := setupLogger(config)
+	if err != nil {
+		usageFatalf("%v", err)
+	}
+	report.update(func() {
+		report.Engine = config.Engine
+		report.TexFiles = config.TexFiles
+	})
+	
+	// Ctrl-C kills the running tools and lets run clean up; a second one
+	// ends ziplatex at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	toolCtx = ctx
+	toolTimeout = config.Timeout
+	for _, cmd := range strings.Split(config.ShellEscape, ",") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" && !contains(shellEscapeAllow, cmd) {
+			shellEscapeAllow = append(shellEscapeAllow, cmd)
+		}
+	}
+	generatorShellEscape = config.Generate
+	
+	if config.Watch {
+		err = watch(config)
+		if err != nil {
+			logger.Errorf("%v", err)
+		}
+		closeLog()
+		os.Exit(exitCode(err))
+	}
+	
+	err = run(config)
+	if err != nil && ctx.Err() != nil {
+		err = withExitCode(ExitInterrupted, err)
+	}
+	if err != nil {
+		report.fail(err)
+	}
+	
+	if config.Format == "json" {
+		report.write(os.Stdout)
+	} else if err != nil {
+		logger.Errorf("%v", err)
 	}
+	closeLog()
+	os.Exit(exitCode(err))
+}
+
+// usageFatalf reports a command line error and exits with ExitUsage
+func usageFatalf(format string, args ...interface{}) {
+	logger.Errorf(format, args...)
+	os.Exit(ExitUsage)
+}
+
+// setupLogger configures the logger from the command line options and
+// returns a function that closes the log file
+func setupLogger(config Config) (func(), error) {
+	logger.ColorMode = config.ColorMode
+	if config.Quiet {
+		logger.Level = LevelWarn
+	}
+	if config.Verbose {
+		logger.Level = LevelDebug
+	}
+	// Keep stdout clean for the JSON report
+	if config.Format == "json" {
+		logger.Stdout = os.Stderr
+	}
+	
+	if config.LogFile == "" {
+		return func() {}, nil
+	}
+	file, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file: %v", err)
+	}
+	logger.File = file
+	return func() { file.Close() }, nil
 }
 
 func parseArgs() Config {
 	var config Config
 	
+	// ziplatex watch takes the same options plus the watch settings
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "watch" {
+		config.Watch = true
+		args = args[1:]
+		flag.DurationVar(&config.Debounce, "debounce", 500*time.Millisecond, "watch: wait this long after the last change before rebuilding")
+		flag.DurationVar(&config.Poll, "poll", 0, "watch: poll for changes at this interval instead of using inotify")
+	}
+	
 	// Determine default output directory
 	defaultOutput := filepath.Join(os.Getenv("HOME"), "Desktop")
 	if _, err := os.Stat(defaultOutput); err != nil {
@@ -42,15 +175,49 @@ func parseArgs() Config {
 	flag.StringVar(&config.OutputDir, "o", defaultOutput, "Output directory")
 	flag.BoolVar(&config.CreateBz2, "j", false, "Create tar.bz2 archive (default: ZIP)")
 	flag.BoolVar(&config.Force, "f", false, "Force operation even if LaTeX compilation fails")
+	flag.StringVar(&config.Engine, "engine", EnginePdfLaTeX, "TeX engine to use: pdflatex, xelatex or lualatex")
 	flag.BoolVar(&config.Debug, "debug", false, "Preserve temp directory for debugging")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Only discover dependencies and print what would be done")
+	flag.BoolVar(&config.Fix, "fix", false, "Rewrite bad Unicode characters in the staged files")
+	flag.StringVar(&config.FixMode, "fix-mode", FixModeMacro, "How to fix bad characters: macro (inline LaTeX) or declare (\\DeclareUnicodeCharacter)")
+	jsonOutput := flag.Bool("json", false, "Print a machine-readable JSON report on stdout (same as -format=json)")
+	flag.StringVar(&config.Format, "format", "text", "Output format: text or json")
+	flag.BoolVar(&config.Quiet, "q", false, "Quiet: only show warnings and errors")
+	flag.BoolVar(&config.Verbose, "v", false, "Verbose: show debug messages")
+	flag.StringVar(&config.ColorMode, "color", ColorAuto, "Color output: auto, always or never")
+	flag.StringVar(&config.LogFile, "log", "", "Also write all messages (including debug) to this file")
+	flag.BoolVar(&config.FixDryRun, "fix-dry-run", false, "Show the changes -fix would make and exit without creating an archive")
+	flag.StringVar(&config.FigureProfile, "figures", "", "Convert figures for a journal: "+figureProfileNames())
+	flag.IntVar(&config.FigureDPI, "figure-dpi", 0, "Resolution of rasterized figures (default: from the -figures profile)")
+	flag.StringVar(&config.FigureMax, "figure-max", "", "Shrink exported figures to fit WIDTHxHEIGHT pixels")
+	flag.StringVar(&config.Bundle, "bundle", BundleSingle, "Archives to write: single (one for all files) or per-doc (one per tex file or -group)")
+	flag.Var(&config.Groups, "group", "Archive tex files together in per-doc mode: NAME=a.tex,b.tex (repeatable)")
+	flag.StringVar(&config.NameTemplate, "name", DefaultNameTemplate, "Archive name template using {project}, {doc} and {date}")
+	flag.BoolVar(&config.FigureBundle, "figure-bundle", false, "Also write a separate archive with only the graphics")
+	flag.BoolVar(&config.IncludePDF, "pdf", false, "Add each document's compiled PDF to its archive (built with -build, otherwise from the project directory)")
+	flag.BoolVar(&config.PDFA, "pdfa", false, "Also check compiled PDFs for basic PDF/A requirements (metadata, output intent, no encryption or JavaScript)")
+	flag.StringVar(&config.CustomClass, "class", os.Getenv("ZIPLATEX_CLASS"), "Class file, or directories and class files separated by "+string(os.PathListSeparator)+", to embed classes that aren't in the project (default $ZIPLATEX_CLASS)")
+	flag.BoolVar(&config.Build, "build", false, "Build the PDFs from the flattened sources, check their metadata, links and fonts, and write them next to the archives")
+	flag.IntVar(&config.Jobs, "jobs", runtime.NumCPU(), "Number of tex files processed in parallel (-j selects tar.bz2)")
+	flag.StringVar(&config.CacheDir, "cache", defaultCacheDir(), "Directory caching engine and latexpand runs between invocations")
+	noCache := flag.Bool("no-cache", false, "Run every step without the cache")
+	flag.StringVar(&config.ShellEscape, "shell-escape-allow", "", "Also let restricted shell escape run these programs, e.g. pygmentize (default: only repstopdf)")
+	flag.BoolVar(&config.Generate, "generate", false, "Let minted, svg and gnuplottex run pygmentize, inkscape and gnuplot through restricted shell escape to make the files they ship")
+	flag.BoolVar(&config.BibTrim, "bib-trim", false, "Ship the .bib files with only the entries the documents cite")
+	flag.StringVar(&config.JournalProfile, "journals", "", "Abbreviate journal names in the .bib and .bbl files for a bibliography style: "+journalProfileNames())
+	flag.StringVar(&config.JournalAbbrevs, "journal-abbrevs", "", "File of \"Full Name = Abbrev.\" lines adding to or overriding the -journals table")
+	flag.DurationVar(&config.Timeout, "timeout", DefaultToolTimeout, "Stop an engine or other tool run that takes longer than this (0 for no limit)")
 	
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [-f] [-j] [--debug] [-o OUTDIR] file.tex [file2.tex ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-f] [-j] [-q|-v] [-color MODE] [-log FILE] [--debug] [--dry-run] [-engine ENGINE] [-fix [-fix-mode MODE] [-fix-dry-run]] [-figures PROFILE [-figure-dpi N] [-figure-max WxH]] [-bundle MODE] [-group NAME=a.tex,...] [-name TEMPLATE] [-figure-bundle] [-build] [-pdf] [-pdfa] [-class PATH] [-jobs N] [-cache DIR|-no-cache] [-timeout DURATION] [-shell-escape-allow CMDS] [-generate] [-bib-trim] [-journals PROFILE [-journal-abbrevs FILE]] [-o OUTDIR] file.tex [file2.tex ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch [-debounce DURATION] [-poll INTERVAL] [options] file.tex [file2.tex ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s enrich -store FILE [-store FILE ...] [-w] refs.bib [more.bib ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s table [-dir DIR|-o FILE] [-caption TEXT] [-label LABEL] [-siunitx] data.csv [more.json ...]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Creates ZIP archive by default. Use -j for tar.bz2 instead.\n")
 		flag.PrintDefaults()
 	}
 	
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 	
 	// Set archive type: default to ZIP unless -j is specified
 	if config.CreateBz2 {
@@ -61,7 +228,32 @@ func parseArgs() Config {
 	
 	if flag.NArg() == 0 {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(ExitUsage)
+	}
+	
+	if *jsonOutput {
+		config.Format = "json"
+	}
+	if config.ColorMode != ColorAuto && config.ColorMode != ColorAlways && config.ColorMode != ColorNever {
+		usageFatalf("Unknown -color %q (use auto, always or never)", config.ColorMode)
+	}
+	if config.Quiet && config.Verbose {
+		usageFatalf("-q and -v cannot be used together")
+	}
+	if config.Format != "text" && config.Format != "json" {
+		usageFatalf("Unknown -format %q (use text or json)", config.Format)
+	}
+	if config.Jobs < 1 {
+		usageFatalf("-jobs must be at least 1")
+	}
+	if config.Timeout < 0 {
+		usageFatalf("-timeout cannot be negative")
+	}
+	if *noCache {
+		config.CacheDir = ""
+	}
+	if config.Watch && (config.DryRun || config.FixDryRun || config.Debug || config.Format == "json") {
+		usageFatalf("watch cannot be used with --dry-run, -fix-dry-run, --debug or -json")
 	}
 	
 	// Get all files from remaining arguments
@@ -77,18 +269,124 @@ func parseArgs() Config {
 	
 	// Set default values
 	config.TmpDir = "LaTeX"
-	// CustomClass will be empty by default - catClass will look for it locally
+	// CustomClass will be empty by default - catClass will look for it locally.
+	// Paths are made absolute since catClass runs in the temp directory.
+	if config.CustomClass != "" {
+		entries := []string{}
+		for _, entry := range filepath.SplitList(config.CustomClass) {
+			if entry == "" {
+				continue
+			}
+			abs, err := filepath.Abs(entry)
+			if err != nil {
+				usageFatalf("Error resolving -class %s: %v", entry, err)
+			}
+			if _, err := os.Stat(abs); err != nil {
+				logger.Warnf("-class entry %s does not exist; ignoring it", entry)
+				continue
+			}
+			entries = append(entries, abs)
+		}
+		config.CustomClass = strings.Join(entries, string(os.PathListSeparator))
+	}
 	
 	// Convert output dir to absolute path
 	absOut, err := filepath.Abs(config.OutputDir)
 	if err != nil {
-		log.Fatalf("Error resolving output directory: %v", err)
+		usageFatalf("Error resolving output directory: %v", err)
 	}
 	config.OutputDir = absOut
 	
+	if !validEngine(config.Engine) {
+		usageFatalf("Unsupported engine %q (use %s, %s or %s)", config.Engine, EnginePdfLaTeX, EngineXeLaTeX, EngineLuaLaTeX)
+	}
+	for _, cmd := range strings.Split(config.ShellEscape, ",") {
+		if isTexEngine(strings.TrimSpace(cmd)) {
+			usageFatalf("-shell-escape-allow can't allow %s: a TeX run started from shell escape can turn shell escape fully on", strings.TrimSpace(cmd))
+		}
+	}
+	
+	// -fix-dry-run implies -fix
+	if config.FixDryRun {
+		config.Fix = true
+	}
+	if config.FixMode != FixModeMacro && config.FixMode != FixModeDeclare {
+		usageFatalf("Unknown -fix-mode %q (use %s or %s)", config.FixMode, FixModeMacro, FixModeDeclare)
+	}
+	
+	// Resolve the figure profile and apply the overrides
+	if config.FigureProfile != "" {
+		preset, ok := figureProfiles[config.FigureProfile]
+		if !ok {
+			usageFatalf("Unknown -figures profile %q (use %s)", config.FigureProfile, figureProfileNames())
+		}
+		profile := preset
+		if config.FigureDPI < 0 {
+			usageFatalf("Invalid -figure-dpi %d", config.FigureDPI)
+		}
+		if config.FigureDPI > 0 {
+			profile.DPI = config.FigureDPI
+		}
+		if config.FigureMax != "" {
+			w, h, err := parseMaxSize(config.FigureMax)
+			if err != nil {
+				usageFatalf("Invalid -figure-max: %v", err)
+			}
+			profile.MaxWidth, profile.MaxHeight = w, h
+		}
+		config.Figures = &profile
+	} else if config.FigureDPI != 0 || config.FigureMax != "" {
+		usageFatalf("-figure-dpi and -figure-max need -figures")
+	}
+	
+	// Load the journal abbreviations of the profile
+	if config.JournalProfile != "" {
+		profile, ok := journalProfiles[config.JournalProfile]
+		if !ok {
+			usageFatalf("Unknown -journals profile %q (use %s)", config.JournalProfile, journalProfileNames())
+		}
+		table, err := newJournalTable(profile, config.JournalAbbrevs)
+		if err != nil {
+			usageFatalf("%v", err)
+		}
+		config.Journals = table
+	} else if config.JournalAbbrevs != "" {
+		usageFatalf("-journal-abbrevs needs -journals")
+	}
+	
+	// -group only makes sense with one archive per document
+	if len(config.Groups) > 0 {
+		config.Bundle = BundlePerDoc
+	}
+	if config.Bundle != BundleSingle && config.Bundle != BundlePerDoc {
+		usageFatalf("Unknown -bundle %q (use %s or %s)", config.Bundle, BundleSingle, BundlePerDoc)
+	}
+	grouped := make(map[string]string)
+	for _, group := range config.Groups {
+		for _, f := range group.TexFiles {
+			found := false
+			for _, texFile := range config.TexFiles {
+				found = found || filepath.Base(texFile) == filepath.Base(f)
+			}
+			if !found {
+				usageFatalf("-group %s: %s is not one of the tex files on the command line", group.Name, f)
+			}
+			if other, ok := grouped[filepath.Base(f)]; ok {
+				usageFatalf("%s is in both -group %s and -group %s", f, other, group.Name)
+			}
+			grouped[filepath.Base(f)] = group.Name
+		}
+	}
+	if strings.TrimSpace(config.NameTemplate) == "" || strings.ContainsAny(config.NameTemplate, "/\\") {
+		usageFatalf("Invalid -name %q (use a file name such as {project}-{doc})", config.NameTemplate)
+	}
+	if err := checkBundleDocs(config, config.TexFiles); err != nil {
+		usageFatalf("%v", err)
+	}
+	
 	// Check if output directory exists
 	if info, err := os.Stat(config.OutputDir); err != nil || !info.IsDir() {
-		log.Fatalf("Output directory does not exist: %s", config.OutputDir)
+		usageFatalf("Output directory does not exist: %s", config.OutputDir)
 	}
 	
 	return config
@@ -96,9 +394,29 @@ func parseArgs() Config {
 
 func run(config Config) error {
 	// Check required tools are available
-	printBlue("Checking required tools...\n")
-	if err := checkRequirements(config.CreateBz2); err != nil {
-		return err
+	report.stage("tools")
+	logger.Stagef("Checking required tools...")
+	if err := checkRequirements(config.Engine, config.CreateBz2); err != nil {
+		return withExitCode(ExitMissingTool, err)
+	}
+	if config.Figures != nil {
+		for _, tool := range figureTools(config.Figures) {
+			if err := checkTool(tool, figureToolVersionArgs[tool]); err != nil {
+				return withExitCode(ExitMissingTool, fmt.Errorf("%s not found or not working: %v\nIt is needed for -figures %s", tool, err, config.Figures.Name))
+			}
+		}
+	}
+	
+	// In dry-run mode nothing is copied, compiled or archived
+	if config.DryRun {
+		report.stage("plan")
+		plan, err := buildPlan(config)
+		if err != nil {
+			return err
+		}
+		report.update(func() { report.Plan = plan })
+		printPlan(plan)
+		return nil
 	}
 	
 	// Check if temp directory already exists
@@ -117,60 +435,147 @@ func run(config Config) error {
 	}
 	
 	// Process each tex file
+	report.stage("discovery")
 	validTexFiles := []string{}
 	allDeps := []string{}
+	usedFiles := make(map[string]bool)
+	docDeps := make(map[string][]string) // Files copied for each tex file
+	cmdLineFiles := []string{}           // Non-tex files from the command line
+	personalCopied := make(map[string]string) // Personal files and their name in the temp dir
+	docGenerators := make(map[string][]string) // Generator packages used by each tex file
+	cited := make(map[string]bool)             // Keys cited by the documents, "*" for all
+	biber := false                             // Some document reads the .bib files with biber
+	roots := findTexRoots(config.Engine)
+	
+	// The engine writes its .aux, .log and .fls files to a scratch directory
+	// per document, so documents can be processed in parallel
+	scratch, err := newScratchDirs()
+	if err != nil {
+		return err
+	}
+	if config.Debug {
+		logger.Debugf("Scratch directory: %s", scratch.root)
+	} else {
+		defer scratch.remove()
+	}
+	
+	// Runs whose inputs haven't changed since a previous invocation are
+	// taken from the cache
+	var cache *engineCache
+	if config.CacheDir != "" {
+		if cache, err = newEngineCache(config.CacheDir, roots, config.Engine, "latexpand"); err != nil {
+			logger.Warnf("%v; running without a cache", err)
+		}
+	}
 	
+	texFiles := []string{}
 	for _, texFile := range config.TexFiles {
 		// Skip directories
 		if info, err := os.Stat(texFile); err == nil && info.IsDir() {
-			fmt.Printf("Skipping directory %s\n", texFile)
+			logger.Infof("Skipping directory %s", texFile)
 			continue
 		}
 		
 		// Check if it's a tex file
 		if !strings.HasSuffix(texFile, ".tex") {
-			fmt.Printf("Skipping non-tex file %s\n", texFile)
+			logger.Infof("Skipping non-tex file %s", texFile)
 			continue
 		}
-		
-		printYellow("Processing %s\n", texFile)
-		
-		// Check for bad Unicode characters
-		logFile := strings.TrimSuffix(texFile, ".tex") + ".log"
-		if _, err := os.Stat(logFile); err == nil {
-			badChars, err := findBadChars(logFile)
-			if err == nil && len(badChars) > 0 {
-				// Only report if characters are actually found in source files
-				foundInSource := false
-				reportedChars := []string{}
-				for _, char := range badChars {
-					locations, _ := findBadCharLocations(char, ".")
-					if len(locations) > 0 {
-						foundInSource = true
-						reportedChars = append(reportedChars, char)
-					}
-				}
-
-				if foundInSource {
-					fmt.Printf("Found problematic characters in source files:\n")
-					for _, char := range reportedChars {
-						fmt.Printf("  Character '%s':\n", char)
-						locations, _ := findBadCharLocations(char, ".")
-						for _, loc := range locations {
-							fmt.Printf("    %s\n", loc)
-						}
-					}
-					if !config.Force {
-						return fmt.Errorf("cannot continue processing %s due to bad characters in source files", texFile)
-					}
-				}
+		texFiles = append(texFiles, texFile)
+	}
+	
+	// Dependencies, bad characters and graphics are found in parallel; the
+	// results are reported and copied in command-line order
+	type discovery struct {
+		deps     []string
+		err      error
+		found    []badChar
+		scanErr  error
+		graphics []string
+		gfxDiags []texDiagnostic
+		personal []string
+		generators []string
+		cited    []string
+	}
+	results := make([]discovery, len(texFiles))
+	
+	err = forEachJob(len(texFiles), config.Jobs, func(i int) {
+		texFile := texFiles[i]
+		r := &results[i]
+		key := cache.key("discovery", texFile, config.Engine, "-draft", "-record")
+		if entry, ok := cache.get(key); ok {
+			logger.Debugf("Using cached dependencies of %s", texFile)
+			r.deps, r.personal, r.generators, r.cited = entry.Deps, entry.Personal, entry.Generators, entry.Cited
+		} else {
+			outDir, err := scratch.dir("discovery", texFile)
+			if err != nil {
+				r.err = err
+				return
+			}
+			if r.deps, r.generators, r.err = discoverDeps(config.Engine, texFile, outDir); r.err != nil {
+				return
+			}
+			r.personal = personalDeps(texFile, outDir, roots)
+			if r.cited, r.err = citedKeys(texFile, outDir); r.err != nil {
+				return
 			}
+			cache.put(key, &cacheEntry{Inputs: cache.inputs(docInputs(texFile, r.deps, r.personal)), Deps: r.deps, Personal: r.personal, Generators: r.generators, Cited: r.cited})
 		}
+		r.found, r.scanErr = scanBadChars(scanFilesFor(r.deps), config.Engine)
+		r.graphics, r.gfxDiags = checkGraphics(texFile, config.Engine)
+	}, func(i int) error {
+		texFile := texFiles[i]
+		r := results[i]
+		logger.Progressf("Processing %s", texFile)
+		report.addInputs(texFile)
 		
 		// Find dependencies
-		deps, err := findDeps(texFile)
+		deps, err := r.deps, r.err
 		if err != nil {
-			return fmt.Errorf("error finding dependencies for %s: %v", texFile, err)
+			// Bad characters are a common cause of failure, so scan the
+			// tex file itself to give the user a hint
+			if found, scanErr := scanBadChars(scanFilesFor([]string{texFile}), config.Engine); scanErr == nil && len(found) > 0 {
+				printBadChars(found)
+				report.addBadChars(found)
+			}
+			return withExitCode(ExitDependencies, fmt.Errorf("error finding dependencies for %s: %v", texFile, err))
+		}
+		
+		// Check every dependency for characters the engine can't handle
+		found, err := r.found, r.scanErr
+		if err != nil {
+			logger.Warnf("could not scan for bad characters: %v", err)
+		} else if len(found) > 0 {
+			printBadChars(found)
+			report.addBadChars(found)
+			report.setStageStatus("warning")
+			if config.Fix {
+				logger.Notef("These will be rewritten in the staged copies")
+			} else if !config.Force {
+				return withExitCode(ExitBadChars, fmt.Errorf("cannot continue processing %s due to bad characters in source files", texFile))
+			}
+		}
+		
+		// Check that every graphic exists and can be included by the engine
+		usedGraphics, gfxDiags := r.graphics, r.gfxDiags
+		report.addDiagnostics(gfxDiags...)
+		for _, diag := range gfxDiags {
+			logger.Errorf("%s:%d: %s", diag.File, diag.Line, diag.Message)
+		}
+		if len(gfxDiags) > 0 && !config.Force {
+			return withExitCode(ExitDependencies, fmt.Errorf("cannot continue processing %s due to missing or unsupported graphics", texFile))
+		}
+		for _, f := range usedGraphics {
+			usedFiles[f] = true
+		}
+		for _, dep := range deps {
+			usedFiles[filepath.Clean(dep)] = true
+		}
+		report.addInputs(deps...)
+		report.addInputs(r.personal...)
+		if names := usableGenerators(texFile, r.generators); len(names) > 0 {
+			logger.Notef("%s uses %s; generated files will be shipped", texFile, strings.Join(names, ", "))
+			docGenerators[filepath.Base(texFile)] = names
 		}
 		
 		// Copy tex file and dependencies to temp directory
@@ -184,29 +589,122 @@ func run(config Config) error {
 			}
 			
 			if err := copyFile(src, dst); err != nil {
-				fmt.Printf("Warning: could not copy %s: %v\n", src, err)
+				logger.Warnf("could not copy %s: %v", src, err)
 			} else {
 				allDeps = append(allDeps, dep)
+				docDeps[filepath.Base(texFile)] = append(docDeps[filepath.Base(texFile)], dep)
+			}
+		}
+		
+		// Files from a personal texmf tree or TEXINPUTS are missing on the
+		// journal's side, so they are bundled next to the tex files
+		for _, dep := range r.personal {
+			name, ok := personalCopied[dep]
+			if !ok {
+				name = filepath.Base(dep)
+				if fileExists(filepath.Join(config.TmpDir, name)) {
+					logger.Warnf("%s comes from outside the TeX distribution but %s is already in the project; not bundling it", dep, name)
+					continue
+				}
+				if err := copyFile(dep, filepath.Join(config.TmpDir, name)); err != nil {
+					logger.Warnf("could not copy %s: %v", dep, err)
+					continue
+				}
+				logger.Warnf("%s comes from outside the TeX distribution; bundling it as %s", dep, name)
+				personalCopied[dep] = name
+				report.update(func() { report.PersonalFiles = append(report.PersonalFiles, FileMove{From: dep, To: name}) })
+				allDeps = append(allDeps, name)
+			}
+			docDeps[filepath.Base(texFile)] = append(docDeps[filepath.Base(texFile)], name)
+		}
+		
+		// Local classes, packages and styles the recorder misses (bibtex reads
+		// the .bst) are copied so that catClass can embed them
+		content, _ := expandIncludes(texFile)
+		for _, key := range r.cited {
+			cited[key] = true
+		}
+		biber = biber || usesBiber(content)
+		for _, f := range localEmbeds(content, embedExts) {
+			report.addInputs(f)
+			if fileExists(filepath.Join(config.TmpDir, f)) {
+				continue
+			}
+			if err := copyFile(f, filepath.Join(config.TmpDir, f)); err != nil {
+				logger.Warnf("could not copy %s: %v", f, err)
+			} else {
+				docDeps[filepath.Base(texFile)] = append(docDeps[filepath.Base(texFile)], f)
 			}
 		}
 		
 		validTexFiles = append(validTexFiles, filepath.Base(texFile))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	
 	if len(validTexFiles) == 0 {
 		return fmt.Errorf("no valid tex files to process")
 	}
 	
+	// Let the authors know about figures nothing uses
+	reportUnusedGraphics(findUnusedGraphics(".", config.TmpDir, usedFiles))
+	
 	// Copy all non-tex command-line files to temp directory (like .bib files)
+	bibFiles := []string{}
 	for _, file := range config.AllFiles {
 		if !strings.HasSuffix(file, ".tex") {
 			if info, err := os.Stat(file); err == nil && !info.IsDir() {
-				printPowderBlue("Adding %s\n", file)
+				logger.Actionf("Adding %s", file)
 				if err := copyFile(file, filepath.Join(config.TmpDir, filepath.Base(file))); err != nil {
-					fmt.Printf("Warning: could not copy %s: %v\n", file, err)
+					logger.Warnf("could not copy %s: %v", file, err)
 				} else {
 					allDeps = append(allDeps, filepath.Base(file))
+					cmdLineFiles = append(cmdLineFiles, filepath.Base(file))
+					if strings.EqualFold(filepath.Ext(file), ".bib") {
+						bibFiles = append(bibFiles, file)
+					}
+				}
+			}
+		}
+	}
+	
+	// Check the .bib files before the journal's bibtex or biber reads them
+	if len(bibFiles) > 0 || config.Journals != nil {
+		report.stage("bibliography")
+		logger.Stagef("Checking bibliography files...")
+		errorCount := 0
+		for _, file := range bibFiles {
+			n, err := checkBibFile(file, filepath.Join(config.TmpDir, filepath.Base(file)), cited, biber, config.BibTrim, config.Journals)
+			if err != nil {
+				return err
+			}
+			errorCount += n
+		}
+		// latexpand puts the .bbl into the flattened tex, so its journal
+		// names are what the journal gets
+		if config.Journals != nil {
+			normalized := make(map[string]bool)
+			for _, dep := range allDeps {
+				if filepath.Ext(dep) != ".bbl" || normalized[dep] {
+					continue
 				}
+				normalized[dep] = true
+				n, diags, err := config.Journals.normalizeBbl(filepath.Join(config.TmpDir, dep))
+				if err != nil {
+					return err
+				}
+				printBibDiagnostics(diags)
+				if n > 0 {
+					logger.Notef("%s: %d journal name(s) abbreviated for %s", dep, n, config.Journals.Profile)
+				}
+			}
+		}
+		if errorCount > 0 {
+			report.setStageStatus("failed")
+			if !config.Force {
+				return withExitCode(ExitBibliography, fmt.Errorf("cannot continue: %d error(s) in the bibliography files", errorCount))
 			}
 		}
 	}
@@ -218,22 +716,73 @@ func run(config Config) error {
 	}
 	defer os.Chdir(originalDir)
 	
+	// Rewrite bad Unicode characters in the staged copies
+	if config.Fix {
+		report.stage("fix")
+		logger.Stagef("Fixing bad Unicode characters...")
+		stagedFiles, err := stagedTextFiles(".", ".tex", ".bib", ".bbl")
+		if err != nil {
+			return fmt.Errorf("error listing staged files: %v", err)
+		}
+		// Classes and packages may select the font encoding
+		encFiles, _ := stagedTextFiles(".", ".cls", ".sty")
+		fixes, err := fixBadChars(stagedFiles, encFiles, validTexFiles, config.Engine, config.FixMode, config.FixDryRun)
+		if err != nil {
+			return err
+		}
+		printFixReport(fixes)
+		if config.FixDryRun {
+			logger.Successf("Dry run: %d line(s) would change; no files were modified", len(fixes.Changes))
+			return nil
+		}
+		if len(fixes.Unmapped) > 0 && !config.Force {
+			return withExitCode(ExitBadChars, fmt.Errorf("cannot continue: %d character(s) could not be mapped to LaTeX", len(fixes.Unmapped)))
+		}
+	}
+	
 	// Flatten tex files
-	printBlue("Flattening LaTeX files...\n")
-	for _, texFile := range validTexFiles {
+	report.stage("latexpand")
+	logger.Stagef("Flattening LaTeX files...")
+	expandErrs := make([]error, len(validTexFiles))
+	forEachJob(len(validTexFiles), config.Jobs, func(i int) {
+		texFile := validTexFiles[i]
 		bblFile := strings.TrimSuffix(texFile, ".tex") + ".bbl"
-		if err := runLatexpand(texFile, bblFile); err != nil {
-			fmt.Printf("Warning: latexpand failed for %s: %v\n", texFile, err)
+		key := cache.key("latexpand", texFile, "latexpand")
+		if entry, ok := cache.get(key); ok {
+			logger.Debugf("Using cached flattened %s", texFile)
+			expandErrs[i] = ioutil.WriteFile(texFile, []byte(entry.Content), 0644)
+			return
+		}
+		// latexpand reads the tex files, the local packages and the .bbl
+		inputs := []string{bblFile}
+		for _, dep := range docDeps[texFile] {
+			if !imageExts[strings.ToLower(filepath.Ext(dep))] {
+				inputs = append(inputs, dep)
+			}
+		}
+		hashes := cache.inputs(inputs)
+		expandErrs[i] = runLatexpand(texFile, bblFile)
+		if expandErrs[i] == nil && cache != nil {
+			if content, err := ioutil.ReadFile(texFile); err == nil {
+				cache.put(key, &cacheEntry{Inputs: hashes, Content: string(content)})
+			}
+		}
+	}, func(i int) error {
+		texFile := validTexFiles[i]
+		if expandErrs[i] != nil {
+			logger.Warnf("latexpand failed for %s: %v", texFile, expandErrs[i])
 		}
 		// DEBUG: Copy file after latexpand for comparison
 		if config.Debug {
 			copyFile(texFile, texFile+".after_latexpand")
 		}
-	}
+		return nil
+	})
 	
 	// Concatenate aux files
+	report.stage("aux")
 	if err := catAux(validTexFiles); err != nil {
-		fmt.Printf("Warning: error concatenating aux files: %v\n", err)
+		logger.Warnf("error concatenating aux files: %v", err)
 	}
 	// DEBUG: Copy file after catAux for comparison
 	if config.Debug {
@@ -243,8 +792,9 @@ func run(config Config) error {
 	}
 	
 	// Concatenate class files
-	if err := catClass(validTexFiles, ""); err != nil {
-		fmt.Printf("Warning: error concatenating class files: %v\n", err)
+	report.stage("class")
+	if err := catClass(validTexFiles, config.CustomClass); err != nil {
+		logger.Warnf("error concatenating class files: %v", err)
 	}
 	// DEBUG: Copy file after catClass for comparison
 	if config.Debug {
@@ -254,38 +804,192 @@ func run(config Config) error {
 	}
 	
 	// Flatten directory structure
-	if err := flattenDirs(validTexFiles); err != nil {
-		fmt.Printf("Warning: error flattening directories: %v\n", err)
+	report.stage("flatten")
+	moves, err := flattenDirs(validTexFiles, config.Engine, usedFiles)
+	if err != nil {
+		logger.Warnf("error flattening directories: %v", err)
+	}
+	report.update(func() { report.Moves = append(report.Moves, moves...) })
+	
+	// Make the files minted, tikzexternalize, svg and gnuplottex need once,
+	// since the journal compiles without shell escape
+	if len(docGenerators) > 0 {
+		report.stage("generate")
+		logger.Stagef("Generating files that need shell escape...")
+		for _, texFile := range validTexFiles {
+			names := docGenerators[texFile]
+			if len(names) == 0 {
+				continue
+			}
+			artifacts, err := generateFiles(config.Engine, texFile, names)
+			if err != nil {
+				if !config.Force {
+					return withExitCode(ExitCompile, fmt.Errorf("error generating files for %s: %v", texFile, err))
+				}
+				logger.Errorf("Error generating files for %s: %v", texFile, err)
+				report.setStageStatus("failed")
+				continue
+			}
+			report.update(func() { report.Generated = append(report.Generated, GeneratedReport{File: texFile, Packages: names, Artifacts: artifacts}) })
+			logger.Successf("%s: %d file(s) generated by %s; the document now uses them without shell escape", texFile, len(artifacts), strings.Join(names, ", "))
+		}
+	}
+	
+	// Convert and export figures for the journal
+	if config.Figures != nil {
+		report.stage("figures")
+		logger.Stagef("Converting figures (%s)...", config.Figures.Name)
+		exportDir := filepath.Join(config.OutputDir, bundleName(config.NameTemplate, filepath.Base(originalDir), FigureBundleDoc))
+		if config.Figures.Export != "" && config.Overwrite {
+			os.RemoveAll(exportDir)
+		}
+		if config.Figures.Export != "" {
+			if _, err := os.Stat(exportDir); err == nil {
+				return withExitCode(ExitArchive, fmt.Errorf("figure directory already exists: %s\nPlease remove it or choose a different output directory", exportDir))
+			}
+		}
+		conversions, err := processFigures(validTexFiles, config.Figures, config.Engine, exportDir)
+		report.update(func() { report.FigureConversions = append(report.FigureConversions, conversions...) })
+		if err != nil {
+			return err
+		}
 	}
 	
 	// Check if tex files compile
-	printBlue("Checking LaTeX compilation...\n")
+	report.stage("compile")
+	logger.Stagef("Checking LaTeX compilation...")
 	allOk := true
-	for _, texFile := range validTexFiles {
-		if err := checkTex(texFile); err != nil {
-			printRed("Error: %v\n", err)
+	compileDiags := make([][]texDiagnostic, len(validTexFiles))
+	compileErrs := make([]error, len(validTexFiles))
+	forEachJob(len(validTexFiles), config.Jobs, func(i int) {
+		texFile := validTexFiles[i]
+		key := cache.key("compile", texFile, config.Engine, "-draft", "-record")
+		if entry, ok := cache.get(key); ok {
+			logger.Debugf("Using cached compilation check of %s", texFile)
+			compileDiags[i] = entry.Diagnostics
+			if entry.Error != "" {
+				compileErrs[i] = errors.New(entry.Error)
+			}
+			return
+		}
+		outDir, err := scratch.dir("compile", texFile)
+		if err != nil {
+			compileErrs[i] = err
+			return
+		}
+		compileDiags[i], compileErrs[i] = checkTex(config.Engine, texFile, outDir)
+		if deps, err := readFls(texFile, outDir); err == nil && cache != nil {
+			entry := &cacheEntry{Inputs: cache.inputs(docInputs(texFile, deps, nil)), Diagnostics: compileDiags[i]}
+			if compileErrs[i] != nil {
+				entry.Error = compileErrs[i].Error()
+			}
+			cache.put(key, entry)
+		}
+	}, func(i int) error {
+		report.addDiagnostics(compileDiags[i]...)
+		if err := compileErrs[i]; err != nil {
+			logger.Errorf("Error: %v", err)
+			report.setStageStatus("failed")
 			allOk = false
 		} else {
-			printGreen("%s compiles successfully\n", texFile)
+			logger.Successf("%s compiles successfully", validTexFiles[i])
 		}
-	}
+		return nil
+	})
 	
 	if !allOk && !config.Force {
-		return fmt.Errorf("LaTeX compilation failed")
+		return withExitCode(ExitCompile, fmt.Errorf("LaTeX compilation failed"))
+	}
+	
+	// Build the final PDFs from the flattened sources
+	if config.Build {
+		report.stage("build")
+		logger.Stagef("Building PDFs...")
+		for _, texFile := range validTexFiles {
+			output, err := buildPDF(config.Engine, texFile)
+			if err != nil {
+				report.addDiagnostics(parseTexDiagnostics(texFile, output)...)
+				if !config.Force {
+					return withExitCode(ExitCompile, err)
+				}
+				logger.Errorf("Error: %v", err)
+				report.setStageStatus("failed")
+				continue
+			}
+			pdfFile := strings.TrimSuffix(texFile, ".tex") + ".pdf"
+			result := checkPDF(pdfFile, texFile, output)
+			report.update(func() { report.PDFs = append(report.PDFs, result) })
+			for _, problem := range result.Problems {
+				logger.Warnf("%s: %s", pdfFile, problem)
+			}
+			if len(result.Problems) == 0 {
+				logger.Successf("%s built and checked", pdfFile)
+			}
+		}
 	}
 	
 	// Get final list of files to archive (AFTER all processing)
 	// This matches the bash script behavior: run findDeps after flattening
-	finalDeps := []string{}
-	for _, texFile := range validTexFiles {
-		deps, err := findDeps(texFile)
-		if err == nil {
-			finalDeps = append(finalDeps, deps...)
+	report.stage("collect")
+	finalDeps := make(map[string][]string)
+	collected := make([][]string, len(validTexFiles))
+	forEachJob(len(validTexFiles), config.Jobs, func(i int) {
+		texFile := validTexFiles[i]
+		key := cache.key("collect", texFile, config.Engine, "-draft", "-record")
+		if entry, ok := cache.get(key); ok {
+			logger.Debugf("Using cached dependencies of %s", texFile)
+			collected[i] = entry.Deps
+			return
 		}
-	}
+		outDir, err := scratch.dir("collect", texFile)
+		if err != nil {
+			return
+		}
+		if deps, err := findDeps(config.Engine, texFile, outDir, shellEscapeAllow); err == nil {
+			collected[i] = deps
+			cache.put(key, &cacheEntry{Inputs: cache.inputs(docInputs(texFile, deps, nil)), Deps: deps})
+		}
+	}, func(i int) error {
+		if collected[i] != nil {
+			finalDeps[validTexFiles[i]] = collected[i]
+		}
+		return nil
+	})
 	
-	// Add all the files we copied from command line (including .bib files)
-	finalDeps = append(finalDeps, allDeps...)
+	// Add each document's PDF: the one just built, or the compiled one from
+	// the project directory
+	if config.IncludePDF && config.Build {
+		for _, texFile := range validTexFiles {
+			pdfFile := strings.TrimSuffix(texFile, ".tex") + ".pdf"
+			if fileExists(pdfFile) {
+				logger.Actionf("Adding %s", pdfFile)
+				finalDeps[texFile] = append(finalDeps[texFile], pdfFile)
+			}
+		}
+	} else if config.IncludePDF {
+		for _, texFile := range config.TexFiles {
+			name := filepath.Base(texFile)
+			if finalDeps[name] == nil && docDeps[name] == nil {
+				continue
+			}
+			pdfFile := strings.TrimSuffix(texFile, ".tex") + ".pdf"
+			pdfStat, err := os.Stat(filepath.Join(originalDir, pdfFile))
+			if err != nil {
+				logger.Warnf("no compiled PDF %s for %s", pdfFile, texFile)
+				continue
+			}
+			if texInfo, err := os.Stat(filepath.Join(originalDir, texFile)); err == nil && texInfo.ModTime().After(pdfStat.ModTime()) {
+				logger.Warnf("%s is older than %s; recompile it to ship an up to date PDF", pdfFile, texFile)
+			}
+			dst := strings.TrimSuffix(name, ".tex") + ".pdf"
+			if err := copyFile(filepath.Join(originalDir, pdfFile), dst); err != nil {
+				logger.Warnf("could not copy %s: %v", pdfFile, err)
+				continue
+			}
+			logger.Actionf("Adding %s", pdfFile)
+			finalDeps[name] = append(finalDeps[name], dst)
+		}
+	}
 	
 	// Read .todel file to see what was concatenated and should be excluded
 	toDelFiles := make(map[string]bool)
@@ -296,7 +1000,7 @@ func run(config Config) error {
 			if line != "" {
 				toDelFiles[line] = true
 				// Remove the actual files as bash script does
-				printBlue("Cleaning up %s\n", line)
+				logger.Stagef("Cleaning up %s", line)
 				os.Remove(line)
 			}
 		}
@@ -305,13 +1009,56 @@ func run(config Config) error {
 	// Remove duplicates and filter out files that were concatenated or are .out files
 	uniqueDeps := make(map[string]bool)
 	filesToArchive := []string{}
-	for _, dep := range finalDeps {
-		if !uniqueDeps[dep] && !strings.HasSuffix(dep, ".out") && !toDelFiles[dep] {
-			uniqueDeps[dep] = true
-			filesToArchive = append(filesToArchive, dep)
+	docFiles := make(map[string][]string)
+	for _, texFile := range validTexFiles {
+		for _, dep := range append(finalDeps[texFile], docDeps[texFile]...) {
+			if strings.HasSuffix(dep, ".out") || toDelFiles[dep] {
+				continue
+			}
+			docFiles[texFile] = append(docFiles[texFile], dep)
+			if !uniqueDeps[dep] {
+				uniqueDeps[dep] = true
+				filesToArchive = append(filesToArchive, dep)
+			}
+		}
+	}
+	for _, f := range cmdLineFiles {
+		if !uniqueDeps[f] {
+			uniqueDeps[f] = true
+			filesToArchive = append(filesToArchive, f)
 		}
 	}
 	
+	// Check the fonts of every PDF that is shipped or was built
+	report.stage("fonts")
+	logger.Stagef("Checking PDF fonts...")
+	pdfFiles := []string{}
+	for _, f := range filesToArchive {
+		// Files moved by flattenDirs are listed under their old path too
+		if strings.EqualFold(filepath.Ext(f), ".pdf") && fileExists(f) {
+			pdfFiles = append(pdfFiles, f)
+		}
+	}
+	if config.Build && !config.IncludePDF {
+		for _, texFile := range validTexFiles {
+			if pdfFile := strings.TrimSuffix(texFile, ".tex") + ".pdf"; fileExists(pdfFile) {
+				pdfFiles = append(pdfFiles, pdfFile)
+			}
+		}
+	}
+	for _, pdfFile := range pdfFiles {
+		result, err := inspectPDF(pdfFile, config.PDFA && isCompiledPDF(pdfFile, validTexFiles))
+		if err != nil {
+			logger.Warnf("could not inspect %s: %v", pdfFile, err)
+			continue
+		}
+		report.update(func() { report.Fonts = append(report.Fonts, result) })
+		for _, problem := range result.Problems {
+			logger.Warnf("%s: %s", pdfFile, problem)
+		}
+		logger.Debugf("%s: %d fonts", pdfFile, len(result.Fonts))
+	}
+	
 	// Clean up temporary files
 	os.Remove(".todel")
 	// Remove .out and .bak files
@@ -327,66 +1074,36 @@ func run(config Config) error {
 	// Change back to original directory for archive creation
 	os.Chdir(originalDir)
 	
-	// Check if output archives already exist before creating them
-	basename := filepath.Base(originalDir)
-	
-	if config.CreateZip {
-		zipPath := filepath.Join(config.OutputDir, basename+".zip")
-		if _, err := os.Stat(zipPath); err == nil {
-			// Clean up temp directory before aborting
-			if !config.Debug {
-				os.RemoveAll(config.TmpDir)
-			}
-			return fmt.Errorf("output file already exists: %s\nPlease remove it or choose a different output directory", zipPath)
+	// Write one archive per bundle, checking none exist before creating any
+	report.stage("archive")
+	archiveFileSizes(config.TmpDir, filesToArchive)
+	bundles := makeBundles(config, filepath.Base(originalDir), validTexFiles, docFiles, cmdLineFiles)
+	if err := writeBundles(config, bundles); err != nil {
+		// Clean up temp directory before aborting
+		if !config.Debug {
+			os.RemoveAll(config.TmpDir)
 		}
+		return err
 	}
 	
-	if config.CreateBz2 {
-		bz2Path := filepath.Join(config.OutputDir, basename+".tar.bz2")
-		if _, err := os.Stat(bz2Path); err == nil {
-			// Clean up temp directory before aborting
-			if !config.Debug {
-				os.RemoveAll(config.TmpDir)
+	// Built PDFs that aren't in the archives go next to them
+	if config.Build && !config.IncludePDF {
+		for _, texFile := range validTexFiles {
+			pdfFile := strings.TrimSuffix(texFile, ".tex") + ".pdf"
+			src := filepath.Join(config.TmpDir, pdfFile)
+			if !fileExists(src) {
+				continue
 			}
-			return fmt.Errorf("output file already exists: %s\nPlease remove it or choose a different output directory", bz2Path)
-		}
-	}
-	
-	// Create archives
-	if config.CreateZip {
-		zipPath := filepath.Join(config.OutputDir, basename+".zip")
-		printPowderBlue("Creating ZIP archive: %s\n", zipPath)
-		
-		// Update paths to be relative to temp dir, but only include files that actually exist
-		zipFiles := []string{}
-		for _, f := range filesToArchive {
-			fullPath := filepath.Join(config.TmpDir, f)
-			if _, err := os.Stat(fullPath); err == nil {
-				zipFiles = append(zipFiles, fullPath)
+			dst := filepath.Join(config.OutputDir, bundleName(config.NameTemplate, filepath.Base(originalDir), strings.TrimSuffix(texFile, ".tex"))+".pdf")
+			if fileExists(dst) && !config.Overwrite {
+				logger.Warnf("%s already exists; not overwriting it", dst)
+				continue
 			}
-		}
-		
-		if err := createZipArchive(zipPath, zipFiles); err != nil {
-			return fmt.Errorf("error creating zip archive: %v", err)
-		}
-	}
-	
-	if config.CreateBz2 {
-		bz2Path := filepath.Join(config.OutputDir, basename+".tar.bz2")
-		printPowderBlue("Creating tar.bz2 archive: %s\n", bz2Path)
-		
-		// Update paths to be relative to temp dir, but only include files that actually exist
-		bz2Files := []string{}
-		for _, f := range filesToArchive {
-			fullPath := filepath.Join(config.TmpDir, f)
-			if _, err := os.Stat(fullPath); err == nil {
-				bz2Files = append(bz2Files, fullPath)
+			logger.Actionf("Writing %s", dst)
+			if err := copyFile(src, dst); err != nil {
+				return withExitCode(ExitArchive, fmt.Errorf("error writing %s: %v", dst, err))
 			}
 		}
-		
-		if err := createBz2Archive(bz2Path, bz2Files); err != nil {
-			return fmt.Errorf("error creating bz2 archive: %v", err)
-		}
 	}
 	
 	// Show debug information if in debug mode
@@ -394,13 +1111,13 @@ func run(config Config) error {
 		// Get absolute path to temp directory
 		absTmpDir, _ := filepath.Abs(config.TmpDir)
 		
-		fmt.Printf("\n=== DEBUG MODE ===\n")
-		fmt.Printf("Temp directory preserved at: %s\n", absTmpDir)
-		fmt.Printf("You can inspect the processed files and debug compilation issues.\n")
-		fmt.Printf("\n*** IMPORTANT ***\n")
-		fmt.Printf("You MUST remove this directory before running ziplatex again:\n")
-		fmt.Printf("    rm -rf %s\n", config.TmpDir)
-		fmt.Printf("Otherwise the next run will fail with 'temp directory already exists'.\n")
+		logger.Infof("\n=== DEBUG MODE ===")
+		logger.Infof("Temp directory preserved at: %s", absTmpDir)
+		logger.Infof("You can inspect the processed files and debug compilation issues.")
+		logger.Infof("\n*** IMPORTANT ***")
+		logger.Infof("You MUST remove this directory before running ziplatex again:")
+		logger.Infof("    rm -rf %s", config.TmpDir)
+		logger.Infof("Otherwise the next run will fail with 'temp directory already exists'.")
 	}
 	
 	return nil
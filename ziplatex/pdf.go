@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pdfFont is a font used by a PDF
+type pdfFont struct {
+	Name     string `json:"name"`
+	Subtype  string `json:"subtype"`
+	Embedded bool   `json:"embedded"`
+}
+
+// FontReport lists the fonts of one PDF and the problems found in it
+type FontReport struct {
+	Path     string    `json:"path"`
+	Fonts    []pdfFont `json:"fonts"`
+	Problems []string  `json:"problems"`
+}
+
+// pdfDocument holds the objects of a PDF: the dictionary text of every
+// object, and the raw data of the streams, which is only decoded on demand.
+type pdfDocument struct {
+	objects map[int]string
+	streams map[int][]byte
+	trailer string
+}
+
+var (
+	pdfObjRe      = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfRefRe      = regexp.MustCompile(`^\s*(\d+)\s+(\d+)\s+R`)
+	pdfRefsRe     = regexp.MustCompile(`(\d+)\s+\d+\s+R`)
+	pdfFontTypeRe = regexp.MustCompile(`/Type\s*/Font\b`)
+	pdfFontFileRe = regexp.MustCompile(`/FontFile[23]?\b`)
+	pdfStreamRe   = regexp.MustCompile(`>>\s*stream\r?\n`)
+	pdfObjStmRe   = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfXRefRe     = regexp.MustCompile(`/Type\s*/XRef\b`)
+	pdfCatalogRe  = regexp.MustCompile(`/Type\s*/Catalog\b`)
+
+	// pdfKeyRes caches the regexps matching dictionary keys
+	pdfKeyRes = make(map[string]*regexp.Regexp)
+)
+
+// pdfKeyRe returns the regexp matching /key as a whole name
+func pdfKeyRe(key string) *regexp.Regexp {
+	re, ok := pdfKeyRes[key]
+	if !ok {
+		re = regexp.MustCompile(`/` + key + `\b`)
+		pdfKeyRes[key] = re
+	}
+	return re
+}
+
+// standardFonts are the base 14 fonts viewers provide, which TeX never needs
+// but which some figure tools reference without embedding
+var standardFonts = map[string]bool{
+	"Times-Roman": true, "Times-Bold": true, "Times-Italic": true, "Times-BoldItalic": true,
+	"Helvetica": true, "Helvetica-Bold": true, "Helvetica-Oblique": true, "Helvetica-BoldOblique": true,
+	"Courier": true, "Courier-Bold": true, "Courier-Oblique": true, "Courier-BoldOblique": true,
+	"Symbol": true, "ZapfDingbats": true,
+}
+
+// readPDF reads the objects of a PDF, including those packed in object
+// streams. The cross-reference table is not needed: objects are found by
+// scanning for "N G obj", and later definitions replace earlier ones like
+// incremental updates do.
+func readPDF(path string) (*pdfDocument, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, fmt.Errorf("%s is not a PDF file", path)
+	}
+
+	doc := &pdfDocument{objects: make(map[int]string), streams: make(map[int][]byte)}
+	locs := pdfObjRe.FindAllSubmatchIndex(data, -1)
+	for i, loc := range locs {
+		num, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		end := len(data)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		body := data[loc[1]:end]
+		if j := bytes.Index(body, []byte("endobj")); j >= 0 {
+			body = body[:j]
+		}
+
+		// Keep the dictionary only; stream data is binary
+		dict := body
+		var stream []byte
+		if m := pdfStreamRe.FindIndex(body); m != nil {
+			dict = body[:m[0]+2]
+			stream = body[m[1]:]
+			if k := bytes.LastIndex(stream, []byte("endstream")); k >= 0 {
+				stream = stream[:k]
+			}
+		}
+		doc.objects[num] = string(dict)
+		delete(doc.streams, num)
+		if stream != nil {
+			doc.streams[num] = stream
+		}
+
+		if stream != nil && pdfObjStmRe.Match(dict) {
+			doc.readObjectStream(string(dict), stream)
+		}
+	}
+
+	if i := bytes.LastIndex(data, []byte("trailer")); i >= 0 {
+		doc.trailer = string(data[i:])
+	}
+	// PDF 1.5 files keep the trailer in the cross-reference stream
+	for _, obj := range doc.objects {
+		if pdfXRefRe.MatchString(obj) {
+			doc.trailer += obj
+		}
+	}
+	return doc, nil
+}
+
+// readObjectStream adds the objects packed in an object stream
+func (d *pdfDocument) readObjectStream(dict string, stream []byte) {
+	data := decodeStream(dict, stream)
+	if data == nil {
+		return
+	}
+	n := d.intValue(dict, "N")
+	first := d.intValue(dict, "First")
+	if n <= 0 || first <= 0 || first > len(data) {
+		return
+	}
+
+	header := strings.Fields(string(data[:first]))
+	for i := 0; i+1 < len(header) && i/2 < n; i += 2 {
+		num, err1 := strconv.Atoi(header[i])
+		off, err2 := strconv.Atoi(header[i+1])
+		if err1 != nil || err2 != nil || first+off > len(data) {
+			continue
+		}
+		end := len(data)
+		if i+3 < len(header) {
+			if next, err := strconv.Atoi(header[i+3]); err == nil && first+next <= len(data) && next >= off {
+				end = first + next
+			}
+		}
+		d.objects[num] = string(data[first+off : end])
+	}
+}
+
+// decodeStream returns the data of an uncompressed or FlateDecode stream,
+// or nil for other filters
+func decodeStream(dict string, stream []byte) []byte {
+	if !strings.Contains(dict, "/Filter") {
+		return stream
+	}
+	if !strings.Contains(dict, "/FlateDecode") {
+		return nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil && len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// value returns the raw text following /key in dict, up to the next key
+func (d *pdfDocument) value(dict string, key string) string {
+	m := pdfKeyRe(key).FindStringIndex(dict)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(dict[m[1]:])
+}
+
+// resolve follows an indirect reference at the start of text
+func (d *pdfDocument) resolve(text string) string {
+	if m := pdfRefRe.FindStringSubmatch(text); m != nil {
+		num, _ := strconv.Atoi(m[1])
+		return d.objects[num]
+	}
+	return text
+}
+
+// name returns the value of a name entry such as /Subtype /Type1
+func (d *pdfDocument) name(dict string, key string) string {
+	v := d.resolve(d.value(dict, key))
+	if !strings.HasPrefix(v, "/") {
+		return ""
+	}
+	end := strings.IndexAny(v[1:], " \t\r\n/[]<>()")
+	if end < 0 {
+		return v[1:]
+	}
+	return v[1 : end+1]
+}
+
+// intValue returns the value of an integer entry such as /N 12
+func (d *pdfDocument) intValue(dict string, key string) int {
+	fields := strings.Fields(d.value(dict, key))
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimRight(fields[0], "/>]"))
+	return n
+}
+
+// hasKey reports whether dict has an entry for key
+func (d *pdfDocument) hasKey(dict string, key string) bool {
+	return pdfKeyRe(key).MatchString(dict)
+}
+
+// embedded reports whether a font dictionary has an embedded font program,
+// looking through the descendant font of composite (Type0) fonts
+func (d *pdfDocument) embedded(font string) bool {
+	if d.name(font, "Subtype") == "Type0" {
+		descendants := d.resolve(d.value(font, "DescendantFonts"))
+		m := pdfRefsRe.FindStringSubmatch(descendants)
+		if m == nil {
+			return false
+		}
+		num, _ := strconv.Atoi(m[1])
+		font = d.objects[num]
+	}
+	descriptor := d.value(font, "FontDescriptor")
+	if m := pdfRefRe.FindStringSubmatch(descriptor); m != nil {
+		num, _ := strconv.Atoi(m[1])
+		descriptor = d.objects[num]
+	}
+	return pdfFontFileRe.MatchString(descriptor)
+}
+
+// fonts lists the fonts of the document, sorted by name
+func (d *pdfDocument) fonts() []pdfFont {
+	fonts := []pdfFont{}
+	seen := make(map[string]bool)
+	for _, obj := range d.objects {
+		if !pdfFontTypeRe.MatchString(obj) {
+			continue
+		}
+		subtype := d.name(obj, "Subtype")
+		// Descendants are reported through their Type0 parent
+		if subtype == "CIDFontType0" || subtype == "CIDFontType2" {
+			continue
+		}
+		font := pdfFont{Name: d.name(obj, "BaseFont"), Subtype: subtype}
+		if font.Name == "" {
+			font.Name = "(unnamed)"
+		}
+		// Type 3 glyphs are drawn by the PDF itself
+		font.Embedded = subtype == "Type3" || d.embedded(obj)
+		key := font.Name + "/" + font.Subtype
+		if !seen[key] {
+			seen[key] = true
+			fonts = append(fonts, font)
+		}
+	}
+	sort.Slice(fonts, func(i, j int) bool { return fonts[i].Name < fonts[j].Name })
+	return fonts
+}
+
+// catalog returns the document catalog dictionary
+func (d *pdfDocument) catalog() string {
+	if root := d.resolve(d.value(d.trailer, "Root")); root != "" {
+		return root
+	}
+	for _, obj := range d.objects {
+		if pdfCatalogRe.MatchString(obj) {
+			return obj
+		}
+	}
+	return ""
+}
+
+// pdfaProblems checks the basic PDF/A requirements that can be seen in the
+// document structure. It is not a validator: fonts, color and transparency
+// rules beyond these need a dedicated tool such as veraPDF.
+func (d *pdfDocument) pdfaProblems() []string {
+	problems := []string{}
+	if d.hasKey(d.trailer, "Encrypt") {
+		problems = append(problems, "PDF/A: the file is encrypted")
+	}
+	catalog := d.catalog()
+	if !d.hasKey(catalog, "Metadata") {
+		problems = append(problems, "PDF/A: no XMP metadata (use the pdfx package)")
+	} else if !d.hasPDFAIdentification() {
+		problems = append(problems, "PDF/A: the XMP metadata does not declare a PDF/A part")
+	}
+	if !d.hasKey(catalog, "OutputIntents") {
+		problems = append(problems, "PDF/A: no output intent (color profile)")
+	}
+	for _, obj := range d.objects {
+		if d.hasKey(obj, "JavaScript") || d.hasKey(obj, "JS") {
+			problems = append(problems, "PDF/A: the file contains JavaScript")
+			break
+		}
+	}
+	return problems
+}
+
+// metadata returns the XMP metadata stream of the catalog, or nil
+func (d *pdfDocument) metadata() []byte {
+	m := pdfRefRe.FindStringSubmatch(d.value(d.catalog(), "Metadata"))
+	if m == nil {
+		return nil
+	}
+	num, _ := strconv.Atoi(m[1])
+	stream, ok := d.streams[num]
+	if !ok {
+		return nil
+	}
+	return decodeStream(d.objects[num], stream)
+}
+
+// hasPDFAIdentification looks for pdfaid:part in the XMP metadata, which
+// pdfx writes uncompressed as PDF/A requires; compressed metadata is read too
+func (d *pdfDocument) hasPDFAIdentification() bool {
+	return bytes.Contains(d.metadata(), []byte("pdfaid:part"))
+}
+
+// inspectPDF lists the fonts of a PDF and flags non-embedded and Type 3
+// fonts, plus the basic PDF/A requirements if pdfa is set
+func inspectPDF(path string, pdfa bool) (FontReport, error) {
+	result := FontReport{Path: path, Fonts: []pdfFont{}, Problems: []string{}}
+	doc, err := readPDF(path)
+	if err != nil {
+		return result, err
+	}
+	result.Fonts = doc.fonts()
+	for _, font := range result.Fonts {
+		switch {
+		case font.Subtype == "Type3":
+			result.Problems = append(result.Problems, fmt.Sprintf("font %s is a Type 3 (bitmap) font", font.Name))
+		case !font.Embedded && standardFonts[font.Name]:
+			result.Problems = append(result.Problems, fmt.Sprintf("font %s is not embedded (standard font)", font.Name))
+		case !font.Embedded:
+			result.Problems = append(result.Problems, fmt.Sprintf("font %s is not embedded", font.Name))
+		}
+	}
+	if pdfa {
+		result.Problems = append(result.Problems, doc.pdfaProblems()...)
+	}
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testPDF assembles a PDF from object bodies numbered from 1; the
+// cross-reference table is left out since readPDF doesn't need it
+func testPDF(t *testing.T, trailer string, objects ...string) string {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	fmt.Fprintf(&b, "trailer\n%s\n%%%%EOF\n", trailer)
+	path := filepath.Join(t.TempDir(), "test.pdf")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// stream returns a stream object with dict entries extra, compressed if flate
+func stream(extra string, data string, flate bool) string {
+	if flate {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write([]byte(data))
+		w.Close()
+		data = z.String()
+		extra += " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", extra, len(data), data)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:Description pdfaid:part="1" pdfaid:conformance="B"/></x:xmpmeta>`
+
+func TestReadPDFFonts(t *testing.T) {
+	// Object 6 is packed in a compressed object stream
+	packed := "6 0 << /Type /Font /Subtype /Type3 /Name /F3 >>"
+	path := testPDF(t, "<< /Root 1 0 R >>",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /CMR10 /FontDescriptor 4 0 R >>",
+		"<< /Type /FontDescriptor /FontName /CMR10 /FontFile 5 0 R >>",
+		stream("", "font program", false),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		stream(fmt.Sprintf("/Type /ObjStm /N 1 /First %d", len("6 0 ")), packed, true),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /Arial /DescendantFonts [9 0 R] >>",
+		"<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Arial /FontDescriptor 10 0 R >>",
+		"<< /Type /FontDescriptor /FontName /Arial /FontFile2 5 0 R >>",
+	)
+	doc, err := readPDF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The packed object replaces the Helvetica object with the same number
+	want := []pdfFont{
+		{Name: "(unnamed)", Subtype: "Type3", Embedded: true},
+		{Name: "Arial", Subtype: "Type0", Embedded: true},
+		{Name: "CMR10", Subtype: "Type1", Embedded: true},
+	}
+	if got := doc.fonts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("fonts() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadPDFNotPDF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake.pdf")
+	os.WriteFile(path, []byte("<html>"), 0644)
+	if _, err := readPDF(path); err == nil {
+		t.Error("readPDF accepted a file without a PDF header")
+	}
+}
+
+func TestPDFAProblems(t *testing.T) {
+	tests := []struct {
+		name    string
+		trailer string
+		objects []string
+		want    []string
+	}{
+		{
+			"uncompressed metadata",
+			"<< /Root 1 0 R >>",
+			[]string{"<< /Type /Catalog /Metadata 2 0 R /OutputIntents [3 0 R] >>", stream("/Type /Metadata /Subtype /XML", testXMP, false), "<< /Type /OutputIntent >>"},
+			[]string{},
+		},
+		{
+			"compressed metadata",
+			"<< /Root 1 0 R >>",
+			[]string{"<< /Type /Catalog /Metadata 2 0 R /OutputIntents [3 0 R] >>", stream("/Type /Metadata /Subtype /XML", testXMP, true), "<< /Type /OutputIntent >>"},
+			[]string{},
+		},
+		{
+			"metadata without identification",
+			"<< /Root 1 0 R >>",
+			[]string{"<< /Type /Catalog /Metadata 2 0 R /OutputIntents [3 0 R] >>", stream("/Type /Metadata /Subtype /XML", "<x:xmpmeta/>", false), "<< /Type /OutputIntent >>"},
+			[]string{"PDF/A: the XMP metadata does not declare a PDF/A part"},
+		},
+		{
+			"identification outside the catalog metadata",
+			"<< /Root 1 0 R >>",
+			[]string{"<< /Type /Catalog >>", stream("/Type /Metadata /Subtype /XML", testXMP, false)},
+			[]string{"PDF/A: no XMP metadata (use the pdfx package)", "PDF/A: no output intent (color profile)"},
+		},
+		{
+			"encrypted with javascript",
+			"<< /Root 1 0 R /Encrypt 2 0 R >>",
+			[]string{"<< /Type /Catalog /Metadata 3 0 R /OutputIntents [] /Names << /JavaScript 2 0 R >> >>", "<< /Filter /Standard >>", stream("", testXMP, false)},
+			[]string{"PDF/A: the file is encrypted", "PDF/A: the file contains JavaScript"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := readPDF(testPDF(t, tt.trailer, tt.objects...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := doc.pdfaProblems(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pdfaProblems() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
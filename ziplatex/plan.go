@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DocumentPlan describes what would happen to a single tex file
+type DocumentPlan struct {
+	TexFile          string     `json:"tex_file"`
+	Dependencies     []string   `json:"dependencies"`
+	EmbeddedAux      []string   `json:"embedded_aux"`
+	EmbeddedClasses  []string   `json:"embedded_classes"`
+	EmbeddedPackages []string   `json:"embedded_packages"` // .sty, .bst, .cbx and .bbx files
+	Generators       []string   `json:"generators"`        // Packages whose shell escape output would be generated and frozen
+	GraphicsPaths    []string   `json:"graphics_paths"`
+	Moves            []FileMove `json:"moves"`
+
+	path string // tex file as given on the command line
+}
+
+// Plan is the result of a dry run
+type Plan struct {
+	Documents  []DocumentPlan `json:"documents"`
+	Copied     []string       `json:"copied"`
+	Collisions []string       `json:"collisions"`
+	Archive    []string       `json:"archive"`
+	Archives   []string       `json:"archives"`
+}
+
+// buildPlan runs dependency discovery only and works out what run would do
+// with the discovered files, without creating the temp directory. The engine
+// writes to a scratch directory and never gets shell escape, so the project
+// is left untouched.
+func buildPlan(config Config) (*Plan, error) {
+	plan := &Plan{
+		Documents:  []DocumentPlan{},
+		Copied:     []string{},
+		Collisions: []string{},
+		Archive:    []string{},
+		Archives:   []string{},
+	}
+	copied := make(map[string]bool)
+	used := make(map[string]bool)
+	addCopied := func(f string) {
+		if !copied[f] {
+			copied[f] = true
+			plan.Copied = append(plan.Copied, f)
+		}
+	}
+
+	roots := findTexRoots(config.Engine)
+	scratch, err := newScratchDirs()
+	if err != nil {
+		return nil, err
+	}
+	defer scratch.remove()
+	for _, texFile := range config.TexFiles {
+		if info, err := os.Stat(texFile); err == nil && info.IsDir() {
+			continue
+		}
+		logger.Progressf("Discovering dependencies of %s", texFile)
+
+		outDir, err := scratch.dir("discovery", texFile)
+		if err != nil {
+			return nil, err
+		}
+		deps, err := findDeps(config.Engine, texFile, outDir, shellEscapeAllow)
+		generators := findGenerators(texFile, outDir)
+		if err != nil && len(generators) > 0 {
+			// A real run gives the generators shell escape; the recorder
+			// file still lists what was read before the engine stopped
+			logger.Warnf("%s needs shell escape for %s; its dependencies are only listed up to where the engine stopped", texFile, strings.Join(generators, ", "))
+			deps, err = readFls(texFile, outDir)
+		}
+		if err != nil {
+			return nil, withExitCode(ExitDependencies, fmt.Errorf("error finding dependencies for %s: %v", texFile, err))
+		}
+
+		if found, err := scanBadChars(scanFilesFor(deps), config.Engine); err == nil && len(found) > 0 {
+			printBadChars(found)
+			report.addBadChars(found)
+		}
+
+		usedGraphics, gfxDiags := checkGraphics(texFile, config.Engine)
+		report.addDiagnostics(gfxDiags...)
+		for _, diag := range gfxDiags {
+			logger.Errorf("%s:%d: %s", diag.File, diag.Line, diag.Message)
+		}
+		for _, f := range usedGraphics {
+			used[f] = true
+		}
+
+		for _, dep := range personalDeps(texFile, outDir, roots) {
+			logger.Warnf("%s comes from outside the TeX distribution; a real run would bundle it as %s", dep, filepath.Base(dep))
+			addCopied(filepath.Base(dep))
+		}
+		for _, dep := range deps {
+			addCopied(dep)
+			used[filepath.Clean(dep)] = true
+		}
+		plan.Documents = append(plan.Documents, DocumentPlan{
+			TexFile:          filepath.Base(texFile),
+			path:             texFile,
+			Dependencies:     deps,
+			EmbeddedAux:      []string{},
+			EmbeddedClasses:  []string{},
+			EmbeddedPackages: []string{},
+			Generators:       append([]string{}, generators...),
+			GraphicsPaths:    []string{},
+			Moves:            []FileMove{},
+		})
+	}
+
+	if len(plan.Documents) == 0 {
+		return nil, fmt.Errorf("no valid tex files to process")
+	}
+	reportUnusedGraphics(findUnusedGraphics(".", config.TmpDir, used))
+
+	// Non-tex command line files are copied to the root of the temp dir
+	for _, file := range config.AllFiles {
+		if !strings.HasSuffix(file, ".tex") {
+			if info, err := os.Stat(file); err == nil && !info.IsDir() {
+				addCopied(filepath.Base(file))
+			}
+		}
+	}
+
+	embedded := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, f := range plan.Copied {
+		if filepath.Dir(f) == "." {
+			taken[f] = true
+		}
+	}
+
+	// Work out the embedded files and which graphics each document moves
+	claimed := make(map[string]bool)
+	toMove := []string{}
+	for i := range plan.Documents {
+		doc := &plan.Documents[i]
+		content, _ := expandIncludes(doc.path)
+
+		auxFile := strings.TrimSuffix(doc.TexFile, ".tex") + ".aux"
+		if copied[auxFile] {
+			doc.EmbeddedAux = append(doc.EmbeddedAux, auxFile)
+			embedded[auxFile] = true
+		}
+
+		// Local files loaded by the document are copied too, then embedded
+		for _, f := range localEmbeds(content, embedExts) {
+			addCopied(f)
+			if filepath.Ext(f) == ".cls" {
+				doc.EmbeddedClasses = append(doc.EmbeddedClasses, f)
+			} else {
+				doc.EmbeddedPackages = append(doc.EmbeddedPackages, f)
+			}
+			embedded[f] = true
+		}
+		if config.CustomClass != "" {
+			for _, load := range parseLoads(content) {
+				if load.Ext != ".cls" || fileExists(load.Name+".cls") {
+					continue
+				}
+				if clsFile := findCustomClass(load.Name+".cls", config.CustomClass); clsFile != "" {
+					doc.EmbeddedClasses = append(doc.EmbeddedClasses, clsFile)
+				}
+			}
+		}
+
+		doc.GraphicsPaths = parseGraphicsPaths(content)
+		for _, gfxPath := range doc.GraphicsPaths {
+			prefix := gfxPath + "/"
+			for _, f := range plan.Copied {
+				if strings.HasPrefix(f, prefix) && !claimed[f] {
+					claimed[f] = true
+					toMove = append(toMove, f)
+					doc.Moves = append(doc.Moves, FileMove{From: f})
+				}
+			}
+		}
+	}
+
+	renamed, collisions := flatNames(toMove, taken)
+	plan.Collisions = append(plan.Collisions, collisions...)
+	for i := range plan.Documents {
+		for j := range plan.Documents[i].Moves {
+			move := &plan.Documents[i].Moves[j]
+			move.To = renamed[move.From]
+		}
+	}
+
+	// The archive gets every copied file under its final name, minus the
+	// embedded aux/cls files and .out files
+	inArchive := make(map[string]bool)
+	for _, f := range plan.Copied {
+		name := f
+		if dest, ok := renamed[f]; ok {
+			name = dest
+		}
+		if embedded[name] || strings.HasSuffix(name, ".out") || inArchive[name] {
+			continue
+		}
+		inArchive[name] = true
+		plan.Archive = append(plan.Archive, name)
+	}
+	sort.Strings(plan.Archive)
+
+	// Archive names follow the bundles a real run would write
+	docFiles := make(map[string][]string)
+	texFiles := []string{}
+	shared := []string{}
+	for _, doc := range plan.Documents {
+		texFiles = append(texFiles, doc.TexFile)
+		docFiles[doc.TexFile] = doc.Dependencies
+	}
+	for _, file := range config.AllFiles {
+		if !strings.HasSuffix(file, ".tex") {
+			shared = append(shared, filepath.Base(file))
+		}
+	}
+	cwd, _ := os.Getwd()
+	for _, b := range makeBundles(config, filepath.Base(cwd), texFiles, docFiles, shared) {
+		plan.Archives = append(plan.Archives, archivePaths(config, b)...)
+	}
+
+	return plan, nil
+}
+
+// printPlan shows the dry run results
+func printPlan(plan *Plan) {
+	logger.Stagef("Files that would be copied to the temp directory:")
+	for _, f := range plan.Copied {
+		logger.Infof("  %s", f)
+	}
+
+	for _, doc := range plan.Documents {
+		logger.Stagef("%s:", doc.TexFile)
+		for _, f := range doc.EmbeddedAux {
+			logger.Notef("  would embed %s with filecontents", f)
+		}
+		for _, f := range append(doc.EmbeddedClasses, doc.EmbeddedPackages...) {
+			logger.Notef("  would embed %s with filecontents*", f)
+		}
+		for _, name := range doc.Generators {
+			logger.Notef("  would generate the %s files once and ship them frozen", name)
+		}
+		for _, gfxPath := range doc.GraphicsPaths {
+			logger.Notef("  would flatten graphicspath %s/", gfxPath)
+		}
+		for _, move := range doc.Moves {
+			logger.Infof("  would move %s to %s", move.From, move.To)
+		}
+	}
+
+	for _, c := range plan.Collisions {
+		logger.Warnf("%s", c)
+	}
+
+	logger.Stagef("Archive contents:")
+	for _, f := range plan.Archive {
+		logger.Infof("  %s", f)
+	}
+	for _, a := range plan.Archives {
+		if _, err := os.Stat(a); err == nil {
+			logger.Warnf("%s already exists; a real run would fail", a)
+		}
+		logger.Actionf("Would create %s", a)
+	}
+}
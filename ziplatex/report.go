@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// reportSchemaVersion is bumped whenever a field of Report changes meaning or is removed
+const reportSchemaVersion = 1
+
+// Exit codes returned by ziplatex
+const (
+	ExitOK           = 0
+	ExitFailure      = 1   // Unclassified failure
+	ExitUsage        = 2   // Bad command line
+	ExitMissingTool  = 3   // pdflatex, latexpand or bzip2 not available
+	ExitDependencies = 4   // Dependency discovery failed
+	ExitBadChars     = 5   // Source files contain characters the engine can't handle
+	ExitCompile      = 6   // Flattened files don't compile
+	ExitArchive      = 7   // Archive could not be written
+	ExitBibliography = 8   // .bib files have errors bibtex or biber can't handle
+	ExitInterrupted  = 130 // Stopped with Ctrl-C or SIGTERM
+)
+
+// exitError attaches an exit code to an error returned from run
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.Err
+}
+
+// withExitCode wraps err so that main exits with code
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{Code: code, Err: err}
+}
+
+// exitCode returns the exit code for an error returned from run
+func exitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ExitFailure
+}
+
+// StageReport records the outcome of one pipeline stage
+type StageReport struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "ok", "warning" or "failed"
+}
+
+// BadCharReport is a bad character location in the JSON report
+type BadCharReport struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Char      string `json:"char"`
+	Codepoint string `json:"codepoint"`
+}
+
+// FileReport is a file that was put in the archive
+type FileReport struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ArchiveReport is an archive that was written
+type ArchiveReport struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Bundle string `json:"bundle"`
+	Size   int64  `json:"size"`
+}
+
+// Report is the machine-readable summary printed by -json
+type Report struct {
+	Schema            int               `json:"schema"`
+	Status            string            `json:"status"` // "ok" or "error"
+	ExitCode          int               `json:"exit_code"`
+	Error             string            `json:"error,omitempty"`
+	Engine            string            `json:"engine"`
+	TexFiles          []string          `json:"tex_files"`
+	Stages            []StageReport     `json:"stages"`
+	Warnings          []string          `json:"warnings"`
+	Diagnostics       []texDiagnostic   `json:"diagnostics"`
+	BadChars          []BadCharReport   `json:"bad_chars"`
+	Files             []FileReport      `json:"files"`
+	Archives          []ArchiveReport   `json:"archives"`
+	Moves             []FileMove        `json:"moves"`
+	UnusedGraphics    []string          `json:"unused_graphics"`
+	FigureConversions []FileMove        `json:"figure_conversions"`
+	PDFs              []PDFReport       `json:"pdfs"`
+	Fonts             []FontReport      `json:"fonts"`
+	PersonalFiles     []FileMove        `json:"personal_files"`
+	OutsideWrites     []OutsideWrite    `json:"outside_writes"`
+	Generated         []GeneratedReport `json:"generated"`
+	Bibliographies    []BibReport       `json:"bibliographies"`
+	Cache             *CacheReport      `json:"cache,omitempty"`
+	Plan              *Plan             `json:"plan,omitempty"`
+
+	inputs []string   // Files the documents were found to depend on, for watch
+	mu     sync.Mutex // Guards every field; parallel jobs log warnings while the pipeline runs
+}
+
+// report collects the results of the current run
+var report = newReport()
+
+func newReport() *Report {
+	return &Report{
+		Schema:            reportSchemaVersion,
+		Status:            "ok",
+		TexFiles:          []string{},
+		Stages:            []StageReport{},
+		Warnings:          []string{},
+		Diagnostics:       []texDiagnostic{},
+		BadChars:          []BadCharReport{},
+		Files:             []FileReport{},
+		Archives:          []ArchiveReport{},
+		Moves:             []FileMove{},
+		UnusedGraphics:    []string{},
+		FigureConversions: []FileMove{},
+		PDFs:              []PDFReport{},
+		Fonts:             []FontReport{},
+		PersonalFiles:     []FileMove{},
+		OutsideWrites:     []OutsideWrite{},
+		Generated:         []GeneratedReport{},
+		Bibliographies:    []BibReport{},
+	}
+}
+
+// update runs f with the report locked; fields without a method of their
+// own are changed through it
+func (r *Report) update(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+}
+
+// stage marks the start of a new pipeline stage
+func (r *Report) stage(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stages = append(r.Stages, StageReport{Name: name, Status: "ok"})
+}
+
+// currentStage returns the name of the running stage
+func (r *Report) currentStage() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Stages) == 0 {
+		return "startup"
+	}
+	return r.Stages[len(r.Stages)-1].Name
+}
+
+// setStageStatus updates the current stage, never downgrading a failure
+func (r *Report) setStageStatus(status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setStageStatusLocked(status)
+}
+
+// setStageStatusLocked is setStageStatus for callers holding r.mu
+func (r *Report) setStageStatusLocked(status string) {
+	if len(r.Stages) == 0 {
+		return
+	}
+	current := &r.Stages[len(r.Stages)-1]
+	if current.Status != "failed" {
+		current.Status = status
+	}
+}
+
+// addWarning records a warning and marks the current stage
+func (r *Report) addWarning(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, msg)
+	r.setStageStatusLocked("warning")
+}
+
+// addDiagnostics records engine, graphics and bibliography diagnostics
+func (r *Report) addDiagnostics(diags ...texDiagnostic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Diagnostics = append(r.Diagnostics, diags...)
+}
+
+// addInputs records files the documents depend on
+func (r *Report) addInputs(files ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inputs = append(r.inputs, files...)
+}
+
+// addBadChars records characters found by scanBadChars
+func (r *Report) addBadChars(found []badChar) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range found {
+		r.BadChars = append(r.BadChars, BadCharReport{
+			File:      b.File,
+			Line:      b.Line,
+			Column:    b.Column,
+			Char:      string(b.Char),
+			Codepoint: fmt.Sprintf("U+%04X", b.Char),
+		})
+	}
+}
+
+// addOutsideWrites records writes outside the staging directory and returns
+// those not recorded by an earlier run
+func (r *Report) addOutsideWrites(writes []OutsideWrite) []OutsideWrite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	added := []OutsideWrite{}
+	for _, w := range writes {
+		seen := false
+		for _, old := range r.OutsideWrites {
+			seen = seen || old == w
+		}
+		if !seen {
+			r.OutsideWrites = append(r.OutsideWrites, w)
+			added = append(added, w)
+		}
+	}
+	return added
+}
+
+// addFile records a file that goes into the archive
+func (r *Report) addFile(path string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Files = append(r.Files, FileReport{Path: path, Size: size})
+}
+
+// addArchive records a written archive
+func (r *Report) addArchive(path string, format string, bundle string) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Archives = append(r.Archives, ArchiveReport{Path: path, Format: format, Bundle: bundle, Size: size})
+}
+
+// fail marks the run as failed
+func (r *Report) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Status = "error"
+	r.ExitCode = exitCode(err)
+	r.Error = err.Error()
+	r.setStageStatusLocked("failed")
+}
+
+// write prints the report as indented JSON
+func (r *Report) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// archiveFileSizes records the size of every file that goes into the archive
+func archiveFileSizes(tmpDir string, files []string) {
+	for _, f := range files {
+		if info, err := os.Stat(filepath.Join(tmpDir, f)); err == nil {
+			report.addFile(f, info.Size())
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// Run with -race: jobs log warnings while the pipeline moves between stages
+func TestReportConcurrentUpdates(t *testing.T) {
+	saved := report
+	defer func() { report = saved }()
+	report = newReport()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				report.addWarning("warning")
+				report.addDiagnostics(texDiagnostic{File: "a.tex", Line: j})
+				report.addOutsideWrites([]OutsideWrite{{Path: "x"}})
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		report.stage("stage")
+		report.setStageStatus("ok")
+		report.addInputs("a.tex")
+	}
+	wg.Wait()
+
+	if len(report.Warnings) != 400 || len(report.Diagnostics) != 400 || len(report.OutsideWrites) != 1 {
+		t.Errorf("got %d warnings, %d diagnostics and %d outside writes, want 400, 400 and 1",
+			len(report.Warnings), len(report.Diagnostics), len(report.OutsideWrites))
+	}
+}
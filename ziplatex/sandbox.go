@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultShellEscapeAllow are the programs restricted shell escape always
+// allows: repstopdf converts the .eps figures pdflatex and lualatex include
+// through epstopdf, as in TeX Live's own restricted mode
+var defaultShellEscapeAllow = []string{"repstopdf"}
+
+// shellEscapeAllow lists the programs \write18 may run in restricted shell
+// escape mode: the defaults and those from -shell-escape-allow. Empty means
+// shell escape is disabled.
+var shellEscapeAllow = append([]string{}, defaultShellEscapeAllow...)
+
+var (
+	// engineEnvKeep are the variables engines keep from the environment,
+	// besides the TeX and locale ones matched by keepEngineVar
+	engineEnvKeep = map[string]bool{
+		"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "LANG": true, "TZ": true,
+		"TMPDIR": true, "TEMP": true, "TMP": true, "SYSTEMROOT": true, "USERPROFILE": true,
+		"SOURCE_DATE_EPOCH": true, "FORCE_SOURCE_DATE": true,
+	}
+	// notWritingRe matches kpathsea refusing a write because of openout_any
+	notWritingRe = regexp.MustCompile(`Not writing to (.+?) \(openout_any = \w\)`)
+)
+
+// OutsideWrite is a file an engine run wrote, or tried to write, outside the
+// directory it was given
+type OutsideWrite struct {
+	File    string `json:"file"`
+	Path    string `json:"path"`
+	Blocked bool   `json:"blocked"`
+}
+
+// keepEngineVar reports whether an environment variable is passed to engines
+func keepEngineVar(name string) bool {
+	switch {
+	case engineEnvKeep[name]:
+		return true
+	case name == "openout_any" || name == "openin_any" || name == "shell_escape" || name == "shell_escape_commands":
+		// Set by sandboxEnv
+		return false
+	case strings.HasPrefix(name, "TEX"), strings.HasPrefix(name, "KPATHSEA"), strings.HasPrefix(name, "LC_"):
+		return true
+	case strings.HasSuffix(name, "INPUTS"), strings.HasSuffix(name, "FONTS"):
+		// BIBINPUTS, BSTINPUTS, LUAINPUTS, TTFONTS, OPENTYPEFONTS, ...
+		return true
+	}
+	return false
+}
+
+// sandboxEnv returns the environment engines and bibliography tools run in:
+// only TeX search paths, locale and basic system variables, with writes
+// limited to the current directory and below (openout_any=p), reads of dot
+// files refused (openin_any=r) and shell escape limited to allow
+func sandboxEnv(allow []string) []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if keepEngineVar(name) {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, "openout_any=p", "openin_any=r")
+	if len(allow) > 0 {
+		env = append(env, "shell_escape_commands="+strings.Join(allow, ","))
+	}
+	return env
+}
+
+// texEngines are the programs that run TeX. Restricted shell escape must
+// never allow one, since its command line can enable full shell escape.
+var texEngines = map[string]bool{
+	"tex": true, "etex": true, "pdftex": true, "xetex": true, "luatex": true, "luahbtex": true,
+	"latex": true, "pdflatex": true, "xelatex": true, "lualatex": true, "luahblatex": true,
+	"latexmk": true, "context": true, "mpost": true,
+}
+
+// isTexEngine reports whether program runs TeX
+func isTexEngine(program string) bool {
+	return texEngines[strings.TrimSuffix(filepath.Base(program), ".exe")]
+}
+
+// shellEscapeArgs returns the engine flag selecting the shell escape mode
+func shellEscapeArgs(allow []string) []string {
+	if len(allow) > 0 {
+		return []string{"-shell-restricted"}
+	}
+	return []string{"-no-shell-escape"}
+}
+
+// engineCommand returns a sandboxed command running engine with args, where
+// shell escape may only run the programs in allow
+func engineCommand(engine string, allow []string, args ...string) (*exec.Cmd, func(error) error) {
+	cmd, finish := toolCommand(engine, append(shellEscapeArgs(allow), args...)...)
+	cmd.Env = sandboxEnv(allow)
+	return cmd, finish
+}
+
+// checkWrites reports the files an engine run on texFile wrote outside
+// outDir (or the current directory if outDir is empty), read from the OUTPUT
+// lines of the .fls, and the writes kpathsea refused according to output
+func checkWrites(texFile string, outDir string, output string) {
+	writes := []OutsideWrite{}
+	for _, m := range notWritingRe.FindAllStringSubmatch(output, -1) {
+		writes = append(writes, OutsideWrite{File: texFile, Path: m[1], Blocked: true})
+	}
+
+	if content, err := ioutil.ReadFile(flsPath(texFile, outDir)); err == nil {
+		pwd, _ := os.Getwd()
+		allowed := outDir
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "PWD ") {
+				pwd = strings.TrimPrefix(line, "PWD ")
+				continue
+			}
+			if !strings.HasPrefix(line, "OUTPUT ") {
+				continue
+			}
+			if allowed == "" {
+				allowed = pwd
+			}
+			path := strings.TrimPrefix(line, "OUTPUT ")
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(pwd, path)
+			}
+			path = filepath.Clean(path)
+			if path != allowed && !strings.HasPrefix(path, allowed+string(filepath.Separator)) {
+				writes = append(writes, OutsideWrite{File: texFile, Path: path})
+			}
+		}
+	}
+
+	for _, w := range report.addOutsideWrites(writes) {
+		if w.Blocked {
+			logger.Warnf("%s tried to write %s outside the staging directory; it was blocked", texFile, w.Path)
+		} else {
+			logger.Warnf("%s wrote %s outside the staging directory", texFile, w.Path)
+		}
+	}
+}
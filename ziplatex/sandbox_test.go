@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeepEngineVar(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"TEXINPUTS", true},
+		{"BIBINPUTS", true},
+		{"BSTINPUTS", true},
+		{"TTFONTS", true},
+		{"TEXMFHOME", true},
+		{"KPATHSEA_DEBUG", true},
+		{"LC_ALL", true},
+		{"PATH", true},
+		{"HOME", true},
+		{"SOURCE_DATE_EPOCH", true},
+		{"shell_escape", false},
+		{"shell_escape_commands", false},
+		{"openout_any", false},
+		{"openin_any", false},
+		{"AWS_ACCESS_KEY_ID", false},
+		{"AWS_SECRET_ACCESS_KEY", false},
+		{"GITHUB_TOKEN", false},
+		{"SSH_AUTH_SOCK", false},
+	}
+	for _, tt := range tests {
+		if got := keepEngineVar(tt.name); got != tt.want {
+			t.Errorf("keepEngineVar(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWrites(t *testing.T) {
+	saved := report
+	defer func() { report = saved }()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	outDir := filepath.Join(dir, "scratch")
+	os.Mkdir(outDir, 0755)
+
+	tests := []struct {
+		name   string
+		fls    string
+		output string
+		want   []OutsideWrite
+	}{
+		{
+			"inside outDir",
+			"PWD " + dir + "\nOUTPUT " + outDir + "/main.aux\nOUTPUT scratch/main.log\nINPUT /usr/share/texmf/article.cls\n",
+			"",
+			[]OutsideWrite{},
+		},
+		{
+			"outside outDir",
+			"PWD " + dir + "\nOUTPUT " + outDir + "/main.aux\nOUTPUT /tmp/evil.tex\nOUTPUT main.out\n",
+			"",
+			[]OutsideWrite{
+				{File: "main.tex", Path: "/tmp/evil.tex"},
+				{File: "main.tex", Path: filepath.Join(dir, "main.out")},
+			},
+		},
+		{
+			"relative after PWD",
+			"PWD " + outDir + "\nOUTPUT main.aux\nOUTPUT sub/../main.toc\nOUTPUT ../escape.tex\n",
+			"",
+			[]OutsideWrite{{File: "main.tex", Path: filepath.Join(dir, "escape.tex")}},
+		},
+		{
+			"blocked by kpathsea",
+			"PWD " + outDir + "\n",
+			"! I can't write on file `/home/u/.bashrc'.\nNot writing to /home/u/.bashrc (openout_any = p).\n",
+			[]OutsideWrite{{File: "main.tex", Path: "/home/u/.bashrc", Blocked: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report = newReport()
+			os.WriteFile(filepath.Join(outDir, "main.fls"), []byte(tt.fls), 0644)
+			checkWrites("main.tex", outDir, tt.output)
+			if !reflect.DeepEqual(report.OutsideWrites, tt.want) {
+				t.Errorf("outside writes = %+v, want %+v", report.OutsideWrites, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellEscapeDefaults(t *testing.T) {
+	if !contains(shellEscapeAllow, "repstopdf") {
+		t.Errorf("shellEscapeAllow = %q, want repstopdf allowed by default", shellEscapeAllow)
+	}
+	if got := shellEscapeArgs(defaultShellEscapeAllow); !reflect.DeepEqual(got, []string{"-shell-restricted"}) {
+		t.Errorf("shellEscapeArgs(defaults) = %q, want restricted mode", got)
+	}
+	if got := shellEscapeArgs(nil); !reflect.DeepEqual(got, []string{"-no-shell-escape"}) {
+		t.Errorf("shellEscapeArgs(nil) = %q, want shell escape disabled", got)
+	}
+	env := sandboxEnv(defaultShellEscapeAllow)
+	if !contains(env, "shell_escape_commands=repstopdf") {
+		t.Errorf("sandboxEnv(defaults) doesn't allow repstopdf: %q", env)
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dataBlock is a run of data lines between comment and blank lines
+type dataBlock struct {
+	Line    int // Line of the block's first row
+	Content string
+}
+
+// tableOptions control how tables are written
+type tableOptions struct {
+	Format  string // csv, tsv, json or auto
+	Caption string
+	Label   string
+	Round   int // Decimal places, -1 to keep numbers as written
+	Style   string
+	Siunitx bool
+}
+
+// tableStyles are the rules drawn above, below and under the header
+var tableStyles = map[string][3]string{
+	"booktabs": {`\toprule`, `\midrule`, `\bottomrule`},
+	"plain":    {`\hline`, `\hline`, `\hline`},
+}
+
+// tableFormats maps data file extensions to the format of their blocks
+var tableFormats = map[string]string{
+	".csv":  "csv",
+	".txt":  "csv",
+	".dat":  "csv",
+	".tsv":  "tsv",
+	".json": "json",
+}
+
+// numberRe matches a decimal number with an optional exponent
+var numberRe = regexp.MustCompile(`^([+-]?)(\d*)(?:\.(\d*))?(?:[eE]([+-]?\d+))?$`)
+
+// splitDataBlocks splits data into blocks at comment and blank lines
+func splitDataBlocks(data string, comment string) []dataBlock {
+	var blocks []dataBlock
+	var current []string
+	start := 0
+	flush := func() {
+		if len(current) > 0 {
+			blocks = append(blocks, dataBlock{Line: start, Content: strings.Join(current, "\n")})
+			current = nil
+		}
+	}
+	for i, line := range strings.Split(data, "\n") {
+		stripped := strings.TrimSpace(line)
+		if stripped == "" || comment != "" && strings.HasPrefix(stripped, comment) {
+			flush()
+			continue
+		}
+		if len(current) == 0 {
+			start = i + 1
+		}
+		current = append(current, strings.TrimRight(line, "\r"))
+	}
+	flush()
+	return blocks
+}
+
+// readDelimited reads a block with comma as the field separator; rows may
+// have different lengths
+func readDelimited(content string, comma rune) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(content))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+	}
+	return rows, nil
+}
+
+// sameWidth returns the number of columns if every row has it, or 0
+func sameWidth(rows [][]string) int {
+	if len(rows) == 0 {
+		return 0
+	}
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			return 0
+		}
+	}
+	return len(rows[0])
+}
+
+// parseDelimited reads a CSV or TSV block. With comma 0 the delimiter is
+// sniffed: the first of tab, comma, semicolon and bar that splits every row
+// into the same number of columns, or else runs of spaces.
+func parseDelimited(content string, comma rune) ([][]string, error) {
+	if comma == 0 {
+		for _, candidate := range []rune{'\t', ',', ';', '|'} {
+			rows, err := readDelimited(content, candidate)
+			if err == nil && sameWidth(rows) > 1 {
+				return rows, nil
+			}
+		}
+		var rows [][]string
+		for _, line := range strings.Split(content, "\n") {
+			rows = append(rows, strings.Fields(line))
+		}
+		if sameWidth(rows) > 1 {
+			return rows, nil
+		}
+		comma = ','
+	}
+	rows, err := readDelimited(content, comma)
+	if err != nil {
+		return nil, err
+	}
+	if sameWidth(rows) == 0 {
+		return nil, fmt.Errorf("rows have different numbers of columns")
+	}
+	return rows, nil
+}
+
+// jsonCell formats a JSON scalar as a table cell
+func jsonCell(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("cells must be strings, numbers, booleans or null")
+}
+
+// jsonKeys returns the keys of the JSON object in raw in document order
+func jsonKeys(raw json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// parseJSONTable reads a JSON block: a list of rows with the header first,
+// an object of columns, or a list of objects with the same keys
+func parseJSONTable(content string) ([][]string, error) {
+	var whole json.RawMessage
+	dec := json.NewDecoder(strings.NewReader(content))
+	if err := dec.Decode(&whole); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	var value interface{}
+	dec = json.NewDecoder(bytes.NewReader(whole))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	cells := func(values []interface{}) ([]string, error) {
+		row := make([]string, len(values))
+		for i, v := range values {
+			var err error
+			if row[i], err = jsonCell(v); err != nil {
+				return nil, err
+			}
+		}
+		return row, nil
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, nil
+		}
+		if _, ok := v[0].(map[string]interface{}); ok {
+			var raw []json.RawMessage
+			if err := json.Unmarshal(whole, &raw); err != nil {
+				return nil, err
+			}
+			keys, err := jsonKeys(raw[0])
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, keys)
+			for _, item := range v {
+				object, ok := item.(map[string]interface{})
+				if !ok || len(object) != len(keys) {
+					return nil, fmt.Errorf("objects must all have the same keys")
+				}
+				values := make([]interface{}, len(keys))
+				for i, key := range keys {
+					if values[i], ok = object[key]; !ok {
+						return nil, fmt.Errorf("objects must all have the same keys")
+					}
+				}
+				row, err := cells(values)
+				if err != nil {
+					return nil, err
+				}
+				rows = append(rows, row)
+			}
+			return rows, nil
+		}
+		for _, item := range v {
+			values, ok := item.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("a list must hold rows (lists) or records (objects)")
+			}
+			row, err := cells(values)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+	case map[string]interface{}:
+		keys, err := jsonKeys(whole)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, keys)
+		for i, key := range keys {
+			column, ok := v[key].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("the value of %q is not a list", key)
+			}
+			if i > 0 && len(column) != len(rows)-1 {
+				return nil, fmt.Errorf("the lists of %q and %q have different lengths", keys[0], key)
+			}
+			for j, cell := range column {
+				if i == 0 {
+					rows = append(rows, make([]string, len(keys)))
+				}
+				if rows[j+1][i], err = jsonCell(cell); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("expected a list of rows, a list of objects or an object of columns")
+	}
+	if sameWidth(rows) == 0 {
+		return nil, fmt.Errorf("rows have different numbers of columns")
+	}
+	return rows, nil
+}
+
+// parseTableBlock reads a block in format; auto tries JSON first
+func parseTableBlock(content string, format string) ([][]string, error) {
+	switch format {
+	case "json":
+		return parseJSONTable(content)
+	case "tsv":
+		return parseDelimited(content, '\t')
+	case "csv":
+		return parseDelimited(content, 0)
+	}
+	if trimmed := strings.TrimSpace(content); strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+		if rows, err := parseJSONTable(content); err == nil {
+			return rows, nil
+		}
+	}
+	return parseDelimited(content, 0)
+}
+
+// latexEscapes are the characters escaped in table text
+var latexEscapes = strings.NewReplacer(
+	`&`, `\&`, `%`, `\%`, `$`, `\$`, `#`, `\#`, `_`, `\_`, `{`, `\{`, `}`, `\}`,
+	`~`, `\textasciitilde{}`, `^`, `\textasciicircum{}`, `\`, `\textbackslash{}`,
+)
+
+// tableNumber is a parsed numeric cell
+type tableNumber struct {
+	Sign, Int, Frac, Exp string
+}
+
+// parseTableNumber parses cell as a number, rounded to round decimal places
+// unless round is negative
+func parseTableNumber(cell string, round int) (tableNumber, bool) {
+	m := numberRe.FindStringSubmatch(cell)
+	if m == nil || m[2] == "" && m[3] == "" {
+		return tableNumber{}, false
+	}
+	n := tableNumber{Sign: m[1], Int: m[2], Frac: m[3], Exp: m[4]}
+	if n.Sign == "+" {
+		n.Sign = ""
+	}
+	if n.Int == "" {
+		n.Int = "0"
+	}
+	if round >= 0 && (n.Frac != "" || n.Exp != "") {
+		mantissa, _ := strconv.ParseFloat(n.Int+"."+n.Frac, 64)
+		n.Int, n.Frac, _ = strings.Cut(strconv.FormatFloat(mantissa, 'f', round, 64), ".")
+		if strings.Trim(n.Int+n.Frac, "0") == "" {
+			n.Sign = ""
+		}
+	}
+	if n.Exp != "" {
+		exp, _ := strconv.Atoi(n.Exp)
+		n.Exp = strconv.Itoa(exp)
+	}
+	return n, true
+}
+
+// String returns the number as plain text for siunitx
+func (n tableNumber) String() string {
+	s := n.Sign + n.Int
+	if n.Frac != "" {
+		s += "." + n.Frac
+	}
+	if n.Exp != "" {
+		s += "e" + n.Exp
+	}
+	return s
+}
+
+// math returns the number in math mode
+func (n tableNumber) math() string {
+	s := n.Sign + n.Int
+	if n.Frac != "" {
+		s += "." + n.Frac
+	}
+	if n.Exp != "" {
+		s += `\times 10^{` + n.Exp + `}`
+	}
+	return "$" + s + "$"
+}
+
+// columnFormat returns the siunitx table-format that fits numbers
+func columnFormat(numbers []tableNumber) string {
+	var sign bool
+	var intDigits, fracDigits, expDigits int
+	var expSign bool
+	for _, n := range numbers {
+		sign = sign || n.Sign != ""
+		intDigits = max(intDigits, len(n.Int))
+		fracDigits = max(fracDigits, len(n.Frac))
+		exp := strings.TrimPrefix(n.Exp, "-")
+		expSign = expSign || exp != n.Exp
+		expDigits = max(expDigits, len(exp))
+	}
+	format := strconv.Itoa(intDigits)
+	if sign {
+		format = "-" + format
+	}
+	if fracDigits > 0 {
+		format += "." + strconv.Itoa(fracDigits)
+	}
+	if expDigits > 0 {
+		format += "e"
+		if expSign {
+			format += "-"
+		}
+		format += strconv.Itoa(expDigits)
+	}
+	return format
+}
+
+// latexTable writes rows as a table float. The first row is the header;
+// columns holding only numbers are right aligned, or aligned on the decimal
+// point with siunitx.
+func latexTable(rows [][]string, caption string, label string, opts tableOptions) string {
+	header, body := rows[0], rows[1:]
+	numbers := make([][]tableNumber, len(body))
+	numeric := make([]bool, len(header))
+	for j := range header {
+		numeric[j] = len(body) > 0
+		seen := false
+		for _, row := range body {
+			if row[j] == "" {
+				continue
+			}
+			if _, ok := parseTableNumber(row[j], opts.Round); !ok {
+				numeric[j] = false
+			}
+			seen = true
+		}
+		numeric[j] = numeric[j] && seen
+	}
+	for i, row := range body {
+		numbers[i] = make([]tableNumber, len(row))
+		for j, cell := range row {
+			if numeric[j] && cell != "" {
+				numbers[i][j], _ = parseTableNumber(cell, opts.Round)
+			}
+		}
+	}
+
+	var spec []string
+	for j := range header {
+		switch {
+		case numeric[j] && opts.Siunitx:
+			var column []tableNumber
+			for i, row := range body {
+				if row[j] != "" {
+					column = append(column, numbers[i][j])
+				}
+			}
+			spec = append(spec, "S[table-format="+columnFormat(column)+"]")
+		case numeric[j]:
+			spec = append(spec, "r")
+		default:
+			spec = append(spec, "l")
+		}
+	}
+	line := func(cells []string) string {
+		return "        " + strings.Join(cells, " & ") + ` \\`
+	}
+	rules := tableStyles[opts.Style]
+
+	var b strings.Builder
+	b.WriteString("\\begin{table}[htbp]\n    \\centering\n")
+	if caption != "" {
+		fmt.Fprintf(&b, "    \\caption{%s}\n", latexEscapes.Replace(caption))
+	}
+	if label != "" {
+		fmt.Fprintf(&b, "    \\label{%s}\n", label)
+	}
+	fmt.Fprintf(&b, "    \\begin{tabular}{%s}\n", strings.Join(spec, " "))
+	fmt.Fprintf(&b, "        %s\n", rules[0])
+	cells := make([]string, len(header))
+	for j, cell := range header {
+		cells[j] = latexEscapes.Replace(cell)
+		if numeric[j] && opts.Siunitx {
+			// siunitx reads unbraced S column cells as numbers
+			cells[j] = "{" + cells[j] + "}"
+		}
+	}
+	b.WriteString(line(cells) + "\n")
+	fmt.Fprintf(&b, "        %s\n", rules[1])
+	for i, row := range body {
+		for j, cell := range row {
+			switch {
+			case !numeric[j] || cell == "":
+				cells[j] = latexEscapes.Replace(cell)
+			case opts.Siunitx:
+				cells[j] = numbers[i][j].String()
+			default:
+				cells[j] = numbers[i][j].math()
+			}
+		}
+		b.WriteString(line(cells) + "\n")
+	}
+	fmt.Fprintf(&b, "        %s\n", rules[2])
+	b.WriteString("    \\end{tabular}\n\\end{table}\n")
+	return b.String()
+}
+
+// tableFragment turns the data blocks of one file into LaTeX. Tables after
+// the first of a file get a numbered caption and label.
+func tableFragment(path string, opts tableOptions, comment string) (string, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading data file: %v", err)
+	}
+	format := opts.Format
+	if format == "auto" {
+		if f, ok := tableFormats[strings.ToLower(filepath.Ext(path))]; ok {
+			format = f
+		}
+	}
+	var blocks []dataBlock
+	if format == "json" {
+		// JSON spans blank lines, so the whole file is one block
+		blocks = []dataBlock{{Line: 1, Content: string(data)}}
+	} else {
+		blocks = splitDataBlocks(string(data), comment)
+	}
+
+	var tables []string
+	failed := 0
+	for i, block := range blocks {
+		rows, err := parseTableBlock(block.Content, format)
+		if err != nil {
+			logger.Errorf("%s:%d: table %d: %v", path, block.Line, i+1, err)
+			failed++
+			continue
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		caption, label := opts.Caption, opts.Label
+		if len(blocks) > 1 {
+			if caption != "" {
+				caption = fmt.Sprintf("%s (Table %d)", caption, i+1)
+			}
+			if label != "" {
+				label = fmt.Sprintf("%s-%d", label, i+1)
+			}
+		}
+		tables = append(tables, latexTable(rows, caption, label, opts))
+	}
+	if failed > 0 {
+		return "", 0, fmt.Errorf("%s: %d of %d data block(s) could not be read", path, failed, len(blocks))
+	}
+	if len(tables) == 0 {
+		logger.Warnf("%s: no data blocks found", path)
+		return "", 0, nil
+	}
+	fragment := fmt.Sprintf("%s from %s; edit the data and rerun instead of this file\n", tableMarker, filepath.ToSlash(path))
+	return fragment + strings.Join(tables, "\n"), len(tables), nil
+}
+
+// tableMarker starts the files ziplatex table writes; other files are only
+// overwritten with -f
+const tableMarker = "% Generated by ziplatex table"
+
+// tableOutput returns where the fragment for a data file is written: the
+// file's name with a .tex extension in dir
+func tableOutput(dir string, path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return filepath.Join(dir, name+".tex")
+}
+
+// tableMain runs ziplatex table and returns its exit code
+func tableMain(args []string) int {
+	var config Config
+	var opts tableOptions
+	flags := flag.NewFlagSet("table", flag.ExitOnError)
+	dir := flags.String("dir", "src", "Directory the .tex fragments are written to")
+	output := flags.String("o", "", "Write all tables to this file instead, - for stdout")
+	force := flags.Bool("f", false, "Overwrite output files that ziplatex table didn't write")
+	flags.StringVar(&opts.Format, "format", "auto", "Data format: auto (from the extension, else sniffed), csv, tsv or json")
+	flags.StringVar(&opts.Caption, "caption", "", "Table caption; numbered when a file has several tables")
+	flags.StringVar(&opts.Label, "label", "", "Table label, e.g. tab:yields; numbered when a file has several tables")
+	flags.IntVar(&opts.Round, "round", -1, "Round numbers to this many decimal places")
+	flags.StringVar(&opts.Style, "style", "booktabs", "Rules: booktabs or plain (\\hline)")
+	flags.BoolVar(&opts.Siunitx, "siunitx", false, "Align numeric columns on the decimal point with siunitx S columns")
+	comment := flags.String("comment", "#", "Lines starting with this are comments and separate tables")
+	flags.BoolVar(&config.Quiet, "q", false, "Quiet: only show warnings and errors")
+	flags.BoolVar(&config.Verbose, "v", false, "Verbose: show debug messages")
+	flags.StringVar(&config.ColorMode, "color", ColorAuto, "Color output: auto, always or never")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s table [-dir DIR|-o FILE] [-f] [-format FORMAT] [-caption TEXT] [-label LABEL] [-round N] [-style STYLE] [-siunitx] [-comment PREFIX] [-q|-v] [-color MODE] data.csv [more.json ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes CSV, TSV and JSON data as LaTeX tables to \\input in a document.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config.Format = "text"
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ExitUsage
+	}
+	if opts.Format != "auto" && opts.Format != "csv" && opts.Format != "tsv" && opts.Format != "json" {
+		usageFatalf("Unknown -format %q (use auto, csv, tsv or json)", opts.Format)
+	}
+	if _, ok := tableStyles[opts.Style]; !ok {
+		usageFatalf("Unknown -style %q (use booktabs or plain)", opts.Style)
+	}
+	if (opts.Caption != "" || opts.Label != "") && flags.NArg() > 1 {
+		usageFatalf("-caption and -label need a single data file")
+	}
+	if opts.Round < -1 {
+		usageFatalf("-round must not be negative")
+	}
+	if config.ColorMode != ColorAuto && config.ColorMode != ColorAlways && config.ColorMode != ColorNever {
+		usageFatalf("Unknown -color %q (use auto, always or never)", config.ColorMode)
+	}
+	if config.Quiet && config.Verbose {
+		usageFatalf("-q and -v cannot be used together")
+	}
+	closeLog, err := setupLogger(config)
+	if err != nil {
+		usageFatalf("%v", err)
+	}
+	defer closeLog()
+
+	if err := tables(flags.Args(), *dir, *output, *force, opts, *comment); err != nil {
+		logger.Errorf("%v", err)
+		return exitCode(err)
+	}
+	return ExitOK
+}
+
+// tables writes the fragments for the data files. A fragment is only
+// rewritten when it changes, so documents \input-ing it aren't rebuilt.
+func tables(files []string, dir string, output string, force bool, opts tableOptions, comment string) error {
+	if output == "" {
+		written := make(map[string]string)
+		for _, file := range files {
+			path := filepath.Clean(tableOutput(dir, file))
+			if other, ok := written[path]; ok && filepath.Clean(other) != filepath.Clean(file) {
+				return withExitCode(ExitUsage, fmt.Errorf("%s and %s would both be written to %s; convert them separately with -o", other, file, path))
+			}
+			written[path] = file
+		}
+	}
+	var combined []string
+	count := 0
+	for _, file := range files {
+		fragment, n, err := tableFragment(file, opts, comment)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		count += n
+		if output != "" {
+			combined = append(combined, fragment)
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating output directory: %v", err)
+		}
+		if err := writeTableFragment(tableOutput(dir, file), fragment, n, force); err != nil {
+			return err
+		}
+	}
+	switch {
+	case count == 0:
+		return nil
+	case output == "-":
+		w := bufio.NewWriter(os.Stdout)
+		io.WriteString(w, strings.Join(combined, "\n"))
+		return w.Flush()
+	case output != "":
+		if err := writeTableFragment(output, strings.Join(combined, "\n"), count, force); err != nil {
+			return err
+		}
+	}
+	packages := "booktabs"
+	if opts.Style == "plain" {
+		packages = ""
+	}
+	if opts.Siunitx {
+		packages = strings.TrimPrefix(packages+",siunitx", ",")
+	}
+	if packages != "" {
+		logger.Infof("The tables need \\usepackage{%s} in the preamble", packages)
+	}
+	return nil
+}
+
+// writeTableFragment writes fragment to path unless it already holds it.
+// An existing file that doesn't start with tableMarker is only replaced if
+// force is set.
+func writeTableFragment(path string, fragment string, n int, force bool) error {
+	old, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil && string(old) == fragment:
+		logger.Infof("%s is up to date", path)
+		return nil
+	case err == nil && !force && !strings.HasPrefix(string(old), tableMarker):
+		return fmt.Errorf("%s exists and was not written by ziplatex table; use -f to overwrite it", path)
+	case err != nil && !os.IsNotExist(err):
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	if err := writeFileAtomic(path, []byte(fragment)); err != nil {
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	logger.Successf("Wrote %d table(s) to %s; add \\input{%s} to the document", n, path, filepath.ToSlash(strings.TrimSuffix(path, ".tex")))
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitDataBlocks(t *testing.T) {
+	data := "# yields\na,b\r\n1,2\n\n\n  # second table\nx;y\n3;4\n// note\n5;6\n"
+	tests := []struct {
+		comment string
+		want    []dataBlock
+	}{
+		{"#", []dataBlock{{Line: 2, Content: "a,b\n1,2"}, {Line: 7, Content: "x;y\n3;4\n// note\n5;6"}}},
+		{"//", []dataBlock{{Line: 1, Content: "# yields\na,b\n1,2"}, {Line: 6, Content: "  # second table\nx;y\n3;4"}, {Line: 10, Content: "5;6"}}},
+		{"", []dataBlock{{Line: 1, Content: "# yields\na,b\n1,2"}, {Line: 6, Content: "  # second table\nx;y\n3;4\n// note\n5;6"}}},
+	}
+	for _, tt := range tests {
+		if got := splitDataBlocks(data, tt.comment); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitDataBlocks(comment %q) = %q, want %q", tt.comment, got, tt.want)
+		}
+	}
+	if got := splitDataBlocks("\n# only comments\n", "#"); got != nil {
+		t.Errorf("splitDataBlocks of comments = %q, want none", got)
+	}
+}
+
+func TestParseDelimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		comma   rune
+		want    [][]string
+		err     bool
+	}{
+		{"comma", "a, b\n1, 2", 0, [][]string{{"a", "b"}, {"1", "2"}}, false},
+		{"tab before comma", "a,x\tb\n1,5\t2", 0, [][]string{{"a,x", "b"}, {"1,5", "2"}}, false},
+		{"semicolon with decimal commas", "a;b\n1,5;2,25", 0, [][]string{{"a", "b"}, {"1,5", "2,25"}}, false},
+		{"bar", "a | b\n1 | 2", 0, [][]string{{"a", "b"}, {"1", "2"}}, false},
+		{"spaces", "T   yield\n20  0.5", 0, [][]string{{"T", "yield"}, {"20", "0.5"}}, false},
+		{"quoted", "name,note\n\"Smith, J.\",\"said \"\"hi\"\"\"", 0, [][]string{{"name", "note"}, {"Smith, J.", `said "hi"`}}, false},
+		{"explicit tab", "a b\tc\n1 2\t3", '\t', [][]string{{"a b", "c"}, {"1 2", "3"}}, false},
+		{"single column", "a\n1", 0, [][]string{{"a"}, {"1"}}, false},
+		{"ragged", "a,b,c\n1,2", 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDelimited(tt.content, tt.comma)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseDelimited(%q) error = %v, want error %v", tt.content, err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDelimited(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    [][]string
+		err     string
+	}{
+		{"rows", `[["T", "yield"], [20, 0.50], [null, true]]`, [][]string{{"T", "yield"}, {"20", "0.50"}, {"", "true"}}, ""},
+		{"records in key order", `[{"z": 1, "a": "x"}, {"a": "y", "z": 2}]`, [][]string{{"z", "a"}, {"1", "x"}, {"2", "y"}}, ""},
+		{"columns", "{\"T\": [20, 30],\n \"yield\": [0.5, 0.7]}\n", [][]string{{"T", "yield"}, {"20", "0.5"}, {"30", "0.7"}}, ""},
+		{"empty list", `[]`, nil, ""},
+		{"records with other keys", `[{"a": 1}, {"b": 2}]`, nil, "objects must all have the same keys"},
+		{"records with more keys", `[{"a": 1}, {"a": 2, "b": 3}]`, nil, "objects must all have the same keys"},
+		{"columns of other lengths", `{"a": [1, 2], "b": [3]}`, nil, `the lists of "a" and "b" have different lengths`},
+		{"column not a list", `{"a": 1}`, nil, `the value of "a" is not a list`},
+		{"nested cell", `[["a"], [[1]]]`, nil, "cells must be strings, numbers, booleans or null"},
+		{"ragged rows", `[["a", "b"], [1]]`, nil, "rows have different numbers of columns"},
+		{"mixed list", `[["a"], {"a": 1}]`, nil, "a list must hold rows (lists) or records (objects)"},
+		{"scalar", `42`, nil, "expected a list of rows, a list of objects or an object of columns"},
+		{"two values", "[{\"a\":1}]\n[{\"a\":3}]", nil, "unexpected data after the JSON value"},
+		{"trailing text", `[["a"], [1]] x`, nil, "unexpected data after the JSON value"},
+		{"not closed", `[["a"], [1]`, nil, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJSONTable(tt.content)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("parseJSONTable(%q) error = %v, want %q", tt.content, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJSONTable(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTableNumber(t *testing.T) {
+	tests := []struct {
+		cell  string
+		round int
+		want  string // String(), or "" if not a number
+		math  string
+	}{
+		{"42", -1, "42", "$42$"},
+		{"+0.50", -1, "0.50", "$0.50$"},
+		{"-.5", -1, "-0.5", "$-0.5$"},
+		{"1.5e-03", -1, "1.5e-3", `$1.5\times 10^{-3}$`},
+		{"6.02E+23", 1, "6.0e23", `$6.0\times 10^{23}$`},
+		{"3.14159", 2, "3.14", "$3.14$"},
+		{"2.5", 0, "2", "$2$"},
+		{"7", 2, "7", "$7$"},
+		{"-0.001", 2, "0.00", "$0.00$"},
+		{"5.", -1, "5", "$5$"},
+		{"", -1, "", ""},
+		{".", -1, "", ""},
+		{"1,5", -1, "", ""},
+		{"1e5x", -1, "", ""},
+		{"n/a", -1, "", ""},
+	}
+	for _, tt := range tests {
+		n, ok := parseTableNumber(tt.cell, tt.round)
+		if ok != (tt.want != "") {
+			t.Errorf("parseTableNumber(%q) ok = %v", tt.cell, ok)
+			continue
+		}
+		if ok && (n.String() != tt.want || n.math() != tt.math) {
+			t.Errorf("parseTableNumber(%q, %d) = %s, %s; want %s, %s", tt.cell, tt.round, n.String(), n.math(), tt.want, tt.math)
+		}
+	}
+}
+
+func TestTablesOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "yields.csv")
+	os.WriteFile(data, []byte("T,yield\n20,0.5\n"), 0644)
+	opts := tableOptions{Format: "auto", Round: -1, Style: "booktabs"}
+
+	// Fragments are rewritten, other files only with force
+	out := filepath.Join(dir, "src")
+	if err := tables([]string{data}, out, "", false, opts, "#"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(data, []byte("T,yield\n30,0.7\n"), 0644)
+	if err := tables([]string{data}, out, "", false, opts, "#"); err != nil {
+		t.Fatal(err)
+	}
+	if fragment, _ := os.ReadFile(filepath.Join(out, "yields.tex")); !strings.Contains(string(fragment), "0.7") {
+		t.Errorf("fragment wasn't rewritten:\n%s", fragment)
+	}
+
+	paper := filepath.Join(dir, "paper.tex")
+	os.WriteFile(paper, []byte("\\documentclass{article}\n"), 0644)
+	if err := tables([]string{data}, "", paper, false, opts, "#"); err == nil {
+		t.Error("tables overwrote a file it didn't write")
+	}
+	if content, _ := os.ReadFile(paper); string(content) != "\\documentclass{article}\n" {
+		t.Errorf("paper.tex was changed to %q", content)
+	}
+	if err := tables([]string{data}, "", paper, true, opts, "#"); err != nil {
+		t.Errorf("tables with force: %v", err)
+	}
+
+	// Two data files with the same name would share a fragment
+	other := filepath.Join(dir, "raw", "yields.json")
+	os.MkdirAll(filepath.Dir(other), 0755)
+	os.WriteFile(other, []byte(`[["T"], [1]]`), 0644)
+	err := tables([]string{data, other}, out, "", false, opts, "#")
+	if err == nil || exitCode(err) != ExitUsage {
+		t.Errorf("tables with colliding outputs = %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultToolTimeout bounds each run of an external tool
+const DefaultToolTimeout = 5 * time.Minute
+
+var (
+	// toolTimeout limits every external tool run, 0 for no limit
+	toolTimeout = DefaultToolTimeout
+	// toolCtx is cancelled when ziplatex is interrupted
+	toolCtx = context.Background()
+)
+
+// toolCommand returns a command running name in its own process group. The
+// whole group is killed when the run takes longer than toolTimeout or when
+// ziplatex is interrupted, so children such as the bibtex or epstopdf a TeX
+// run spawns don't survive it. finish must be called with the error of the
+// run; it stops the timer and explains a kill, naming the stalled step.
+func toolCommand(name string, args ...string) (*exec.Cmd, func(error) error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if toolTimeout > 0 {
+		ctx, cancel = context.WithTimeout(toolCtx, toolTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(toolCtx)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	// Don't wait for output pipes a stray process may still hold
+	cmd.WaitDelay = 5 * time.Second
+
+	step := report.currentStage()
+	finish := func(err error) error {
+		defer cancel()
+		if err == nil {
+			return nil
+		}
+		desc := commandLine(name, args)
+		switch {
+		case toolCtx.Err() != nil:
+			return fmt.Errorf("interrupted while running %s", desc)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return fmt.Errorf("the %s step stalled: %s was stopped after %v (use -timeout to allow more time)", step, desc, toolTimeout)
+		}
+		return err
+	}
+	return cmd, finish
+}
+
+// commandLine shows a command for messages, shortening long argument lists
+func commandLine(name string, args []string) string {
+	if len(args) > 6 {
+		args = append(append(args[:3:3], "..."), args[len(args)-2:]...)
+	}
+	return strings.Join(append([]string{name}, args...), " ")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToolCommandTimeout(t *testing.T) {
+	saved, savedReport := toolTimeout, report
+	defer func() { toolTimeout, report = saved, savedReport }()
+	toolTimeout = 100 * time.Millisecond
+	report = newReport()
+	report.stage("compile")
+
+	start := time.Now()
+	cmd, finish := toolCommand("sleep", "10")
+	err := finish(cmd.Run())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sleep ran for %v, want it killed after %v", elapsed, toolTimeout)
+	}
+	if err == nil || !strings.Contains(err.Error(), "the compile step stalled: sleep 10 was stopped after 100ms") {
+		t.Errorf("finish() = %v, want the stalled step message", err)
+	}
+
+	// Without a timeout the command runs to completion
+	toolTimeout = 0
+	cmd, finish = toolCommand("true")
+	if err := finish(cmd.Run()); err != nil {
+		t.Errorf("finish() = %v without a timeout", err)
+	}
+}
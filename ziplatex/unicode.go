@@ -0,0 +1,594 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fix modes for rewriting bad characters
+const (
+	FixModeMacro   = "macro"   // Replace characters inline with LaTeX macros
+	FixModeDeclare = "declare" // Add \DeclareUnicodeCharacter lines to the preamble
+)
+
+// unicodeReplacements maps characters that break pdflatex to LaTeX equivalents
+var unicodeReplacements = map[rune]string{
+	// Quotes and dashes
+	'‘': "`",
+	'’': "'",
+	'‚': ",",
+	'“': "``",
+	'”': "''",
+	'„': ",,",
+	'′': "\\ensuremath{'}",
+	'″': "\\ensuremath{''}",
+	'‐': "-",
+	'‑': "-",
+	'‒': "--",
+	'–': "--",
+	'—': "---",
+	'―': "---",
+	'−': "\\ensuremath{-}",
+	'…': "\\dots{}",
+	'•': "\\textbullet{}",
+
+	// Spaces
+	'\u00A0': "~",
+	'\u2002': "\\enspace{}",
+	'\u2003': "\\quad{}",
+	'\u2009': "\\,",
+	'\u200A': "\\,",
+	'\u202F': "\\,",
+	'\u200B': "",
+	'\u200C': "",
+	'\u200D': "",
+	'\u2060': "",
+	'\uFEFF': "",
+	'\u00AD': "\\-",
+
+	// Units and symbols
+	'µ':      "\\textmu{}",
+	'°':      "\\textdegree{}",
+	'℃':      "\\textdegree{}C",
+	'\u212B': "\\AA{}",
+	'±':      "\\textpm{}",
+	'×':      "\\texttimes{}",
+	'÷':      "\\textdiv{}",
+	'≤':      "\\ensuremath{\\leq}",
+	'≥':      "\\ensuremath{\\geq}",
+	'≠':      "\\ensuremath{\\neq}",
+	'≈':      "\\ensuremath{\\approx}",
+	'∞':      "\\ensuremath{\\infty}",
+	'→':      "\\ensuremath{\\rightarrow}",
+	'←':      "\\ensuremath{\\leftarrow}",
+	'↔':      "\\ensuremath{\\leftrightarrow}",
+	'⇌':      "\\ensuremath{\\rightleftharpoons}",
+	'⋅':      "\\ensuremath{\\cdot}",
+	'·':      "\\textperiodcentered{}",
+	'⁰':      "\\textsuperscript{0}",
+	'¹':      "\\textsuperscript{1}",
+	'²':      "\\textsuperscript{2}",
+	'³':      "\\textsuperscript{3}",
+	'⁴':      "\\textsuperscript{4}",
+	'⁺':      "\\textsuperscript{+}",
+	'⁻':      "\\textsuperscript{--}",
+	'₀':      "\\textsubscript{0}",
+	'₁':      "\\textsubscript{1}",
+	'₂':      "\\textsubscript{2}",
+	'₃':      "\\textsubscript{3}",
+	'₄':      "\\textsubscript{4}",
+
+	// Greek letters
+	'α':      "\\ensuremath{\\alpha}",
+	'β':      "\\ensuremath{\\beta}",
+	'γ':      "\\ensuremath{\\gamma}",
+	'δ':      "\\ensuremath{\\delta}",
+	'ε':      "\\ensuremath{\\epsilon}",
+	'ζ':      "\\ensuremath{\\zeta}",
+	'η':      "\\ensuremath{\\eta}",
+	'θ':      "\\ensuremath{\\theta}",
+	'ι':      "\\ensuremath{\\iota}",
+	'κ':      "\\ensuremath{\\kappa}",
+	'λ':      "\\ensuremath{\\lambda}",
+	'μ':      "\\ensuremath{\\mu}",
+	'ν':      "\\ensuremath{\\nu}",
+	'ξ':      "\\ensuremath{\\xi}",
+	'ο':      "o",
+	'π':      "\\ensuremath{\\pi}",
+	'ρ':      "\\ensuremath{\\rho}",
+	'ς':      "\\ensuremath{\\varsigma}",
+	'σ':      "\\ensuremath{\\sigma}",
+	'τ':      "\\ensuremath{\\tau}",
+	'υ':      "\\ensuremath{\\upsilon}",
+	'φ':      "\\ensuremath{\\phi}",
+	'χ':      "\\ensuremath{\\chi}",
+	'ψ':      "\\ensuremath{\\psi}",
+	'ω':      "\\ensuremath{\\omega}",
+	'Α':      "A",
+	'Β':      "B",
+	'Γ':      "\\ensuremath{\\Gamma}",
+	'Δ':      "\\ensuremath{\\Delta}",
+	'Ε':      "E",
+	'Ζ':      "Z",
+	'Η':      "H",
+	'Θ':      "\\ensuremath{\\Theta}",
+	'Ι':      "I",
+	'Κ':      "K",
+	'Λ':      "\\ensuremath{\\Lambda}",
+	'Μ':      "M",
+	'Ν':      "N",
+	'Ξ':      "\\ensuremath{\\Xi}",
+	'Ο':      "O",
+	'Π':      "\\ensuremath{\\Pi}",
+	'Ρ':      "P",
+	'Σ':      "\\ensuremath{\\Sigma}",
+	'Τ':      "T",
+	'Υ':      "\\ensuremath{\\Upsilon}",
+	'Φ':      "\\ensuremath{\\Phi}",
+	'Χ':      "X",
+	'Ψ':      "\\ensuremath{\\Psi}",
+	'Ω':      "\\ensuremath{\\Omega}",
+	'\u2126': "\\ensuremath{\\Omega}",
+}
+
+// combiningAccents maps combining diacritical marks to LaTeX accent macros
+var combiningAccents = map[rune]string{
+	'\u0300': "\\`",
+	'\u0301': "\\'",
+	'\u0302': "\\^",
+	'\u0303': "\\~",
+	'\u0304': "\\=",
+	'\u0306': "\\u",
+	'\u0307': "\\.",
+	'\u0308': "\\\"",
+	'\u030A': "\\r",
+	'\u030B': "\\H",
+	'\u030C': "\\v",
+	'\u0327': "\\c",
+	'\u0328': "\\k",
+}
+
+// fixChange records a single rewritten line
+type fixChange struct {
+	File string
+	Line int
+	Old  string
+	New  string
+}
+
+// fixReport summarizes what the fixer did (or would do)
+type fixReport struct {
+	Changes  []fixChange
+	Declared []rune            // Characters added as \DeclareUnicodeCharacter
+	Unmapped map[rune][]string // Characters with no replacement -> locations
+}
+
+// isSafeRune reports whether a character can be left alone for pdflatex
+func isSafeRune(r rune) bool {
+	// ASCII and the Latin-1 letters handled by inputenc/fontenc out of the box
+	if r < 0x80 {
+		return true
+	}
+	if r >= 0xC0 && r <= 0xFF && r != 0xD7 && r != 0xF7 {
+		return true
+	}
+	return false
+}
+
+// fixLine rewrites the characters in a single line that supported rejects,
+// the same test the scanner uses. In declare mode only combining accents are
+// rewritten inline; every other mapped character is left in place and
+// recorded in used so it can be declared in the preamble.
+func fixLine(line string, mode string, supported func(rune) bool, used map[rune]bool, unmapped map[rune]bool) string {
+	var b strings.Builder
+	runes := []rune(line)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		// Look ahead for a combining accent applied to this character
+		if i+1 < len(runes) {
+			if accent, ok := combiningAccents[runes[i+1]]; ok && !supported(runes[i+1]) && r < 0x80 && r != ' ' {
+				base := string(r)
+				if r == 'i' {
+					base = "\\i"
+				} else if r == 'j' {
+					base = "\\j"
+				}
+				fmt.Fprintf(&b, "%s{%s}", accent, base)
+				i++
+				continue
+			}
+		}
+
+		if supported(r) {
+			b.WriteRune(r)
+			continue
+		}
+
+		repl, ok := unicodeReplacements[r]
+		if !ok {
+			unmapped[r] = true
+			b.WriteRune(r)
+			continue
+		}
+
+		if mode == FixModeDeclare {
+			used[r] = true
+			b.WriteRune(r)
+		} else {
+			b.WriteString(repl)
+		}
+	}
+
+	return b.String()
+}
+
+// fixBadChars rewrites the characters engine can't typeset in the given
+// files. The font encoding and declared characters are read from encFiles.
+// If dryRun is true the files are left untouched and only the report is filled in.
+func fixBadChars(files []string, encFiles []string, texFiles []string, engine string, mode string, dryRun bool) (*fixReport, error) {
+	if mode != FixModeMacro && mode != FixModeDeclare {
+		return nil, fmt.Errorf("unknown fix mode %q (use %s or %s)", mode, FixModeMacro, FixModeDeclare)
+	}
+
+	report := &fixReport{Unmapped: make(map[rune][]string)}
+	used := make(map[rune]bool)
+	t1, declared := false, make(map[rune]bool)
+	for _, file := range append(encFiles, files...) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", file, err)
+		}
+		t1 = readFontSetup(content, declared) || t1
+	}
+	supported := func(r rune) bool {
+		return charSupported(r, engine, t1, declared)
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", file, err)
+		}
+		if !utf8.Valid(content) {
+			logger.Warnf("%s is not valid UTF-8, skipping", file)
+			continue
+		}
+
+		lines := strings.Split(string(content), "\n")
+		changed := false
+		for i, line := range lines {
+			unmapped := make(map[rune]bool)
+			newLine := fixLine(line, mode, supported, used, unmapped)
+			for r := range unmapped {
+				report.Unmapped[r] = append(report.Unmapped[r],
+					fmt.Sprintf("%s:%d: %s", file, i+1, strings.TrimSpace(line)))
+			}
+			if newLine != line {
+				report.Changes = append(report.Changes, fixChange{File: file, Line: i + 1, Old: line, New: newLine})
+				lines[i] = newLine
+				changed = true
+			}
+		}
+
+		if changed && !dryRun {
+			if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+				return nil, fmt.Errorf("error writing %s: %v", file, err)
+			}
+		}
+	}
+
+	if mode == FixModeDeclare && len(used) > 0 {
+		for r := range used {
+			report.Declared = append(report.Declared, r)
+		}
+		sort.Slice(report.Declared, func(i, j int) bool { return report.Declared[i] < report.Declared[j] })
+
+		if !dryRun {
+			for _, texFile := range texFiles {
+				if err := insertUnicodeDeclarations(texFile, report.Declared); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// unicodeDeclaration returns the \DeclareUnicodeCharacter line for a character
+func unicodeDeclaration(r rune) string {
+	return fmt.Sprintf("\\DeclareUnicodeCharacter{%04X}{%s}", r, unicodeReplacements[r])
+}
+
+// insertUnicodeDeclarations adds \DeclareUnicodeCharacter lines before \begin{document}
+func insertUnicodeDeclarations(texFile string, chars []rune) error {
+	content, err := ioutil.ReadFile(texFile)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", texFile, err)
+	}
+
+	idx := strings.Index(string(content), "\\begin{document}")
+	if idx < 0 {
+		// Not a top-level document (e.g. an included chapter), nothing to do
+		return nil
+	}
+
+	var decls strings.Builder
+	for _, r := range chars {
+		decls.WriteString(unicodeDeclaration(r))
+		decls.WriteString("\n")
+	}
+
+	newContent := string(content[:idx]) + decls.String() + string(content[idx:])
+	return ioutil.WriteFile(texFile, []byte(newContent), 0644)
+}
+
+// stagedTextFiles lists the files below dir with one of exts
+func stagedTextFiles(dir string, exts ...string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		for _, ext := range exts {
+			if filepath.Ext(path) == ext {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// printFixReport shows the diff of rewritten lines and any unmapped characters
+func printFixReport(report *fixReport) {
+	for _, change := range report.Changes {
+		logger.Actionf("%s:%d", change.File, change.Line)
+		logger.log(LevelInfo, StyleError, "- %s", change.Old)
+		logger.log(LevelInfo, StyleSuccess, "+ %s", change.New)
+	}
+
+	if len(report.Declared) > 0 {
+		logger.Actionf("Preamble declarations:")
+		for _, r := range report.Declared {
+			logger.Successf("+ %s", unicodeDeclaration(r))
+		}
+	}
+
+	if len(report.Unmapped) > 0 {
+		chars := []rune{}
+		for r := range report.Unmapped {
+			chars = append(chars, r)
+		}
+		sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+
+		logger.Warnf("could not map %d character(s):", len(chars))
+		for _, r := range chars {
+			logger.log(LevelWarn, StylePlain, "  Character '%c' (U+%04X):", r, r)
+			for _, loc := range report.Unmapped[r] {
+				logger.log(LevelWarn, StylePlain, "    %s", loc)
+			}
+		}
+	}
+}
+
+// badChar is a character in a source file that the engine cannot typeset
+type badChar struct {
+	File   string
+	Line   int
+	Column int  // 1-based byte offset within the line
+	Char   rune // utf8.RuneError for invalid UTF-8
+	Text   string
+}
+
+// String formats the location like a compiler diagnostic
+func (b badChar) String() string {
+	if b.Char == utf8.RuneError {
+		return fmt.Sprintf("%s:%d:%d: invalid UTF-8: %s", b.File, b.Line, b.Column, b.Text)
+	}
+	return fmt.Sprintf("%s:%d:%d: '%c' (U+%04X): %s", b.File, b.Line, b.Column, b.Char, b.Char, b.Text)
+}
+
+// scannableExts are the dependency types that are read as text by the engine or bibtex/biber
+var scannableExts = map[string]bool{
+	".tex": true,
+	".bib": true,
+	".bbl": true,
+	".sty": true,
+	".cls": true,
+	".cfg": true,
+	".def": true,
+}
+
+var (
+	fontencRe        = regexp.MustCompile(`\\(?:usepackage|RequirePackage)\[([^\]]*)\]\{fontenc\}`)
+	declareUnicodeRe = regexp.MustCompile(`\\DeclareUnicodeCharacter\{([0-9A-Fa-f]+)\}`)
+	bibResourceRe    = regexp.MustCompile(`\\(?:addbibresource|bibliography)(?:\[[^\]]*\])?\{([^}]+)\}`)
+)
+
+// kernelUnicode are the characters outside Latin-1 letters that the LaTeX
+// kernel declares for pdflatex without any package: the OT1 and TS1
+// (textcomp) definitions loaded by default
+var kernelUnicode = map[rune]bool{
+	// OT1
+	0x00A0: true, 0x00A1: true, 0x00A3: true, 0x00AD: true, 0x00BF: true,
+	0x0131: true, 0x0141: true, 0x0142: true, 0x0152: true, 0x0153: true, 0x0237: true,
+	0x02C6: true, 0x02DC: true, 0x2013: true, 0x2014: true, 0x2018: true, 0x2019: true,
+	0x201C: true, 0x201D: true, 0x2026: true,
+	// TS1
+	0x00A2: true, 0x00A4: true, 0x00A5: true, 0x00A6: true, 0x00A7: true, 0x00A8: true,
+	0x00A9: true, 0x00AA: true, 0x00AC: true, 0x00AE: true, 0x00AF: true, 0x00B0: true,
+	0x00B1: true, 0x00B2: true, 0x00B3: true, 0x00B4: true, 0x00B5: true, 0x00B6: true,
+	0x00B7: true, 0x00B8: true, 0x00B9: true, 0x00BA: true, 0x00BC: true, 0x00BD: true,
+	0x00BE: true, 0x00D7: true, 0x00F7: true, 0x2016: true, 0x2020: true, 0x2021: true,
+	0x2022: true, 0x2030: true, 0x2031: true, 0x2044: true, 0x20AC: true, 0x2103: true,
+	0x2116: true, 0x2122: true, 0x2126: true, 0x2127: true, 0x2190: true, 0x2191: true,
+	0x2192: true, 0x2193: true, 0x2212: true, 0x221A: true, 0x2423: true, 0x25E6: true,
+	0x25EF: true, 0x266A: true,
+}
+
+// t1Unicode are the characters T1 adds to the kernel's set besides Latin Extended-A
+var t1Unicode = map[rune]bool{
+	0x00AB: true, 0x00BB: true, 0x201A: true, 0x201E: true, 0x2039: true, 0x203A: true,
+}
+
+// charSupported reports whether the engine can typeset r with the given font encoding.
+// XeLaTeX and LuaLaTeX read Unicode natively, so only invisible format
+// characters (zero-width spaces, stray byte order marks) are flagged for them.
+func charSupported(r rune, engine string, t1 bool, declared map[rune]bool) bool {
+	if declared[r] {
+		return true
+	}
+	if engine != EnginePdfLaTeX {
+		return !unicode.Is(unicode.Cf, r)
+	}
+	if isSafeRune(r) || kernelUnicode[r] {
+		return true
+	}
+	// Latin Extended-A is covered by inputenc's utf8 definitions for T1
+	if t1 && (r >= 0x100 && r <= 0x17F || t1Unicode[r]) {
+		return true
+	}
+	return false
+}
+
+// readFontSetup reports whether content selects the T1 font encoding and
+// adds the characters it declares with \DeclareUnicodeCharacter to declared
+func readFontSetup(content []byte, declared map[rune]bool) bool {
+	t1 := false
+	for _, match := range fontencRe.FindAllSubmatch(content, -1) {
+		for _, enc := range strings.Split(string(match[1]), ",") {
+			if strings.TrimSpace(enc) == "T1" {
+				t1 = true
+			}
+		}
+	}
+	for _, match := range declareUnicodeRe.FindAllSubmatch(content, -1) {
+		if cp, err := strconv.ParseUint(string(match[1]), 16, 32); err == nil {
+			declared[rune(cp)] = true
+		}
+	}
+	return t1
+}
+
+// stripTexComment removes an unescaped % comment from a line of TeX source
+func stripTexComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '%' {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// scanFilesFor returns the dependencies worth scanning for bad characters,
+// adding any .bib files referenced from them since bibtex/biber read those
+// outside of the recorder.
+func scanFilesFor(deps []string) []string {
+	files := []string{}
+	seen := make(map[string]bool)
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+
+	for _, dep := range deps {
+		if !scannableExts[filepath.Ext(dep)] {
+			continue
+		}
+		add(dep)
+
+		if filepath.Ext(dep) != ".tex" {
+			continue
+		}
+		content, err := ioutil.ReadFile(dep)
+		if err != nil {
+			continue
+		}
+		for _, match := range bibResourceRe.FindAllStringSubmatch(string(content), -1) {
+			for _, bib := range strings.Split(match[1], ",") {
+				bib = strings.TrimSpace(bib)
+				if bib == "" {
+					continue
+				}
+				if filepath.Ext(bib) == "" {
+					bib += ".bib"
+				}
+				if _, err := os.Stat(bib); err == nil {
+					add(bib)
+				}
+			}
+		}
+	}
+
+	return files
+}
+
+// scanBadChars checks every file for characters the engine cannot handle.
+// It reads the sources directly so it does not depend on a previous .log.
+func scanBadChars(files []string, engine string) ([]badChar, error) {
+	contents := make(map[string][]byte)
+	t1 := false
+	declared := make(map[rune]bool)
+
+	// First pass: collect the font encoding and any declared characters
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", file, err)
+		}
+		contents[file] = content
+		t1 = readFontSetup(content, declared) || t1
+	}
+
+	// Second pass: report every offending character with its position
+	found := []badChar{}
+	for _, file := range files {
+		isTex := filepath.Ext(file) != ".bib"
+		for i, line := range strings.Split(string(contents[file]), "\n") {
+			text := line
+			if isTex {
+				text = stripTexComment(line)
+			}
+			for col := 0; col < len(text); {
+				r, size := utf8.DecodeRuneInString(text[col:])
+				if (r == utf8.RuneError && size == 1) || !charSupported(r, engine, t1, declared) {
+					found = append(found, badChar{
+						File:   file,
+						Line:   i + 1,
+						Column: col + 1,
+						Char:   r,
+						Text:   strings.TrimSpace(line),
+					})
+				}
+				col += size
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// printBadChars reports the characters found by scanBadChars
+func printBadChars(found []badChar) {
+	logger.Warnf("found %d problematic character(s) in source files:", len(found))
+	for _, b := range found {
+		logger.log(LevelWarn, StylePlain, "  %s", b)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestFixLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		mode     string
+		engine   string
+		t1       bool
+		declared string
+		want     string
+		used     string
+		unmapped string
+	}{
+		{"greek pdflatex", "α-helix", FixModeMacro, EnginePdfLaTeX, false, "", `\ensuremath{\alpha}-helix`, "", ""},
+		{"greek xelatex", "α-helix", FixModeMacro, EngineXeLaTeX, false, "", "α-helix", "", ""},
+		{"greek lualatex", "Ω", FixModeMacro, EngineLuaLaTeX, false, "", "Ω", "", ""},
+		{"latin extended T1", "Dvořák", FixModeMacro, EnginePdfLaTeX, true, "", "Dvořák", "", ""},
+		{"latin extended OT1", "Dvořák", FixModeMacro, EnginePdfLaTeX, false, "", "Dvořák", "", "ř"},
+		{"combining accent pdflatex", "Cafe\u0301", FixModeMacro, EnginePdfLaTeX, false, "", `Caf\'{e}`, "", ""},
+		{"combining dotless i", "nai\u0308ve", FixModeMacro, EnginePdfLaTeX, false, "", `na\"{\i}ve`, "", ""},
+		{"combining accent xelatex", "Cafe\u0301", FixModeMacro, EngineXeLaTeX, false, "", "Cafe\u0301", "", ""},
+		{"zero width space xelatex", "a\u200bb", FixModeMacro, EngineXeLaTeX, false, "", "ab", "", ""},
+		{"declare mode", "x ≤ y", FixModeDeclare, EnginePdfLaTeX, false, "", "x ≤ y", "≤", ""},
+		{"declare mode accent", "Cafe\u0301 ≤", FixModeDeclare, EnginePdfLaTeX, false, "", `Caf\'{e} ≤`, "≤", ""},
+		{"declared character", "x ≤ y", FixModeMacro, EnginePdfLaTeX, false, "≤", "x ≤ y", "", ""},
+		{"ascii", "plain text", FixModeMacro, EnginePdfLaTeX, false, "", "plain text", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			declared := map[rune]bool{}
+			for _, r := range tt.declared {
+				declared[r] = true
+			}
+			supported := func(r rune) bool { return charSupported(r, tt.engine, tt.t1, declared) }
+			used, unmapped := map[rune]bool{}, map[rune]bool{}
+			if got := fixLine(tt.line, tt.mode, supported, used, unmapped); got != tt.want {
+				t.Errorf("fixLine(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+			if got := runeSet(used); got != tt.used {
+				t.Errorf("used = %q, want %q", got, tt.used)
+			}
+			if got := runeSet(unmapped); got != tt.unmapped {
+				t.Errorf("unmapped = %q, want %q", got, tt.unmapped)
+			}
+		})
+	}
+}
+
+func TestCharSupported(t *testing.T) {
+	tests := []struct {
+		r      rune
+		engine string
+		t1     bool
+		want   bool
+	}{
+		{'é', EnginePdfLaTeX, false, true},
+		{'°', EnginePdfLaTeX, false, true},
+		{'µ', EnginePdfLaTeX, false, true},
+		{'–', EnginePdfLaTeX, false, true},
+		{'€', EnginePdfLaTeX, false, true},
+		{'ř', EnginePdfLaTeX, false, false},
+		{'ř', EnginePdfLaTeX, true, true},
+		{'«', EnginePdfLaTeX, false, false},
+		{'«', EnginePdfLaTeX, true, true},
+		{'α', EnginePdfLaTeX, true, false},
+		{'≤', EnginePdfLaTeX, true, false},
+		{'α', EngineXeLaTeX, false, true},
+		{'\u200b', EngineLuaLaTeX, false, false},
+	}
+	for _, tt := range tests {
+		if got := charSupported(tt.r, tt.engine, tt.t1, nil); got != tt.want {
+			t.Errorf("charSupported(%q, %s, t1=%v) = %v, want %v", tt.r, tt.engine, tt.t1, got, tt.want)
+		}
+	}
+}
+
+func TestScanBadChars(t *testing.T) {
+	dir := t.TempDir()
+	cls := filepath.Join(dir, "paper.cls")
+	tex := filepath.Join(dir, "main.tex")
+	os.WriteFile(cls, []byte("\\RequirePackage[T1]{fontenc}\n"), 0644)
+	os.WriteFile(tex, []byte("25 °C, 5 µm, Dvořák\n% α in a comment\n$α$ \\DeclareUnicodeCharacter{2264}{\\leq} ≤\n"), 0644)
+
+	found, err := scanBadChars([]string{cls, tex}, EnginePdfLaTeX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Char != 'α' || found[0].Line != 3 || found[0].Column != 2 {
+		t.Errorf("scanBadChars = %v, want only the α on line 3", found)
+	}
+}
+
+// runeSet returns the runes of a set in order
+func runeSet(m map[rune]bool) string {
+	var s []rune
+	for r := range m {
+		s = append(s, r)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return string(s)
+}
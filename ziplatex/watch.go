@@ -0,0 +1,254 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultPollInterval is used when native file watching is unavailable
+const defaultPollInterval = time.Second
+
+// fileWatcher reports changes to a set of files
+type fileWatcher interface {
+	// watch replaces the set of watched files
+	watch(files []string) error
+	// changes delivers the paths of changed files
+	changes() <-chan string
+	close()
+}
+
+// newFileWatcher returns an inotify watcher where available, otherwise or if
+// poll is set a watcher polling at that interval
+func newFileWatcher(poll time.Duration) fileWatcher {
+	if poll <= 0 {
+		w, err := newNativeWatcher()
+		if err == nil {
+			return w
+		}
+		logger.Debugf("Native file watching unavailable (%v); polling", err)
+		poll = defaultPollInterval
+	}
+	return newPollWatcher(poll)
+}
+
+// notify queues a change without blocking. If the queue is full a rebuild is
+// already pending, so dropping the path loses nothing.
+func notify(events chan string, path string) {
+	select {
+	case events <- path:
+	default:
+	}
+}
+
+// fileStamp is what the poll watcher compares to detect a change
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// pollWatcher detects changes by comparing sizes and modification times
+type pollWatcher struct {
+	mu     sync.Mutex
+	files  map[string]fileStamp
+	events chan string
+	stop   chan struct{}
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{files: make(map[string]fileStamp), events: make(chan string, 64), stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				w.poll()
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) poll() {
+	w.mu.Lock()
+	changed := []string{}
+	for path, old := range w.files {
+		if stamp := stampFile(path); stamp != old {
+			w.files[path] = stamp
+			changed = append(changed, path)
+		}
+	}
+	w.mu.Unlock()
+	for _, path := range changed {
+		notify(w.events, path)
+	}
+}
+
+func (w *pollWatcher) watch(files []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = make(map[string]fileStamp)
+	for _, path := range files {
+		w.files[path] = stampFile(path)
+	}
+	return nil
+}
+
+func (w *pollWatcher) changes() <-chan string { return w.events }
+
+func (w *pollWatcher) close() { close(w.stop) }
+
+// watch runs the pipeline, then runs it again whenever one of the files the
+// documents depend on changes, until interrupted. Archives from the previous
+// run are replaced, so the output directory always holds an up-to-date bundle.
+func watch(config Config) error {
+	config.Overwrite = true
+	projectDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	watcher := newFileWatcher(config.Poll)
+	defer watcher.close()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	watched := make(map[string]bool)
+	for {
+		// Edits made while the pipeline runs are caught by comparing with
+		// the stamps from before the run
+		start := time.Now()
+		before := make(map[string]fileStamp)
+		for path := range watched {
+			before[path] = stampFile(path)
+		}
+		report = newReport()
+		report.update(func() {
+			report.Engine = config.Engine
+			report.TexFiles = config.TexFiles
+		})
+		err := run(config)
+		if err != nil {
+			report.fail(err)
+		}
+		printWatchSummary(err)
+		// Without the tools nothing will ever build
+		if exitCode(err) == ExitMissingTool {
+			return err
+		}
+
+		// Files stay watched after a failed run, which may not get as far
+		// as finding them
+		for _, path := range append(report.inputs, config.AllFiles...) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(projectDir, path)
+			}
+			watched[filepath.Clean(path)] = true
+		}
+		files := make([]string, 0, len(watched))
+		for path := range watched {
+			files = append(files, path)
+		}
+		sort.Strings(files)
+		if err := watcher.watch(files); err != nil {
+			return err
+		}
+		logger.Infof("Watching %d files for changes (Ctrl-C to stop)", len(files))
+
+		path := changedSince(files, before, start)
+		if path == "" {
+			select {
+			case <-interrupt:
+				return nil
+			case path = <-watcher.changes():
+			}
+		}
+		logger.Notef("%s changed", relativeTo(projectDir, path))
+		// Wait until the edits settle
+		timer := time.NewTimer(config.Debounce)
+	settle:
+		for {
+			select {
+			case <-interrupt:
+				timer.Stop()
+				return nil
+			case path := <-watcher.changes():
+				logger.Debugf("%s changed", relativeTo(projectDir, path))
+				timer.Reset(config.Debounce)
+			case <-timer.C:
+				break settle
+			}
+		}
+	}
+}
+
+// changedSince returns the first of files that changed during a run that
+// began at start: its stamp differs from the one in before, or, for a file
+// the run found, it was modified after start. It returns "" if none did.
+func changedSince(files []string, before map[string]fileStamp, start time.Time) string {
+	for _, path := range files {
+		stamp := stampFile(path)
+		if old, ok := before[path]; ok && stamp != old {
+			return path
+		} else if !ok && stamp.modTime.After(start) {
+			return path
+		}
+	}
+	return ""
+}
+
+// relativeTo shortens path for messages if it is inside dir
+func relativeTo(dir string, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// printWatchSummary shows the outcome of one watch run and the errors found
+// in the sources
+func printWatchSummary(err error) {
+	errorCount, warningCount := 0, 0
+	for _, diag := range report.Diagnostics {
+		if diag.Level == "error" {
+			errorCount++
+		} else {
+			warningCount++
+		}
+	}
+
+	stamp := time.Now().Format("15:04:05")
+	if err != nil {
+		logger.Errorf("[%s] Build failed: %v", stamp, err)
+	} else {
+		archives := []string{}
+		for _, a := range report.Archives {
+			archives = append(archives, filepath.Base(a.Path))
+		}
+		logger.Successf("[%s] Bundle up to date: %s", stamp, strings.Join(archives, ", "))
+	}
+	logger.Infof("%d error(s), %d LaTeX warning(s), %d other warning(s)", errorCount, warningCount, len(report.Warnings))
+	for _, diag := range report.Diagnostics {
+		if diag.Level == "error" {
+			logger.Errorf("%s:%d: %s", diag.File, diag.Line, diag.Message)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask catches files written in place and files replaced by editors
+// that write a new file and rename it
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+// inotifyWatcher watches the directories of the watched files, since a
+// watch on a file is lost when an editor replaces it
+type inotifyWatcher struct {
+	file   *os.File
+	fd     int
+	mu     sync.Mutex
+	dirs   map[string]int // Directory to watch descriptor
+	wds    map[int]string
+	files  map[string]bool
+	events chan string
+}
+
+// newNativeWatcher returns an inotify watcher
+func newNativeWatcher() (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %v", err)
+	}
+	w := &inotifyWatcher{
+		// A non-blocking descriptor goes through the runtime poller, so
+		// closing the file ends a pending read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		dirs:   make(map[string]int),
+		wds:    make(map[int]string),
+		files:  make(map[string]bool),
+		events: make(chan string, 64),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) watch(files []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = make(map[string]bool)
+	needed := make(map[string]bool)
+	for _, path := range files {
+		w.files[path] = true
+		needed[filepath.Dir(path)] = true
+	}
+
+	for dir := range needed {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+		if err != nil {
+			// The directory may not exist yet; its files count as unchanged
+			logger.Debugf("Cannot watch %s: %v", dir, err)
+			continue
+		}
+		w.dirs[dir] = wd
+		w.wds[wd] = dir
+	}
+	for dir, wd := range w.dirs {
+		if !needed[dir] {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, dir)
+			delete(w.wds, wd)
+		}
+	}
+	return nil
+}
+
+// read turns inotify events for watched files into changes
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			end := start + int(event.Len)
+			if end > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[start:end]), "\x00")
+			offset = end
+
+			w.mu.Lock()
+			path := filepath.Join(w.wds[int(event.Wd)], name)
+			watched := w.files[path]
+			w.mu.Unlock()
+			if watched {
+				notify(w.events, path)
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) changes() <-chan string { return w.events }
+
+func (w *inotifyWatcher) close() { w.file.Close() }
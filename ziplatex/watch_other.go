@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// newNativeWatcher is only implemented with inotify; other systems poll
+func newNativeWatcher() (fileWatcher, error) {
+	return nil, fmt.Errorf("not supported on this system")
+}
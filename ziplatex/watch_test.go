@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.tex")
+	other := filepath.Join(dir, "other.tex")
+	os.WriteFile(file, []byte("a"), 0644)
+	os.WriteFile(other, []byte("a"), 0644)
+
+	w := newPollWatcher(10 * time.Millisecond)
+	defer w.close()
+	w.watch([]string{file})
+
+	os.WriteFile(other, []byte("changed"), 0644)
+	os.WriteFile(file, []byte("changed"), 0644)
+	select {
+	case path := <-w.changes():
+		if path != file {
+			t.Errorf("changes() = %s, want %s", path, file)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change reported")
+	}
+
+	os.Remove(file)
+	select {
+	case path := <-w.changes():
+		if path != file {
+			t.Errorf("changes() = %s, want %s", path, file)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("removing the file reported no change")
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	dir := t.TempDir()
+	known := filepath.Join(dir, "known.tex")
+	found := filepath.Join(dir, "found.tex")
+	os.WriteFile(known, []byte("a"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.WriteFile(found, []byte("a"), 0644)
+	os.Chtimes(found, old, old)
+	files := []string{found, known}
+
+	start := time.Now()
+	before := map[string]fileStamp{known: stampFile(known)}
+	if got := changedSince(files, before, start); got != "" {
+		t.Errorf("changedSince = %q before any edit", got)
+	}
+
+	// Edited during the run
+	os.WriteFile(known, []byte("edited"), 0644)
+	if got := changedSince(files, before, start); got != known {
+		t.Errorf("changedSince = %q, want %s", got, known)
+	}
+
+	// First seen in this run and edited after it started
+	before[known] = stampFile(known)
+	later := start.Add(time.Second)
+	os.Chtimes(found, later, later)
+	if got := changedSince(files, before, start); got != found {
+		t.Errorf("changedSince = %q, want %s", got, found)
+	}
+}